@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/keystore"
+)
+
+// デプロイしたサイトにゲートウェイからアクセスするURL
+type accessURLs struct {
+	defaultMode string
+	secureMode  string
+	gatewayHost string
+}
+
+func getAccessURLs(gateway string, replaceable bool, dTag, encoded string) (*accessURLs, error) {
+	pubkey, err := keystore.GetPublic()
+	if err != nil {
+		return nil, err
+	}
+	npub, err := nip19.EncodePublicKey(pubkey)
+	if err != nil {
+		return nil, err
+	}
+
+	gatewayURL, err := url.Parse(gateway)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gateway: %w", err)
+	}
+	defaultModeUrl := strings.TrimSuffix(gatewayURL.String(), "/")
+	secureModeUrl := fmt.Sprintf("%s://%s.%s", gatewayURL.Scheme, npub, gatewayURL.Host)
+
+	if replaceable {
+		defaultModeUrl = fmt.Sprintf("%s/p/%s/d/%s", defaultModeUrl, npub, dTag)
+		secureModeUrl = fmt.Sprintf("%s/d/%s", secureModeUrl, dTag)
+	} else {
+		defaultModeUrl = fmt.Sprintf("%s/e/%s", defaultModeUrl, encoded)
+		secureModeUrl = fmt.Sprintf("%s/e/%s", secureModeUrl, encoded)
+	}
+
+	return &accessURLs{
+		defaultMode: defaultModeUrl,
+		secureMode:  secureModeUrl,
+		gatewayHost: gatewayURL.Host,
+	}, nil
+}
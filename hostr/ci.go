@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/deploy"
+	"github.com/urfave/cli/v2"
+)
+
+// --ciが指定されるか、CIサービスが設定するCI環境変数がある場合は対話せずに実行する。
+// --ci=falseで自動判定を無効にできる
+func isCI(ctx *cli.Context) bool {
+	if ctx.IsSet("ci") {
+		return ctx.Bool("ci")
+	}
+	value := strings.ToLower(os.Getenv("CI"))
+	return len(value) > 0 && value != "false" && value != "0"
+}
+
+// エラーの種類に応じた終了コード
+func exitCodeFor(err error) int {
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, deploy.ErrQuorumNotMet):
+		return exitCodePublishFailed
+	case errors.Is(err, deploy.ErrVerificationFailed):
+		return exitCodeVerifyFailed
+	default:
+		return exitCodeError
+	}
+}
@@ -0,0 +1,158 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// 標準入力から読み込む場合のアーカイブ名
+const Stdin = "-"
+
+// アーカイブと、展開したtarやzipの中身の最大サイズ。アーカイブはメモリに読み込むので、
+// 大きすぎるアーカイブや圧縮爆弾でメモリを使い切らないよう制限する
+const MaxArchiveSize = 1 << 30
+
+// ErrArchiveTooLarge はアーカイブまたは展開後のサイズがMaxArchiveSizeを超える場合のエラー
+var ErrArchiveTooLarge = fmt.Errorf("archive exceeds %d bytes", MaxArchiveSize)
+
+// Open は.tar、.tar.gz、.zipのアーカイブを読み込み、サイトのfs.FSとして返す。
+// nameが"-"の場合はstdinから読み込む。形式は拡張子ではなく先頭のバイト列から判定する。
+// アーカイブのルートにindex.htmlがなく、ディレクトリが1つだけある場合はそのディレクトリをルートにする
+func Open(name string, stdin io.Reader) (fs.FS, error) {
+	reader := stdin
+	if name != Stdin {
+		file, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		reader = file
+	}
+
+	data, err := readAllLimited(reader, MaxArchiveSize)
+	if err != nil {
+		return nil, err
+	}
+
+	fsys, err := load(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return trimSingleRootDir(fsys)
+}
+
+func load(data []byte) (fs.FS, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		gzipReader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer gzipReader.Close()
+
+		tarData, err := readAllLimited(gzipReader, MaxArchiveSize)
+		if err != nil {
+			return nil, err
+		}
+		if !isTar(tarData) {
+			return nil, errors.New("gzip archive does not contain a tar archive")
+		}
+		return loadTar(tarData)
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")), bytes.HasPrefix(data, []byte("PK\x05\x06")):
+		zipReader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, err
+		}
+		// zipのファイルは読み込むときに展開される。展開後のサイズはヘッダーと一致しないと読み込めないので、ヘッダーの合計で制限する
+		var size uint64
+		for _, file := range zipReader.File {
+			size += file.UncompressedSize64
+			if size > MaxArchiveSize {
+				return nil, ErrArchiveTooLarge
+			}
+		}
+		return zipReader, nil
+	case isTar(data):
+		return loadTar(data)
+	}
+	return nil, errors.New("unsupported archive format. Use .tar, .tar.gz or .zip")
+}
+
+// readerをlimitバイトまで読み込む。limitを超える場合はErrArchiveTooLargeを返す
+func readAllLimited(reader io.Reader, limit int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, ErrArchiveTooLarge
+	}
+	return data, nil
+}
+
+// ustar形式とGNU形式のtarはヘッダーのオフセット257に"ustar"を持つ
+func isTar(data []byte) bool {
+	return len(data) >= 262 && string(data[257:262]) == "ustar"
+}
+
+func loadTar(data []byte) (fs.FS, error) {
+	fsys := newMemFS()
+	reader := tar.NewReader(bytes.NewReader(data))
+
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name, ok := cleanEntryName(header.Name)
+		if !ok {
+			return nil, fmt.Errorf("invalid path in archive: %s", header.Name)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			fsys.mkdirAll(name, header.ModTime)
+		case tar.TypeReg:
+			if name == "." {
+				continue
+			}
+			content, err := io.ReadAll(reader)
+			if err != nil {
+				return nil, err
+			}
+			fsys.addFile(name, content, header.FileInfo().Mode(), header.ModTime)
+		}
+		// シンボリックリンクなどの通常ファイル以外はデプロイしない
+	}
+
+	return fsys, nil
+}
+
+// `tar czf site.tar.gz dist`のようにディレクトリごと固めたアーカイブはそのディレクトリをルートにする
+func trimSingleRootDir(fsys fs.FS) (fs.FS, error) {
+	if _, err := fs.Stat(fsys, "index.html"); err == nil {
+		return fsys, nil
+	}
+
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) != 1 || !entries[0].IsDir() {
+		return fsys, nil
+	}
+
+	return fs.Sub(fsys, entries[0].Name())
+}
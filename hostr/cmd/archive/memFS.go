@@ -0,0 +1,135 @@
+package archive
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// tarの内容をメモリ上に保持するfs.FS
+type memFS struct {
+	// [スラッシュ区切りのパス]:[ファイルまたはディレクトリ]。ルートは"."
+	files map[string]*memFile
+}
+
+type memFile struct {
+	name    string
+	data    []byte
+	mode    fs.FileMode
+	modTime time.Time
+	// ディレクトリの場合の直下のエントリの名前
+	children map[string]bool
+}
+
+func newMemFS() *memFS {
+	return &memFS{files: map[string]*memFile{
+		".": {name: ".", mode: fs.ModeDir | 0755, children: map[string]bool{}},
+	}}
+}
+
+// ファイルを追加する。親ディレクトリがなければ作成する
+func (m *memFS) addFile(name string, data []byte, mode fs.FileMode, modTime time.Time) {
+	m.mkdirAll(path.Dir(name), modTime)
+	m.files[name] = &memFile{name: path.Base(name), data: data, mode: mode.Perm(), modTime: modTime}
+	m.files[path.Dir(name)].children[path.Base(name)] = true
+}
+
+func (m *memFS) mkdirAll(name string, modTime time.Time) {
+	if dir, ok := m.files[name]; ok {
+		// 同じ名前のファイルがある場合はディレクトリで置き換える
+		if dir.children == nil {
+			dir.mode = fs.ModeDir | 0755
+			dir.data = nil
+			dir.children = map[string]bool{}
+		}
+		return
+	}
+	m.mkdirAll(path.Dir(name), modTime)
+	m.files[name] = &memFile{name: path.Base(name), mode: fs.ModeDir | 0755, modTime: modTime, children: map[string]bool{}}
+	m.files[path.Dir(name)].children[path.Base(name)] = true
+}
+
+func (m *memFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	file, ok := m.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	if file.children == nil {
+		return &openMemFile{memFile: file, Reader: bytes.NewReader(file.data)}, nil
+	}
+
+	names := []string{}
+	for child := range file.children {
+		names = append(names, child)
+	}
+	sort.Strings(names)
+	entries := []fs.DirEntry{}
+	for _, child := range names {
+		entries = append(entries, fs.FileInfoToDirEntry(m.files[path.Join(name, child)]))
+	}
+	return &openMemDir{memFile: file, entries: entries}, nil
+}
+
+// fs.FileInfoの実装
+func (f *memFile) Name() string       { return f.name }
+func (f *memFile) Size() int64        { return int64(len(f.data)) }
+func (f *memFile) Mode() fs.FileMode  { return f.mode }
+func (f *memFile) ModTime() time.Time { return f.modTime }
+func (f *memFile) IsDir() bool        { return f.children != nil }
+func (f *memFile) Sys() any           { return nil }
+
+type openMemFile struct {
+	*memFile
+	*bytes.Reader
+}
+
+func (f *openMemFile) Stat() (fs.FileInfo, error) { return f.memFile, nil }
+func (f *openMemFile) Close() error               { return nil }
+
+// bytes.ReaderとmemFileのどちらもSizeを持つので明示する
+func (f *openMemFile) Size() int64 { return f.memFile.Size() }
+
+type openMemDir struct {
+	*memFile
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *openMemDir) Stat() (fs.FileInfo, error) { return d.memFile, nil }
+func (d *openMemDir) Close() error               { return nil }
+
+func (d *openMemDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: fs.ErrInvalid}
+}
+
+func (d *openMemDir) ReadDir(count int) ([]fs.DirEntry, error) {
+	remaining := d.entries[d.offset:]
+	if count <= 0 {
+		d.offset = len(d.entries)
+		return remaining, nil
+	}
+	if len(remaining) < 1 {
+		return nil, io.EOF
+	}
+	count = min(count, len(remaining))
+	d.offset += count
+	return remaining[:count], nil
+}
+
+// tarのエントリ名をfs.FSのパスにする。サイトルートの外を指す場合はokがfalseになる
+func cleanEntryName(name string) (string, bool) {
+	name = path.Clean("/" + strings.ReplaceAll(name, "\\", "/"))
+	name = strings.TrimPrefix(name, "/")
+	if len(name) < 1 {
+		return ".", true
+	}
+	return name, fs.ValidPath(name)
+}
@@ -0,0 +1,219 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+const FileName = "hostr.toml"
+
+const DefaultGateway = "https://h.hostr.cc"
+
+// Config はプロジェクトごとのhostr.tomlの内容
+type Config struct {
+	// サイトのディレクトリ。hostr.tomlからの相対パス
+	Path        string       `toml:"path,omitempty"`
+	Identifier  string       `toml:"identifier,omitempty"`
+	Replaceable *bool        `toml:"replaceable,omitempty"`
+	Relays      []string     `toml:"relays,omitempty"`
+	Gateway     string       `toml:"gateway,omitempty"`
+	SPA         bool         `toml:"spa,omitempty"`
+	Upload      UploadConfig `toml:"upload,omitempty"`
+	Ignore      IgnoreConfig `toml:"ignore,omitempty"`
+	// [拡張子またはファイル名]:[Content-Type]
+	MIME map[string]string `toml:"mime,omitempty"`
+
+	// 読み込んだhostr.tomlのパス
+	FilePath string `toml:"-"`
+}
+
+// UploadConfig はメディアのアップロード先
+type UploadConfig struct {
+	Uploader  string `toml:"uploader,omitempty"`
+	Server    string `toml:"server,omitempty"`
+	MediaMode string `toml:"media_mode,omitempty"`
+}
+
+// IgnoreConfig はデプロイ対象から除外するファイル
+type IgnoreConfig struct {
+	GitIgnore     bool     `toml:"gitignore,omitempty"`
+	IncludeHidden bool     `toml:"include_hidden,omitempty"`
+	Patterns      []string `toml:"patterns,omitempty"`
+}
+
+// Find はstartPathから親ディレクトリへ順にhostr.tomlを探す。見つからない場合は空文字列を返す
+func Find(startPath string) (string, error) {
+	dir, err := filepath.Abs(startPath)
+	if err != nil {
+		return "", err
+	}
+	if info, err := os.Stat(dir); err == nil && !info.IsDir() {
+		dir = filepath.Dir(dir)
+	}
+
+	for {
+		filePath := filepath.Join(dir, FileName)
+		if _, err := os.Stat(filePath); err == nil {
+			return filePath, nil
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+// Load はstartPathから見つかったhostr.tomlを読み込む。見つからない場合はnilを返す
+func Load(startPath string) (*Config, error) {
+	filePath, err := Find(startPath)
+	if err != nil || len(filePath) < 1 {
+		return nil, err
+	}
+
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	// 設定名の誤りに気付けるよう未知のキーはエラーにする
+	config := &Config{}
+	decoder := toml.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		var strictErr *toml.StrictMissingError
+		if errors.As(err, &strictErr) {
+			return nil, fmt.Errorf("%s: %s", filePath, strictErr.String())
+		}
+		return nil, fmt.Errorf("%s: %w", filePath, err)
+	}
+	config.FilePath = filePath
+
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", filePath, err)
+	}
+
+	return config, nil
+}
+
+func (c *Config) validate() error {
+	switch c.Upload.Uploader {
+	case "", "nostrcheck", "blossom", "nip96":
+	default:
+		return fmt.Errorf("invalid upload.uploader %q. Must be 'nostrcheck', 'blossom' or 'nip96'", c.Upload.Uploader)
+	}
+	switch c.Upload.MediaMode {
+	case "", "upload", "relay":
+	default:
+		return fmt.Errorf("invalid upload.media_mode %q. Must be 'upload' or 'relay'", c.Upload.MediaMode)
+	}
+	return nil
+}
+
+// ビルド結果を置く一般的なディレクトリのうちindex.htmlがあるものを返す。見つからない場合は"."
+func GuessSitePath(dir string) string {
+	for _, candidate := range []string{"dist", "build", "public", "out"} {
+		if _, err := os.Stat(filepath.Join(dir, candidate, "index.html")); err == nil {
+			return candidate
+		}
+	}
+	return "."
+}
+
+// SitePath はhostr.tomlのあるディレクトリを基準にサイトのディレクトリを返す
+func (c *Config) SitePath() string {
+	if filepath.IsAbs(c.Path) {
+		return c.Path
+	}
+	return filepath.Join(filepath.Dir(c.FilePath), c.Path)
+}
+
+// Init はdirにhostr.tomlの雛形を作成する。既に存在する場合はforceでなければエラーにする
+func Init(dir string, config *Config, force bool) (string, error) {
+	filePath := filepath.Join(dir, FileName)
+	if _, err := os.Stat(filePath); err == nil && !force {
+		return "", fmt.Errorf("%s already exists", filePath)
+	}
+
+	replaceable := true
+	if config.Replaceable != nil {
+		replaceable = *config.Replaceable
+	}
+	gateway := config.Gateway
+	if len(gateway) < 1 {
+		gateway = DefaultGateway
+	}
+	uploader := config.Upload.Uploader
+	if len(uploader) < 1 {
+		uploader = "nostrcheck"
+	}
+	mediaMode := config.Upload.MediaMode
+	if len(mediaMode) < 1 {
+		mediaMode = "upload"
+	}
+
+	var b strings.Builder
+	fmt.Fprintln(&b, "# hostr deploy settings. Command line flags override these values.")
+	fmt.Fprintln(&b, "")
+	fmt.Fprintln(&b, "# Site directory, relative to this file")
+	fmt.Fprintf(&b, "path = %s\n", quote(config.Path))
+	fmt.Fprintln(&b, "# d tag of index.html (NIP-33)")
+	fmt.Fprintf(&b, "identifier = %s\n", quote(config.Identifier))
+	fmt.Fprintf(&b, "replaceable = %t\n", replaceable)
+	fmt.Fprintln(&b, "# Relays to deploy to, instead of ~/.nostr-webhost/.nostr_relays")
+	fmt.Fprintf(&b, "relays = %s\n", quoteList(config.Relays))
+	fmt.Fprintln(&b, "# Gateway shown in the deploy output")
+	fmt.Fprintf(&b, "gateway = %s\n", quote(gateway))
+	fmt.Fprintln(&b, "# Serve index.html for paths that match no file. _redirects rules are applied first")
+	fmt.Fprintf(&b, "spa = %t\n", config.SPA)
+	fmt.Fprintln(&b, "")
+	fmt.Fprintln(&b, "[upload]")
+	fmt.Fprintln(&b, "# 'nostrcheck', 'blossom' or 'nip96'")
+	fmt.Fprintf(&b, "uploader = %s\n", quote(uploader))
+	fmt.Fprintln(&b, "# Required for 'blossom' and 'nip96'")
+	fmt.Fprintf(&b, "server = %s\n", quote(config.Upload.Server))
+	fmt.Fprintln(&b, "# 'upload' or 'relay'")
+	fmt.Fprintf(&b, "media_mode = %s\n", quote(mediaMode))
+	fmt.Fprintln(&b, "")
+	fmt.Fprintln(&b, "[ignore]")
+	fmt.Fprintln(&b, "# Also exclude files listed in the site's .gitignore")
+	fmt.Fprintf(&b, "gitignore = %t\n", config.Ignore.GitIgnore)
+	fmt.Fprintln(&b, "# Deploy files and directories whose names start with a dot")
+	fmt.Fprintf(&b, "include_hidden = %t\n", config.Ignore.IncludeHidden)
+	fmt.Fprintln(&b, "# .gitignore style patterns, applied before the site's .hostrignore")
+	fmt.Fprintf(&b, "patterns = %s\n", quoteList(config.Ignore.Patterns))
+	fmt.Fprintln(&b, "")
+	fmt.Fprintln(&b, "[mime]")
+	fmt.Fprintln(&b, "# Content-Type by extension or file name, overriding the built-in detection.")
+	fmt.Fprintln(&b, "# Images, video and audio are uploaded as media, everything else is stored on relays.")
+	fmt.Fprintln(&b, "# \".glb\" = \"model/gltf-binary\"")
+	fmt.Fprintln(&b, "# \"CNAME\" = \"text/plain; charset=utf-8\"")
+
+	err := os.WriteFile(filePath, []byte(b.String()), 0644)
+	if err != nil {
+		return "", err
+	}
+	return filePath, nil
+}
+
+func quote(value string) string {
+	quoted, _ := toml.Marshal(map[string]string{"v": value})
+	return strings.TrimSpace(strings.TrimPrefix(string(quoted), "v = "))
+}
+
+func quoteList(values []string) string {
+	quoted := []string{}
+	for _, value := range values {
+		quoted = append(quoted, quote(value))
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
@@ -10,4 +10,6 @@ const (
 	KindWebhostReplaceableCSS  = 35393
 	KindWebhostReplaceableJS   = 35394
 	KindReplaceableTextFile    = 30064
+	KindWebhostSiteManifest    = 35391
+	KindDeletion               = 5
 )
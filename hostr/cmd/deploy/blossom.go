@@ -0,0 +1,162 @@
+package deploy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/keystore"
+)
+
+// Blossomの認可イベントのkind (BUD-01)
+const KindBlossomAuthorization = 24242
+
+// 認可イベントの有効期限
+const blossomAuthorizationExpiration = 5 * time.Minute
+
+// BlobDescriptor はBlossomサーバーが返すBlobの情報 (BUD-02)
+type BlobDescriptor struct {
+	URL      string `json:"url"`
+	Sha256   string `json:"sha256"`
+	Size     int64  `json:"size"`
+	Type     string `json:"type,omitempty"`
+	Uploaded int64  `json:"uploaded"`
+}
+
+// Blossom (BUD-01/02) サーバーへアップロードする
+type blossomUploader struct {
+	server string
+	signer keystore.Signer
+	pubKey string
+	client *http.Client
+}
+
+func newBlossomUploader(server string, signer keystore.Signer, pubKey string) *blossomUploader {
+	return &blossomUploader{
+		server: strings.TrimSuffix(server, "/"),
+		signer: signer,
+		pubKey: pubKey,
+		client: &http.Client{},
+	}
+}
+
+func (u *blossomUploader) Name() string {
+	return UploaderBlossom + ":" + u.server
+}
+
+func (u *blossomUploader) Upload(filePath, contentType string, content []byte, hash string) (string, error) {
+	// sha256でアドレスされるので、既にアップロード済みであれば再利用する
+	blobURL := u.server + "/" + hash + strings.ToLower(filepath.Ext(filePath))
+	exists, err := u.exists(blobURL)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		return blobURL, nil
+	}
+
+	// 認可イベントを生成
+	auth, err := u.getAuthorization("upload", "Upload "+filepath.Base(filePath), hash)
+	if err != nil {
+		return "", err
+	}
+
+	request, err := http.NewRequest(http.MethodPut, u.server+"/upload", bytes.NewReader(content))
+	if err != nil {
+		return "", fmt.Errorf("Error creating request: %w", err)
+	}
+	request.Header.Set("Authorization", auth)
+	request.Header.Set("Content-Type", contentType)
+
+	response, err := u.client.Do(request)
+	if err != nil {
+		return "", fmt.Errorf("Error sending request: %w", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return "", fmt.Errorf("Failed to upload: %d %s", response.StatusCode, response.Header.Get("X-Reason"))
+	}
+
+	var descriptor BlobDescriptor
+	err = json.NewDecoder(response.Body).Decode(&descriptor)
+	if err != nil {
+		return "", fmt.Errorf("Error decoding response: %w", err)
+	}
+
+	if descriptor.Sha256 != "" && descriptor.Sha256 != hash {
+		return "", fmt.Errorf("Hash mismatch: expected %s but got %s", hash, descriptor.Sha256)
+	}
+	if len(descriptor.URL) < 1 {
+		return blobURL, nil
+	}
+
+	return descriptor.URL, nil
+}
+
+// 認可イベントを付けてDELETEリクエストを送りBlobを削除する (BUD-02)
+func (u *blossomUploader) Delete(blobURL, hash string) error {
+	auth, err := u.getAuthorization("delete", "Delete "+hash, hash)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest(http.MethodDelete, u.server+"/"+hash, nil)
+	if err != nil {
+		return fmt.Errorf("Error creating request: %w", err)
+	}
+	request.Header.Set("Authorization", auth)
+
+	response, err := u.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("Error sending request: %w", err)
+	}
+	response.Body.Close()
+
+	// 既に削除されている場合も成功とみなす
+	if response.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("Failed to delete: %d %s", response.StatusCode, response.Header.Get("X-Reason"))
+	}
+
+	return nil
+}
+
+// HEADリクエストでBlobの存在を確認する
+func (u *blossomUploader) exists(blobURL string) (bool, error) {
+	response, err := u.client.Head(blobURL)
+	if err != nil {
+		return false, fmt.Errorf("Error sending request: %w", err)
+	}
+	response.Body.Close()
+	return response.StatusCode == http.StatusOK, nil
+}
+
+// kind 24242の認可イベントをAuthorizationヘッダーの値として取得する
+func (u *blossomUploader) getAuthorization(verb, content, hash string) (string, error) {
+	tags := nostr.Tags{
+		nostr.Tag{"t", verb},
+		nostr.Tag{"x", hash},
+		nostr.Tag{"expiration", fmt.Sprint(time.Now().Add(blossomAuthorizationExpiration).Unix())},
+	}
+
+	ev, err := getSignedEvent(u.signer, u.pubKey, content, KindBlossomAuthorization, tags)
+	if err != nil {
+		return "", fmt.Errorf("Error get event: %w", err)
+	}
+
+	evJson, err := ev.MarshalJSON()
+	if err != nil {
+		return "", fmt.Errorf("Error marshaling event: %w", err)
+	}
+
+	return "Nostr " + base64.StdEncoding.EncodeToString(evJson), nil
+}
@@ -0,0 +1,44 @@
+package deploy
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/tools"
+)
+
+const CompressionNone = "none"
+
+func (s *deployState) setContentEncoding(compression string) error {
+	switch compression {
+	case "", CompressionNone:
+		s.contentEncoding = ""
+	case tools.EncodingGzip, tools.EncodingBrotli:
+		s.contentEncoding = compression
+	default:
+		return fmt.Errorf("Invalid compression: %s", compression)
+	}
+	return nil
+}
+
+// rawを圧縮してbase64エンコードし、encodingタグを付与したタグを返す。
+// 圧縮しない場合や圧縮しても小さくならない場合はplainContentとtagsをそのまま返す
+func (s *deployState) compressEventContent(raw []byte, plainContent string, tags nostr.Tags) (string, nostr.Tags) {
+	if len(s.contentEncoding) < 1 {
+		return plainContent, tags
+	}
+
+	compressed, err := tools.Compress(raw, s.contentEncoding)
+	if err != nil {
+		fmt.Fprintln(s.log, "❌ Failed to compress content:", err)
+		return plainContent, tags
+	}
+
+	content := base64.StdEncoding.EncodeToString(compressed)
+	if len(content) >= len(plainContent) {
+		return plainContent, tags
+	}
+
+	return content, tags.AppendUnique(nostr.Tag{"encoding", s.contentEncoding})
+}
@@ -0,0 +1,565 @@
+package deploy
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/consts"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/paths"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/relays"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/tools"
+)
+
+// 1つの削除リクエストに含めるe・aタグの数
+const deletionBatchSize = 100
+
+// 削除対象のイベントの取得を待つ時間
+const deleteQueryTimeout = 30 * time.Second
+
+// 削除対象のイベントを1度に取得する数
+const deleteQueryLimit = 500
+
+// イベントのcontentに含まれるneventを検出する
+var neventPattern = regexp.MustCompile(`nevent1[02-9ac-hj-np-z]+`)
+
+// 削除対象のイベントとメディア
+type deletionTarget struct {
+	// [event id]:[kind]
+	eventIDs map[string]int
+	// [kind:pubkey:d]:[kind]
+	addresses map[string]int
+	// [url]:[sha256]
+	media map[string]string
+	// 削除後に取り除くローカルのマニフェスト
+	manifestFilePaths []string
+	// メディアのアップロード先
+	uploader string
+}
+
+func newDeletionTarget() *deletionTarget {
+	return &deletionTarget{
+		eventIDs:  map[string]int{},
+		addresses: map[string]int{},
+		media:     map[string]string{},
+	}
+}
+
+func (t *deletionTarget) addEvent(event *nostr.Event) {
+	t.eventIDs[event.ID] = event.Kind
+	if isAddressableKind(event.Kind) {
+		if dTag := event.Tags.GetFirst([]string{"d", ""}); dTag != nil {
+			t.addresses[fmt.Sprintf("%d:%s:%s", event.Kind, event.PubKey, dTag.Value())] = event.Kind
+		}
+	}
+	// チャンクに分割されたメディアのチャンク
+	for _, tag := range event.Tags.GetAll([]string{"chunk"}) {
+		if _, ok := t.eventIDs[tag.Value()]; !ok {
+			t.eventIDs[tag.Value()] = consts.KindTextFile
+		}
+	}
+}
+
+// マニフェストやデプロイ履歴に記録されたイベントとメディアを追加する
+func (t *deletionTarget) addManifestEntries(pubKey string, entries map[string]*ManifestEntry) {
+	for _, entry := range entries {
+		if len(entry.EventID) > 0 {
+			if _, ok := t.eventIDs[entry.EventID]; !ok {
+				t.eventIDs[entry.EventID] = entry.Kind
+			}
+			if len(entry.DTag) > 0 && isAddressableKind(entry.Kind) {
+				t.addresses[fmt.Sprintf("%d:%s:%s", entry.Kind, pubKey, entry.DTag)] = entry.Kind
+			}
+		}
+		if len(entry.URL) > 0 {
+			t.media[entry.URL] = entry.Hash
+		}
+	}
+}
+
+// ローカルのマニフェストに記録されたイベントとメディアを追加する
+func (t *deletionTarget) addManifest(pubKey, filePath string, manifest *Manifest) {
+	t.addManifestEntries(pubKey, manifest.Files)
+	if len(manifest.Uploader) > 0 {
+		t.uploader = manifest.Uploader
+	}
+	t.manifestFilePaths = append(t.manifestFilePaths, filePath)
+}
+
+// Delete はサイトのすべてのイベントにNIP-09の削除リクエストを送り、アップロードしたメディアを削除する。
+// htmlIdentifierを指定した場合はReplaceableなサイト、eventRefを指定した場合はそのイベントから参照を辿れるサイトを削除する
+func (d *Deployer) Delete(htmlIdentifier, eventRef string) (int, error) {
+	s, err := d.newState()
+	if err != nil {
+		fmt.Fprintln(d.logWriter(), "❌ Failed to prepare delete:", err)
+		return 0, err
+	}
+
+	fmt.Fprintln(s.log, "🔍 Finding events...")
+
+	target := newDeletionTarget()
+	if len(htmlIdentifier) > 0 {
+		err = s.findReplaceableSiteEvents(htmlIdentifier, target)
+	} else {
+		err = s.findEventGraph(eventRef, target)
+	}
+	if err != nil {
+		fmt.Fprintln(s.log, "❌ Failed to find events:", err)
+		return 0, err
+	}
+
+	if len(target.eventIDs) < 1 && len(target.addresses) < 1 && len(target.media) < 1 {
+		err := fmt.Errorf("no events of %s were found", htmlIdentifier+eventRef)
+		fmt.Fprintln(s.log, "❌ Failed to delete:", err)
+		return 0, err
+	}
+
+	fmt.Fprintf(s.log, "🗑 Found %d events, %d addresses and %d media files\n", len(target.eventIDs), len(target.addresses), len(target.media))
+
+	if s.dryRun {
+		for _, id := range sortedKeys(target.eventIDs) {
+			fmt.Fprintln(s.log, "  e", id)
+		}
+		for _, address := range sortedKeys(target.addresses) {
+			fmt.Fprintln(s.log, "  a", address)
+		}
+		for _, url := range sortedKeys(target.media) {
+			fmt.Fprintln(s.log, "  media", url)
+		}
+		return 0, nil
+	}
+
+	if !d.Options.Yes && (d.Confirm == nil || !d.Confirm("Delete them from all relays?")) {
+		fmt.Fprintln(s.log, "Canceled.")
+		return 0, nil
+	}
+
+	// 削除リクエストを生成してキューに追加
+	deletions, err := s.generateDeletionEvents(target)
+	if err != nil {
+		fmt.Fprintln(s.log, "❌ Failed to get deletion event:", err)
+		return 0, err
+	}
+	for i, deletion := range deletions {
+		key := fmt.Sprintf("#deletion-%d", i+1)
+		s.currentManifest.Files[key] = &ManifestEntry{EventID: deletion.ID, Kind: deletion.Kind}
+		s.addNostrEventQueue(deletion, key)
+	}
+
+	_, err = s.publishEventsFromQueue()
+	if err != nil {
+		fmt.Fprintln(s.log, "❌ Failed to publish:", err)
+		return 0, err
+	}
+
+	// アップロードしたメディアを削除する
+	err = s.deleteUploadedMedia(target)
+	if err != nil {
+		fmt.Fprintln(s.log, "❌ Failed to delete media:", err)
+		return 0, err
+	}
+
+	// 次回のデプロイですべてのファイルを再度publishするためにマニフェストを取り除く
+	for _, filePath := range target.manifestFilePaths {
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintln(s.log, "❌ Failed to remove manifest:", err)
+			return 0, err
+		}
+	}
+
+	return len(target.eventIDs), nil
+}
+
+// サイトのマニフェストと、dタグがidentifierと一致するかidentifier以下のパスであるイベントを取得する。
+// identifier以下に別のサイトがある場合、そのサイトのイベントは含めない
+func (s *deployState) findReplaceableSiteEvents(htmlIdentifier string, target *deletionTarget) error {
+	ctx, cancel := context.WithTimeout(context.Background(), deleteQueryTimeout)
+	defer cancel()
+
+	// リレーはdタグの前方一致で検索できないので、kindで取得してから絞り込む
+	pool := relays.NewPool(ctx, s.signer)
+	defer pool.Close()
+	events := queryAllEvents(ctx, pool, s.allRelays, nostr.Filter{
+		Kinds: []int{
+			consts.KindWebhostSiteManifest,
+			consts.KindWebhostReplaceableHTML,
+			consts.KindWebhostReplaceableCSS,
+			consts.KindWebhostReplaceableJS,
+			consts.KindReplaceableTextFile,
+		},
+		Authors: []string{s.pubKey},
+	})
+
+	// マニフェストのあるサイトのidentifier。マニフェストのない以前のバージョンのサイトも対象にする
+	identifiers := []string{htmlIdentifier}
+	for _, event := range events {
+		if event.Kind == consts.KindWebhostSiteManifest {
+			identifiers = append(identifiers, getDTagValue(event))
+		}
+	}
+
+	fileIDs := []string{}
+	// 同じ内容のファイルは同じイベントやメディアを使うので、他のサイトから参照されているものは削除しない
+	sharedIDs := map[string]bool{}
+	// アップロードしたメディアはハッシュで保存されるので、ハッシュとURLの両方で判定する
+	sharedMediaHashes := map[string]bool{}
+	sharedMediaURLs := map[string]bool{}
+	for _, event := range events {
+		owned := findSiteIdentifier(getDTagValue(event), identifiers) == htmlIdentifier
+		if owned {
+			target.addEvent(event)
+		}
+
+		if event.Kind != consts.KindWebhostSiteManifest {
+			continue
+		}
+		for _, tag := range event.Tags.GetAll([]string{"file"}) {
+			if len(tag) < 3 {
+				continue
+			}
+			switch {
+			case !owned:
+				if len(tag[2]) > 0 {
+					sharedIDs[tag[2]] = true
+				}
+				if len(tag) > 4 {
+					if len(tag[3]) > 0 {
+						sharedMediaHashes[tag[3]] = true
+					}
+					sharedMediaURLs[tag[4]] = true
+				}
+			case len(tag) > 4:
+				target.media[tag[4]] = tag[3]
+			case len(tag[2]) > 0:
+				fileIDs = append(fileIDs, tag[2])
+			}
+		}
+	}
+	fileIDs = slices.DeleteFunc(fileIDs, func(id string) bool { return sharedIDs[id] })
+
+	// マニフェストから参照されるファイルはdタグを持たないので、IDで取得してチャンクも含めて追加する
+	if len(fileIDs) > 0 {
+		for event := range pool.SubManyEose(ctx, s.allRelays, nostr.Filters{{
+			IDs:     fileIDs,
+			Authors: []string{s.pubKey},
+		}}) {
+			target.addEvent(event)
+		}
+		for _, id := range fileIDs {
+			if _, ok := target.eventIDs[id]; !ok {
+				target.eventIDs[id] = 0
+			}
+		}
+	}
+
+	// リレーから消えていてもローカルに記録されているイベントとメディアは削除する
+	manifestFilePath, err := getManifestFilePath(s.pubKey, "", true, htmlIdentifier)
+	if err != nil {
+		return err
+	}
+	manifest, err := loadManifest(manifestFilePath)
+	if err != nil {
+		return err
+	}
+	target.addManifest(s.pubKey, manifestFilePath, manifest)
+
+	// ファイルは置き換えられないイベントなので、以前のデプロイのイベントもneventで配信され続ける。
+	// デプロイ履歴に記録されたすべてのバージョンのイベントとメディアも削除する
+	historyDir, err := getHistoryDirectory(s.pubKey, htmlIdentifier)
+	if err != nil {
+		return err
+	}
+	versions, err := loadDeployHistory(historyDir)
+	if err != nil {
+		return err
+	}
+	for _, version := range versions {
+		target.addManifestEntries(s.pubKey, version.Files)
+		if len(version.SiteManifestEventID) > 0 {
+			target.eventIDs[version.SiteManifestEventID] = consts.KindWebhostSiteManifest
+		}
+	}
+
+	for id := range sharedIDs {
+		delete(target.eventIDs, id)
+	}
+	for url, hash := range target.media {
+		if sharedMediaURLs[url] || sharedMediaHashes[hash] {
+			delete(target.media, url)
+		}
+	}
+
+	return nil
+}
+
+// filterに一致するイベントを、created_atの新しい順にdeleteQueryLimitずつ遡ってすべて取得する
+func queryAllEvents(ctx context.Context, pool *relays.Pool, urls []string, filter nostr.Filter) []*nostr.Event {
+	events := []*nostr.Event{}
+	seen := map[string]bool{}
+
+	filter.Limit = deleteQueryLimit
+	for ctx.Err() == nil {
+		found := 0
+		var oldest nostr.Timestamp
+		for event := range pool.SubManyEose(ctx, urls, nostr.Filters{filter}) {
+			if oldest == 0 || event.CreatedAt < oldest {
+				oldest = event.CreatedAt
+			}
+			if seen[event.ID] {
+				continue
+			}
+			seen[event.ID] = true
+			events = append(events, event)
+			found++
+		}
+		if found < 1 {
+			break
+		}
+
+		// 同じcreated_atのイベントが次のページにまたがる場合があるので、最も古いcreated_atも含めて取得する
+		until := oldest
+		filter.Until = &until
+	}
+
+	return events
+}
+
+// dタグのパスを含むサイトのうち、最も深い階層のidentifierを返す。どのサイトにも含まれない場合は空文字を返す
+func findSiteIdentifier(dTag string, identifiers []string) string {
+	found := ""
+	for _, identifier := range identifiers {
+		if dTag != identifier && !strings.HasPrefix(dTag, identifier+"/") {
+			continue
+		}
+		if len(identifier) > len(found) {
+			found = identifier
+		}
+	}
+	return found
+}
+
+func getDTagValue(event *nostr.Event) string {
+	dTag := event.Tags.GetFirst([]string{"d", ""})
+	if dTag == nil {
+		return ""
+	}
+	return dTag.Value()
+}
+
+// eventRefのイベントから、contentのneventとチャンクを辿ってサイトのイベントを取得する
+func (s *deployState) findEventGraph(eventRef string, target *deletionTarget) error {
+	rootID, err := decodeEventRef(eventRef)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), deleteQueryTimeout)
+	defer cancel()
+
+	pool := relays.NewPool(ctx, s.signer)
+	defer pool.Close()
+
+	target.addEventGraph(rootID, func(ids []string) <-chan *nostr.Event {
+		return pool.SubManyEose(ctx, s.allRelays, nostr.Filters{{
+			IDs:     ids,
+			Authors: []string{s.pubKey},
+		}})
+	})
+
+	if _, ok := target.eventIDs[rootID]; !ok {
+		fmt.Fprintln(s.log, "⚠️ Event", rootID, "was not found on relays")
+	}
+
+	// アップロードしたメディアはイベントから辿れないので、このサイトをデプロイしたマニフェストから取得する
+	return findManifestsByEventID(s.pubKey, rootID, target)
+}
+
+// rootIDのイベントから参照を辿れるイベントをすべて追加する。fetchはIDのイベントを取得する
+func (t *deletionTarget) addEventGraph(rootID string, fetch func(ids []string) <-chan *nostr.Event) {
+	visited := map[string]bool{rootID: true}
+	frontier := []string{rootID}
+	for len(frontier) > 0 {
+		next := []string{}
+		for event := range fetch(frontier) {
+			if _, ok := t.eventIDs[event.ID]; ok {
+				continue
+			}
+			t.addEvent(event)
+
+			for _, id := range getEventReferences(event) {
+				if !visited[id] {
+					visited[id] = true
+					next = append(next, id)
+				}
+			}
+		}
+		frontier = next
+	}
+}
+
+// イベントのチャンクと、デプロイ時に書き換えられたcontentのneventが指すイベントのIDを返す
+func getEventReferences(event *nostr.Event) []string {
+	refs := []string{}
+	for _, tag := range event.Tags.GetAll([]string{"chunk"}) {
+		refs = append(refs, tag.Value())
+	}
+
+	isTextFile := false
+	switch event.Kind {
+	case consts.KindTextFile, consts.KindReplaceableTextFile:
+		isTextFile = true
+	case consts.KindWebhostHTML, consts.KindWebhostCSS, consts.KindWebhostJS,
+		consts.KindWebhostReplaceableHTML, consts.KindWebhostReplaceableCSS, consts.KindWebhostReplaceableJS:
+	default:
+		return refs
+	}
+
+	// 圧縮されている場合は展開してから探す
+	content, _, err := tools.GetResponseContent(event, isTextFile, "")
+	if err != nil {
+		return refs
+	}
+	for _, nevent := range neventPattern.FindAllString(string(content), -1) {
+		if id, err := decodeEventRef(nevent); err == nil {
+			refs = append(refs, id)
+		}
+	}
+	return refs
+}
+
+// 設定ディレクトリのマニフェストのうちeventIDを含むものを追加する
+func findManifestsByEventID(pubKey, eventID string, target *deletionTarget) error {
+	dir, err := paths.GetSettingsDirectory()
+	if err != nil {
+		return err
+	}
+	filePaths, err := filepath.Glob(filepath.Join(dir, ManifestDirName, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	for _, filePath := range filePaths {
+		manifest, err := loadManifest(filePath)
+		if err != nil {
+			continue
+		}
+		for _, entry := range manifest.Files {
+			if entry.EventID == eventID {
+				target.addManifest(pubKey, filePath, manifest)
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+// hexまたはneventからイベントIDを取得する
+func decodeEventRef(eventRef string) (string, error) {
+	if !strings.HasPrefix(eventRef, "nevent") {
+		if _, err := hex.DecodeString(eventRef); err != nil || len(eventRef) != 64 {
+			return "", fmt.Errorf("invalid event id: %s", eventRef)
+		}
+		return eventRef, nil
+	}
+	_, data, err := nip19.Decode(eventRef)
+	if err != nil {
+		return "", err
+	}
+	pointer, ok := data.(nostr.EventPointer)
+	if !ok {
+		return "", fmt.Errorf("failed to decode nevent")
+	}
+	return pointer.ID, nil
+}
+
+// e・a・kタグを含む削除リクエストをdeletionBatchSizeずつ生成する
+func (s *deployState) generateDeletionEvents(target *deletionTarget) ([]*nostr.Event, error) {
+	refs := nostr.Tags{}
+	kinds := []int{}
+	for _, id := range sortedKeys(target.eventIDs) {
+		refs = append(refs, nostr.Tag{"e", id})
+		kinds = append(kinds, target.eventIDs[id])
+	}
+	for _, address := range sortedKeys(target.addresses) {
+		refs = append(refs, nostr.Tag{"a", address})
+		kinds = append(kinds, target.addresses[address])
+	}
+
+	deletions := []*nostr.Event{}
+	for start := 0; start < len(refs); start += deletionBatchSize {
+		end := min(start+deletionBatchSize, len(refs))
+		tags := append(nostr.Tags{}, refs[start:end]...)
+
+		batchKinds := map[int]bool{}
+		for _, kind := range kinds[start:end] {
+			if kind > 0 {
+				batchKinds[kind] = true
+			}
+		}
+		for _, kind := range sortedKeys(batchKinds) {
+			tags = append(tags, nostr.Tag{"k", fmt.Sprint(kind)})
+		}
+
+		deletion, err := s.getEvent("", consts.KindDeletion, tags)
+		if err != nil {
+			return nil, err
+		}
+		deletions = append(deletions, deletion)
+	}
+
+	return deletions, nil
+}
+
+// マニフェストに記録されたアップロード先からメディアを削除する
+func (s *deployState) deleteUploadedMedia(target *deletionTarget) error {
+	if len(target.media) < 1 {
+		return nil
+	}
+
+	uploader, err := newUploaderFromName(target.uploader, s.signer, s.pubKey, s.log)
+	if err != nil {
+		return err
+	}
+	deleter, ok := uploader.(Deleter)
+	if !ok {
+		fmt.Fprintln(s.log, "⚠️", uploader.Name(), "does not support deleting media. Please delete them manually:")
+		for _, url := range sortedKeys(target.media) {
+			fmt.Fprintln(s.log, "  ", url)
+		}
+		return nil
+	}
+
+	failed := 0
+	for _, url := range sortedKeys(target.media) {
+		if err := deleter.Delete(url, target.media[url]); err != nil {
+			fmt.Fprintln(s.log, "❌ Failed to delete", url, ":", err)
+			failed++
+			continue
+		}
+		fmt.Fprintln(s.log, "Deleted", url)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d media files could not be deleted", failed, len(target.media))
+	}
+
+	return nil
+}
+
+func sortedKeys[K string | int, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
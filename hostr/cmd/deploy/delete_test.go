@@ -0,0 +1,112 @@
+package deploy
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/consts"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/tools"
+)
+
+// テスト用の署名済みイベントを生成する
+func newSignedEvent(t *testing.T, secretKey string, kind int, content string, tags nostr.Tags) *nostr.Event {
+	t.Helper()
+	event := &nostr.Event{Kind: kind, Content: content, Tags: tags, CreatedAt: nostr.Now()}
+	if err := event.Sign(secretKey); err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func encodeTestNevent(t *testing.T, id string) string {
+	t.Helper()
+	nevent, err := nip19.EncodeEvent(id, []string{"wss://relay.example.com"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nevent
+}
+
+// Replaceableでないサイトのindex.html → style.css → 画像(チャンク)の参照をすべて辿る
+func TestAddEventGraph(t *testing.T) {
+	secretKey := nostr.GeneratePrivateKey()
+
+	chunk := newSignedEvent(t, secretKey, consts.KindTextFile, base64.StdEncoding.EncodeToString([]byte("png")), nostr.Tags{
+		nostr.Tag{"type", "application/octet-stream"},
+		nostr.Tag{"part", "0", "1"},
+	})
+	image := newSignedEvent(t, secretKey, consts.KindTextFile, "", nostr.Tags{
+		nostr.Tag{"type", "image/png"},
+		nostr.Tag{"chunk", chunk.ID},
+	})
+	css := newSignedEvent(t, secretKey, consts.KindWebhostCSS,
+		"body { background: url(/e/"+encodeTestNevent(t, image.ID)+"); }", nil)
+
+	// 圧縮されたcontentも展開してneventを探す
+	html := "<link rel=\"stylesheet\" href=\"/e/" + encodeTestNevent(t, css.ID) + "\">"
+	compressed, err := tools.Compress([]byte(html), tools.EncodingGzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := newSignedEvent(t, secretKey, consts.KindWebhostHTML, base64.StdEncoding.EncodeToString(compressed), nostr.Tags{
+		nostr.Tag{"encoding", tools.EncodingGzip},
+	})
+
+	// 参照されていないイベントは含めない
+	unrelated := newSignedEvent(t, secretKey, consts.KindWebhostJS, "console.log(1)", nil)
+
+	store := map[string]*nostr.Event{}
+	for _, event := range []*nostr.Event{index, css, image, chunk, unrelated} {
+		store[event.ID] = event
+	}
+
+	target := newDeletionTarget()
+	target.addEventGraph(index.ID, func(ids []string) <-chan *nostr.Event {
+		events := make(chan *nostr.Event, len(ids))
+		for _, id := range ids {
+			if event, ok := store[id]; ok {
+				events <- event
+			}
+		}
+		close(events)
+		return events
+	})
+
+	want := map[string]int{
+		index.ID: consts.KindWebhostHTML,
+		css.ID:   consts.KindWebhostCSS,
+		image.ID: consts.KindTextFile,
+		chunk.ID: consts.KindTextFile,
+	}
+	if len(target.eventIDs) != len(want) {
+		t.Fatalf("eventIDs = %v, want %v", target.eventIDs, want)
+	}
+	for id, kind := range want {
+		if target.eventIDs[id] != kind {
+			t.Errorf("eventIDs[%s] = %d, want %d", id, target.eventIDs[id], kind)
+		}
+	}
+}
+
+func TestFindSiteIdentifier(t *testing.T) {
+	identifiers := []string{"blog", "blog/v2", "blogger"}
+
+	tests := map[string]string{
+		"blog":                 "blog",
+		"blog/index.html":      "blog",
+		"blog/v2":              "blog/v2",
+		"blog/v2/index.html":   "blog/v2",
+		"blog/v20/index.html":  "blog",
+		"blogger/index.html":   "blogger",
+		"other/index.html":     "",
+		"blog-old/style.css":   "",
+		"blog/v2/assets/a.css": "blog/v2",
+	}
+	for dTag, want := range tests {
+		if got := findSiteIdentifier(dTag, identifiers); got != want {
+			t.Errorf("findSiteIdentifier(%q) = %q, want %q", dTag, got, want)
+		}
+	}
+}
@@ -1,20 +1,14 @@
 package deploy
 
 import (
-	"bufio"
-	"bytes"
+	"errors"
 	"fmt"
+	"io/fs"
 	"net/url"
-	"os"
-	"path/filepath"
-	"strings"
 
-	"github.com/nbd-wtf/go-nostr"
 	"github.com/nbd-wtf/go-nostr/nip19"
 	"github.com/studiokaiji/nostr-webhost/hostr/cmd/consts"
-	"github.com/studiokaiji/nostr-webhost/hostr/cmd/keystore"
-	"github.com/studiokaiji/nostr-webhost/hostr/cmd/relays"
-	"golang.org/x/net/html"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/tools"
 )
 
 func isExternalURL(urlStr string) bool {
@@ -22,184 +16,263 @@ func isExternalURL(urlStr string) bool {
 	return err == nil && u.Scheme != "" && u.Host != ""
 }
 
-func Deploy(basePath string, replaceable bool, htmlIdentifier string) (string, string, string, error) {
-	// 引数からデプロイしたいサイトのパスを受け取る。
-	filePath := filepath.Join(basePath, "index.html")
+// Options はデプロイの動作を指定する
+type Options struct {
+	// 前回のマニフェストを無視してすべてのファイルをデプロイする
+	Force bool
+	// メディアのアップロードとイベントの署名・publishを行わずに計画のみ作成する
+	DryRun bool
+	// メディアのアップロード先 (nostrcheck, blossom, nip96)
+	Uploader string
+	// アップロード先のサーバーのURL
+	UploadServer string
+	// メディアの保存先 (upload: アップロード先のサーバー, relay: NIP-95のイベントとしてリレー)
+	MediaMode string
+	// HTML, CSS, JS, Text Fileのcontentの圧縮形式 (none, gzip, br)
+	Compression string
+	// リレーへの接続とpublishを再試行する回数
+	Retries int
+	// 各イベントを受け付ける必要があるリレーの数。満たさない場合はエラーにする
+	MinRelays int
+	// publish後にすべてのリレーからイベントを読み出して検証する
+	Verify bool
+	// 削除の確認を省略する
+	Yes bool
+	// サイトルートの.gitignoreに記載されたファイルも除外する
+	GitIgnore bool
+	// ドットで始まるファイルとディレクトリもデプロイする
+	IncludeHidden bool
+	// hostr.tomlで指定された除外パターン
+	IgnorePatterns []string
+	// 除外されたファイルなどの詳細を表示する
+	Verbose bool
+	// [拡張子またはファイル名]:[Content-Type]。組み込みのMIMEの判定より優先する
+	MimeTypes map[string]string
+	// 一致するファイルがないパスにindex.htmlを返す
+	SPA bool
+	// 進捗バーの代わりに、CIのログのように進捗を行単位で出力する
+	PlainProgress bool
+}
 
-	// パスのディレクトリ内のファイルからindex.htmlファイルを取得
-	content, err := os.ReadFile(filePath)
+// Deploy はサイトをデプロイする。basePathはFSがnilの場合に読み込むディレクトリで、
+// Replaceableでないサイトではマニフェストを保存する場所の識別にも使う。
+// 途中で失敗した場合も、分かっている部分を含む結果を返す
+func (d *Deployer) Deploy(basePath string, replaceable bool, htmlIdentifier string) (*Result, error) {
+	s, err := d.newState()
 	if err != nil {
-		fmt.Println("❌ Failed to read index.html:", err)
-		return "", "", "", err
+		fmt.Fprintln(d.logWriter(), "❌ Failed to prepare deploy:", err)
+		return &Result{Replaceable: replaceable, Identifier: htmlIdentifier}, err
 	}
+	s.basePath = basePath
+	s.replaceable = replaceable
+	s.indexHtmlIdentifier = htmlIdentifier
+	s.result.Plan = s.plan
 
-	// HTMLの解析
-	doc, err := html.Parse(bytes.NewReader(content))
-	if err != nil {
-		fmt.Println("❌ Failed to parse index.html:", err)
-		return "", "", "", err
-	}
+	err = s.deploy(d)
+	return s.result, err
+}
 
-	// Eventの取得に必要になるキーペアを取得
-	priKey, err := keystore.GetSecret()
-	if err != nil {
-		fmt.Println("❌ Failed to get private key:", err)
-		return "", "", "", err
+// .hostrignoreなどで除外するファイルを読み込み、デプロイするサイトのファイルを返す
+func (d *Deployer) loadSiteFiles(basePath string) (*tools.SiteFiles, error) {
+	ignoreOptions := tools.IgnoreOptions{
+		GitIgnore:     d.Options.GitIgnore,
+		IncludeHidden: d.Options.IncludeHidden,
+		Patterns:      d.Options.IgnorePatterns,
 	}
-	pubKey, err := nostr.GetPublicKey(priKey)
-	if err != nil {
-		fmt.Println("❌ Failed to get public key:", err)
-		return "", "", "", err
+	if d.FS != nil {
+		return tools.NewSiteFiles(d.FS, ignoreOptions)
 	}
+	return tools.NewDirSiteFiles(basePath, ignoreOptions)
+}
 
-	// htmlIdentifierの存在チェック
-	if replaceable && len(htmlIdentifier) < 1 {
-		// htmlIdentifierが指定されていない場合はユーザー入力を受け取る
-		reader := bufio.NewReader(os.Stdin)
-		fmt.Print("⌨️ Please type identifier: ")
+func (s *deployState) deploy(d *Deployer) error {
+	options := d.Options
+
+	err := s.setContentEncoding(options.Compression)
+	if err != nil {
+		fmt.Fprintln(s.log, "❌ Failed to set compression:", err)
+		return err
+	}
 
-		htmlIdentifier, _ = reader.ReadString('\n')
-		// 改行タグを削除
-		htmlIdentifier = strings.TrimSpace(htmlIdentifier)
+	s.result.Npub, _ = nip19.EncodePublicKey(s.pubKey)
+	s.result.Replaceable = s.replaceable
+	s.result.Identifier = s.indexHtmlIdentifier
+	s.result.Relays = s.allRelays
 
-		fmt.Printf("Identifier: %s\n", htmlIdentifier)
+	// htmlIdentifierの存在チェック
+	if s.replaceable && len(s.indexHtmlIdentifier) < 1 {
+		err := errors.New("identifier is required. Pass --identifier or set identifier in hostr.toml")
+		fmt.Fprintln(s.log, "❌", err)
+		return err
 	}
 
-	// リレーを取得
-	allRelays, err = relays.GetAllRelays()
-	if err != nil {
-		fmt.Println("❌ Failed to get all relays:", err)
-		return "", "", "", err
-	}
-
-	// basePath以下のText Fileのパスをすべて羅列する
-	err = generateEventsAndAddQueueAllValidStaticTextFiles(
-		priKey,
-		pubKey,
-		htmlIdentifier,
-		basePath,
-		replaceable,
-	)
+	s.files, err = d.loadSiteFiles(s.basePath)
 	if err != nil {
-		fmt.Println("❌ Failed to convert text files:", err)
-		return "", "", "", err
+		fmt.Fprintln(s.log, "❌ Failed to load ignore rules:", err)
+		return err
 	}
 
-	// basePath以下のMedia Fileのパスを全て羅列しアップロード
-	err = uploadAllValidStaticMediaFiles(priKey, pubKey, basePath)
+	// サイトルートにindex.htmlファイルがあるか確認
+	_, err = fs.Stat(s.files.FS(), "index.html")
 	if err != nil {
-		fmt.Println("❌ Failed to upload media:", err)
-		return "", "", "", err
+		fmt.Fprintln(s.log, "❌ Failed to read index.html:", err)
+		return err
+	}
+
+	if options.Verbose {
+		ignoredFiles, err := s.files.Ignored()
+		if err != nil {
+			fmt.Fprintln(s.log, "❌ Failed to list ignored files:", err)
+			return err
+		}
+		for _, file := range ignoredFiles {
+			fmt.Fprintf(s.log, "Excluded %s (%s)\n", file.Path, file.Reason)
+		}
 	}
 
-	// リンクの解析と変換
-	convertLinks(priKey, pubKey, basePath, replaceable, htmlIdentifier, doc)
+	// 前回のデプロイ結果を読み込む
+	manifestFilePath, err := getManifestFilePath(s.pubKey, s.basePath, s.replaceable, s.indexHtmlIdentifier)
+	if err != nil {
+		fmt.Fprintln(s.log, "❌ Failed to get manifest path:", err)
+		return err
+	}
+	if !options.Force {
+		s.previousManifest, err = loadManifest(manifestFilePath)
+		if err != nil {
+			fmt.Fprintln(s.log, "❌ Failed to load manifest:", err)
+			return err
+		}
+	}
+	s.currentManifest.Relays = s.allRelays
+
+	// メディアのアップロード先を取得
+	s.mediaUploader = d.Uploader
+	if s.mediaUploader == nil {
+		s.mediaUploader, err = NewUploader(options.Uploader, options.UploadServer, s.signer, s.pubKey, s.log)
+		if err != nil {
+			fmt.Fprintln(s.log, "❌ Failed to get uploader:", err)
+			return err
+		}
+	}
+	s.currentManifest.Uploader = s.mediaUploader.Name()
 
-	// 更新されたHTML
-	var buf bytes.Buffer
-	html.Render(&buf, doc)
+	s.plan.Identifier = s.indexHtmlIdentifier
+	s.plan.Replaceable = s.replaceable
+	s.plan.Relays = s.allRelays
 
-	strHtml := buf.String()
+	// サイトのText Fileのパスをすべて羅列する
+	err = s.generateEventsAndAddQueueAllValidStaticTextFiles()
+	if err != nil {
+		fmt.Fprintln(s.log, "❌ Failed to convert text files:", err)
+		return err
+	}
 
-	// index.htmlのkindを設定
-	indexHtmlKind := consts.KindWebhostHTML
-	if replaceable {
-		indexHtmlKind = consts.KindWebhostReplaceableHTML
+	if options.MediaMode == MediaModeRelay {
+		// サイトのMedia Fileをイベントとしてキューに追加
+		err = s.generateEventsAndAddQueueAllValidStaticMediaFiles()
+		if err != nil {
+			fmt.Fprintln(s.log, "❌ Failed to convert media files:", err)
+			return err
+		}
+	} else {
+		// サイトのMedia Fileのパスを全て羅列しアップロード
+		err = s.uploadAllValidStaticMediaFiles()
+		if err != nil {
+			// アップロードに失敗したファイルを結果に含める
+			s.collectResult(nil)
+			fmt.Fprintln(s.log, "❌ Failed to upload media:", err)
+			return err
+		}
 	}
 
-	// Tagsを追加
-	tags := nostr.Tags{}
-	if replaceable {
-		tags = tags.AppendUnique(nostr.Tag{"d", htmlIdentifier})
+	// index.htmlから参照されているファイルを辿って変換し、eventを生成しキューに追加
+	eventId, err := s.publishFile("index.html")
+	if err != nil {
+		fmt.Fprintln(s.log, "❌ Failed to get event:", err)
+		return err
 	}
 
-	// Eventを生成しキューに追加
-	event, err := getEvent(priKey, pubKey, strHtml, indexHtmlKind, tags)
+	// index.htmlから辿れないページやCSS/JSもすべて変換してキューに追加
+	htmlFilePaths, err := s.findFilesByClass(tools.FileClassPage)
 	if err != nil {
-		fmt.Println("❌ Failed to get public key:", err)
-		return "", "", "", err
+		fmt.Fprintln(s.log, "❌ Failed to list page files:", err)
+		return err
+	}
+	for _, htmlFilePath := range htmlFilePaths {
+		_, err := s.publishFile(htmlFilePath)
+		if err != nil {
+			fmt.Fprintln(s.log, "❌ Failed to get event:", err)
+			return err
+		}
+	}
+
+	// 置き換え可能な場合はすべてのファイルを参照するマニフェストを生成する
+	if s.replaceable {
+		s.siteRoutingTags, err = generateRoutingTags(s.files.FS(), options.SPA)
+		if err != nil {
+			fmt.Fprintln(s.log, "❌ Failed to load routing rules:", err)
+			return err
+		}
+
+		_, err = s.generateSiteManifestEvent(s.indexHtmlIdentifier)
+		if err != nil {
+			fmt.Fprintln(s.log, "❌ Failed to get site manifest event:", err)
+			return err
+		}
+	} else if _, err := fs.Stat(s.files.FS(), tools.RedirectsFileName); options.SPA || err == nil {
+		// ルーティングはサイトのマニフェストから読み込まれる
+		fmt.Fprintln(s.log, "⚠️ SPA mode and", tools.RedirectsFileName, "are only applied to replaceable sites")
 	}
 
-	addNostrEventQueue(event, filePath)
+	if !s.dryRun {
+		report, publishErr := s.publishEventsFromQueue()
+		s.collectResult(report)
 
-	eventId, encoded := publishEventsFromQueue(replaceable)
+		// 今回のデプロイ結果を保存。publishに失敗したファイルは次回再度publishされる
+		err = saveManifest(manifestFilePath, s.currentManifest)
+		if err != nil {
+			fmt.Fprintln(s.log, "❌ Failed to save manifest:", err)
+			return err
+		}
 
-	return eventId, encoded, htmlIdentifier, err
-}
+		if publishErr != nil {
+			fmt.Fprintln(s.log, "❌ Failed to publish:", publishErr)
+			return publishErr
+		}
 
-func convertLinks(
-	priKey, pubKey, basePath string,
-	replaceable bool,
-	indexHtmlIdentifier string,
-	n *html.Node,
-) {
-	if n.Type == html.ElementNode {
-		if n.Data == "link" || n.Data == "script" {
-			// <link> と <script> タグを対象としてNostr Eventを作成
-			for i, a := range n.Attr {
-				// href,srcのうち、外部URLでないものかつ. html, .css, .js のみ変換する
-				if (a.Key == "href" || a.Key == "src") && !isExternalURL(a.Val) && isValidBasicFileType(a.Val) {
-					filePath := filepath.Join(basePath, a.Val)
-
-					// kindを取得
-					kind, err := pathToKind(filePath, replaceable)
-					if err != nil {
-						break
-					}
-
-					// contentを取得
-					bytesContent, err := os.ReadFile(filePath)
-					if err != nil {
-						fmt.Println("❌ Failed to read", filePath, ":", err)
-						continue
-					}
-
-					content := string(bytesContent)
-
-					// Tagsを追加
-					tags := nostr.Tags{}
-					// 置き換え可能なイベントの場合
-					if replaceable {
-						fileIdentifier := getReplaceableIdentifier(indexHtmlIdentifier, a.Val)
-						tags = tags.AppendUnique(nostr.Tag{"d", fileIdentifier})
-						// 元のパスをfileIdentifierに置き換える
-						n.Attr[i].Val = fileIdentifier
-					}
-
-					// jsファイルを解析する
-					if strings.HasSuffix(a.Val, ".js") {
-						// アップロード済みファイルの元パスとURLを取得
-						for path, url := range uploadedMediaFilePathToURL {
-							// JS内に該当ファイルがあったら置換
-							content = strings.ReplaceAll(content, path, url)
-						}
-					}
-
-					event, err := getEvent(priKey, pubKey, content, kind, tags)
-					if err != nil {
-						fmt.Println("❌ Failed to get event for", filePath, ":", err)
-						break
-					}
-
-					addNostrEventQueue(event, filePath)
-
-					// 置き換え可能なイベントでない場合
-					if !replaceable {
-						// neventを指定
-						nevent, err := nip19.EncodeEvent(event.ID, allRelays, pubKey)
-						if err != nil {
-							fmt.Println("❌ Failed to encode event", filePath, ":", err)
-							break
-						}
-						n.Attr[i].Val = nevent
-					}
-				}
+		// ロールバックできるようにデプロイ履歴に記録する
+		if s.replaceable {
+			_, err = s.saveDeployHistory(s.indexHtmlIdentifier, 0, 0)
+			if err != nil {
+				fmt.Fprintln(s.log, "❌ Failed to save deploy history:", err)
+				return err
+			}
+		}
+
+		if options.Verify {
+			_, err = s.verifyManifest(s.currentManifest)
+			if err != nil {
+				fmt.Fprintln(s.log, "❌ Failed to verify:", err)
+				return err
 			}
 		}
 	}
 
-	// 子ノードに対して再帰的に処理
-	for c := n.FirstChild; c != nil; c = c.NextSibling {
-		convertLinks(priKey, pubKey, basePath, replaceable, indexHtmlIdentifier, c)
+	s.result.EventID = eventId
+	if s.replaceable {
+		s.result.Naddr, _ = nip19.EncodeEntity(s.pubKey, consts.KindWebhostSiteManifest, s.indexHtmlIdentifier, s.allRelays)
+	} else if nevent, err := nip19.EncodeEvent(eventId, s.allRelays, s.pubKey); err == nil {
+		s.result.Nevent = nevent
+	} else {
+		fmt.Fprintln(s.log, "❌ Failed to covert nevent:", err)
 	}
+
+	return nil
+}
+
+// DetectFileTypeの判定がclassのファイルのサイトルートからの相対パスを返す
+func (s *deployState) findFilesByClass(class string) ([]string, error) {
+	return s.files.Find(func(path string) bool {
+		return s.mimeTypes.DetectFileType(s.files.FS(), path).Class == class
+	})
 }
@@ -0,0 +1,226 @@
+package deploy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/keystore"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/tools"
+)
+
+const (
+	ProgressStageUpload  = "upload"
+	ProgressStagePublish = "publish"
+)
+
+// Progress はメディアのアップロード、またはイベントのpublishの進捗
+type Progress struct {
+	Stage string
+	Done  int
+	Total int
+}
+
+// Deployer はサイトをNostrのリレーにデプロイする。
+// デプロイ中の状態は呼び出しごとに作られるので、1つのDeployerを何度でも、複数のgoroutineから使える
+type Deployer struct {
+	// イベントとアップロードの認可に署名する
+	Signer keystore.Signer
+	// publish先のリレー
+	Relays []string
+	// メディアのアップロード先。nilの場合はOptions.UploaderとOptions.UploadServerから生成する
+	Uploader Uploader
+	// デプロイするサイトのファイル。nilの場合はDeployに渡したディレクトリから読み込む
+	FS fs.FS
+	// デプロイの動作
+	Options Options
+	// 進捗を受け取る。複数のgoroutineから呼ばれることがある。nilの場合は進捗バーを表示する
+	OnProgress func(Progress)
+	// 削除する前に確認する。Options.Yesがfalseでnilの場合は削除しない
+	Confirm func(message string) bool
+	// 進捗とログの出力先。nilの場合は標準出力に出力する
+	Log io.Writer
+}
+
+func (d *Deployer) logWriter() io.Writer {
+	if d.Log == nil {
+		return os.Stdout
+	}
+	return d.Log
+}
+
+// 1回のデプロイ、ロールバック、削除、検証の間だけ使う状態
+type deployState struct {
+	signer     keystore.Signer
+	pubKey     string
+	allRelays  []string
+	onProgress func(Progress)
+	// 進捗とログの出力先
+	log io.Writer
+	// 進捗を行単位で出力する
+	plainProgress bool
+
+	// dry-runの場合はメディアのアップロードとイベントの署名・publishを行わない
+	dryRun bool
+	// リレーへの接続とpublishを再試行する回数
+	publishRetries int
+	// 各イベントを受け付ける必要があるリレーの数
+	minRelays int
+	// イベントのcontentの圧縮形式。空の場合は圧縮しない
+	contentEncoding string
+
+	// デプロイ対象のサイト
+	files               *tools.SiteFiles
+	mimeTypes           *tools.MimeTypes
+	basePath            string
+	replaceable         bool
+	indexHtmlIdentifier string
+
+	// 前回のデプロイ結果
+	previousManifest *Manifest
+	// 今回のデプロイ結果
+	currentManifest *Manifest
+
+	// 使用するアップロード先
+	mediaUploader Uploader
+	// [サイトルートからの相対パス]:[URL]の形で記録する
+	uploadedMediaFilePathToURL map[string]string
+	// Media Fileのサイトルートからの相対パスを記録する
+	mediaFilePaths map[string]bool
+	// アップロードに失敗したメディアの[サイトルートからの相対パス]:[エラー]
+	mediaUploadFailures map[string]string
+	// アップロードは並列に行うので、上の3つとcurrentManifestの更新を排他制御する
+	mediaMutex sync.Mutex
+
+	// [サイトルートからの相対パス]:[event id]の形で記録する
+	textFilePathToEventID      map[string]string
+	publishedFilePathToEventID map[string]string
+	// 循環参照を検出するために処理中のファイルを記録する
+	resolvingFilePaths map[string]bool
+	// 循環参照を警告済みのファイル
+	circularReferences map[string]bool
+
+	// すべてのリレーの上限。リレーのNIP-11から1度だけ取得する
+	relayLimits *relayLimits
+
+	nostrEventsQueue []*nostr.Event
+	// 他のすべてのイベントをpublishした後にpublishするサイトのマニフェストイベント
+	siteManifestEvent *nostr.Event
+	// サイトのマニフェストイベントに追加するルーティングのタグ
+	siteRoutingTags nostr.Tags
+
+	plan   *Plan
+	result *Result
+}
+
+// 署名者とリレーを確認し、空の状態を作る
+func (d *Deployer) newState() (*deployState, error) {
+	if d.Signer == nil {
+		return nil, errors.New("signer is required")
+	}
+	if len(d.Relays) < 1 {
+		return nil, errors.New("at least one relay is required")
+	}
+
+	pubKey, err := d.Signer.GetPublicKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return &deployState{
+		signer:                     d.Signer,
+		pubKey:                     pubKey,
+		allRelays:                  slices.Clone(d.Relays),
+		onProgress:                 d.OnProgress,
+		log:                        d.logWriter(),
+		plainProgress:              d.Options.PlainProgress,
+		dryRun:                     d.Options.DryRun,
+		publishRetries:             max(d.Options.Retries, 0),
+		minRelays:                  max(d.Options.MinRelays, 1),
+		mimeTypes:                  tools.NewMimeTypes(d.Options.MimeTypes),
+		previousManifest:           newManifest(),
+		currentManifest:            newManifest(),
+		uploadedMediaFilePathToURL: map[string]string{},
+		mediaFilePaths:             map[string]bool{},
+		mediaUploadFailures:        map[string]string{},
+		textFilePathToEventID:      map[string]string{},
+		publishedFilePathToEventID: map[string]string{},
+		resolvingFilePaths:         map[string]bool{},
+		circularReferences:         map[string]bool{},
+		siteRoutingTags:            nostr.Tags{},
+		plan:                       &Plan{Files: []*PlanEntry{}},
+		result:                     &Result{PubKey: pubKey},
+	}, nil
+}
+
+// 進捗を行単位で出力する場合に、途中の進捗を出力する間隔
+const plainProgressInterval = 2 * time.Second
+
+// 進捗を数え、OnProgressに通知するか進捗バーまたは行単位で表示する
+type progressCounter struct {
+	stage      string
+	done       int
+	total      int
+	onProgress func(Progress)
+	log        io.Writer
+	// 進捗を行単位で出力する。最後に出力した時刻から間隔を空け、完了時は必ず出力する
+	plain       bool
+	lastPrinted time.Time
+	mutex       sync.Mutex
+	wg          sync.WaitGroup
+}
+
+func (s *deployState) startProgress(stage string, total int) *progressCounter {
+	p := &progressCounter{stage: stage, total: total, onProgress: s.onProgress, log: s.log}
+	if p.onProgress != nil {
+		p.onProgress(Progress{Stage: stage, Done: 0, Total: total})
+		return p
+	}
+
+	// ターミナルでない場合は\rで上書きできないので行単位で出力する
+	if s.plainProgress || !tools.IsTerminal(s.log) {
+		p.plain = true
+		p.lastPrinted = time.Now()
+		return p
+	}
+
+	p.wg.Add(1)
+	go func() {
+		tools.DisplayProgressBar(s.log, p.snapshot)
+		p.wg.Done()
+	}()
+	return p
+}
+
+func (p *progressCounter) increment() {
+	p.mutex.Lock()
+	p.done++
+	progress := Progress{Stage: p.stage, Done: p.done, Total: p.total}
+	if p.plain && (p.done >= p.total || time.Since(p.lastPrinted) >= plainProgressInterval) {
+		fmt.Fprintf(p.log, "%s %d/%d\n", p.stage, p.done, p.total)
+		p.lastPrinted = time.Now()
+	}
+	p.mutex.Unlock()
+
+	if p.onProgress != nil {
+		p.onProgress(progress)
+	}
+}
+
+// 進捗バーの描画中にincrementと競合しないよう、ロックして現在の進捗を返す
+func (p *progressCounter) snapshot() (int, int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.done, p.total
+}
+
+// 進捗バーの表示が終わるまで待つ
+func (p *progressCounter) wait() {
+	p.wg.Wait()
+}
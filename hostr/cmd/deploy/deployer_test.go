@@ -0,0 +1,42 @@
+package deploy
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// 行単位の進捗はLogに出力し、完了時は必ず出力する
+func TestPlainProgress(t *testing.T) {
+	var log bytes.Buffer
+	s := &deployState{log: &log, plainProgress: true}
+
+	progress := s.startProgress(ProgressStagePublish, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			progress.increment()
+		}()
+	}
+	wg.Wait()
+	progress.wait()
+
+	if !strings.HasSuffix(log.String(), "publish 10/10\n") {
+		t.Errorf("log = %q, want it to end with the completed progress", log.String())
+	}
+}
+
+func TestDeployerLog(t *testing.T) {
+	var log bytes.Buffer
+	deployer := &Deployer{Log: &log}
+
+	if _, err := deployer.Verify("blog"); err == nil {
+		t.Fatal("Verify without a signer succeeded")
+	}
+	if !strings.Contains(log.String(), "❌ Failed to prepare verify: signer is required") {
+		t.Errorf("log = %q", log.String())
+	}
+}
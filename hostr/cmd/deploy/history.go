@@ -0,0 +1,162 @@
+package deploy
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/paths"
+)
+
+const HistoryDirName = "history"
+
+const (
+	historyVersionsFileName = "versions.json"
+	historyEventsDirName    = "events"
+)
+
+// DeployVersion はReplaceableなサイトの1回分のデプロイの記録
+type DeployVersion struct {
+	Version             int             `json:"version"`
+	CreatedAt           nostr.Timestamp `json:"createdAt"`
+	SiteManifestEventID string          `json:"siteManifestEventId,omitempty"`
+	// ロールバックの場合に、ロールバックする前の最新のバージョン
+	RolledBackFrom int `json:"rolledBackFrom,omitempty"`
+	// ロールバックの場合に、戻した先のバージョン。履歴にないマニフェストに戻した場合は0
+	RestoredVersion int                       `json:"restoredVersion,omitempty"`
+	Files           map[string]*ManifestEntry `json:"files"`
+}
+
+// サイトのデプロイ履歴を保存するディレクトリを取得
+func getHistoryDirectory(pubKey, htmlIdentifier string) (string, error) {
+	dir, err := paths.GetSettingsDirectory()
+	if err != nil {
+		return "", err
+	}
+
+	siteHash, err := getSiteHash(pubKey, "", true, htmlIdentifier)
+	if err != nil {
+		return "", err
+	}
+
+	dir = filepath.Join(dir, HistoryDirName, siteHash)
+	if err := os.MkdirAll(filepath.Join(dir, historyEventsDirName), 0700); err != nil {
+		return "", err
+	}
+
+	return dir, nil
+}
+
+// デプロイ履歴を古い順に読み込む。存在しない場合は空の履歴を返す
+func loadDeployHistory(historyDir string) ([]*DeployVersion, error) {
+	content, err := os.ReadFile(filepath.Join(historyDir, historyVersionsFileName))
+	if os.IsNotExist(err) {
+		return []*DeployVersion{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	versions := []*DeployVersion{}
+	if err := json.Unmarshal(content, &versions); err != nil {
+		return nil, err
+	}
+
+	return versions, nil
+}
+
+// 今回publishしたイベントを保存し、manifestを新しいバージョンとして履歴に追加する。
+// ロールバックでない場合、rolledBackFromとrestoredVersionは0
+func recordDeployHistory(historyDir string, events []*nostr.Event, manifest *Manifest, rolledBackFrom, restoredVersion int) (*DeployVersion, error) {
+	versions, err := loadDeployHistory(historyDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// 署名済みのイベントをIDごとに保存する。再利用されたイベントは以前のデプロイで保存済み
+	for _, event := range events {
+		content, err := json.Marshal(event)
+		if err != nil {
+			return nil, err
+		}
+		err = os.WriteFile(filepath.Join(historyDir, historyEventsDirName, event.ID+".json"), content, 0600)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	siteManifestEventID := ""
+	if entry, ok := manifest.Files[siteManifestKey]; ok {
+		siteManifestEventID = entry.EventID
+	}
+
+	// 前回から変更がない場合は新しいバージョンを作らない
+	if len(versions) > 0 && versions[len(versions)-1].SiteManifestEventID == siteManifestEventID {
+		return versions[len(versions)-1], nil
+	}
+
+	version := &DeployVersion{
+		Version:             len(versions) + 1,
+		CreatedAt:           nostr.Now(),
+		SiteManifestEventID: siteManifestEventID,
+		RolledBackFrom:      rolledBackFrom,
+		RestoredVersion:     restoredVersion,
+		Files:               map[string]*ManifestEntry{},
+	}
+	if len(versions) > 0 {
+		version.Version = versions[len(versions)-1].Version + 1
+	}
+	for key, entry := range manifest.Files {
+		version.Files[key] = entry
+	}
+	versions = append(versions, version)
+
+	content, err := json.MarshalIndent(versions, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(filepath.Join(historyDir, historyVersionsFileName), content, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return version, nil
+}
+
+// 履歴に保存された署名済みのイベントを読み込む。存在しない場合はnilを返す
+func loadHistoryEvent(historyDir, eventID string) (*nostr.Event, error) {
+	// IDをファイル名に使うので不正な値は受け付けない
+	if len(eventID) != 64 || strings.ContainsAny(eventID, "./\\") {
+		return nil, nil
+	}
+
+	content, err := os.ReadFile(filepath.Join(historyDir, historyEventsDirName, eventID+".json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var event nostr.Event
+	if err := json.Unmarshal(content, &event); err != nil {
+		return nil, err
+	}
+
+	return &event, nil
+}
+
+// publishしたイベントとともに今回のデプロイを履歴に記録する
+func (s *deployState) saveDeployHistory(htmlIdentifier string, rolledBackFrom, restoredVersion int) (*DeployVersion, error) {
+	historyDir, err := getHistoryDirectory(s.pubKey, htmlIdentifier)
+	if err != nil {
+		return nil, err
+	}
+
+	events := s.nostrEventsQueue
+	if s.siteManifestEvent != nil {
+		events = append(events, s.siteManifestEvent)
+	}
+
+	return recordDeployHistory(historyDir, events, s.currentManifest, rolledBackFrom, restoredVersion)
+}
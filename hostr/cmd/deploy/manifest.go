@@ -0,0 +1,186 @@
+package deploy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/paths"
+)
+
+const ManifestDirName = "manifests"
+
+// ManifestEntry はデプロイ済みファイル1つ分の記録
+type ManifestEntry struct {
+	Hash    string `json:"hash"`
+	EventID string `json:"eventId,omitempty"`
+	Kind    int    `json:"kind,omitempty"`
+	DTag    string `json:"dTag,omitempty"`
+	URL     string `json:"url,omitempty"`
+}
+
+// Manifest はサイト毎に保存される [相対パス]:[ManifestEntry] の記録
+type Manifest struct {
+	Relays   []string                  `json:"relays"`
+	Uploader string                    `json:"uploader,omitempty"`
+	Files    map[string]*ManifestEntry `json:"files"`
+}
+
+func newManifest() *Manifest {
+	return &Manifest{Files: map[string]*ManifestEntry{}}
+}
+
+// イベントとして保存されたファイルの記録を作成する
+func newEventManifestEntry(hash, eventID string, kind int, tags nostr.Tags) *ManifestEntry {
+	entry := &ManifestEntry{Hash: hash, EventID: eventID, Kind: kind}
+	if dTag := tags.GetFirst([]string{"d", ""}); dTag != nil {
+		entry.DTag = dTag.Value()
+	}
+	return entry
+}
+
+// サイトを一意に識別するキーからマニフェストのパスを取得
+func getManifestFilePath(pubKey, basePath string, replaceable bool, htmlIdentifier string) (string, error) {
+	dir, err := paths.GetSettingsDirectory()
+	if err != nil {
+		return "", err
+	}
+
+	dir = filepath.Join(dir, ManifestDirName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	siteHash, err := getSiteHash(pubKey, basePath, replaceable, htmlIdentifier)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, siteHash+".json"), nil
+}
+
+// replaceableの場合はidentifier、そうでない場合はサイトの絶対パスで識別する
+func getSiteHash(pubKey, basePath string, replaceable bool, htmlIdentifier string) (string, error) {
+	siteKey := htmlIdentifier
+	if !replaceable {
+		absPath, err := filepath.Abs(basePath)
+		if err != nil {
+			return "", err
+		}
+		siteKey = absPath
+	}
+
+	hash := sha256.Sum256([]byte(pubKey + ":" + siteKey))
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// マニフェストを読み込む。存在しない場合は空のマニフェストを返す
+func loadManifest(filePath string) (*Manifest, error) {
+	content, err := os.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return newManifest(), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	manifest := newManifest()
+	if err := json.Unmarshal(content, manifest); err != nil {
+		return nil, err
+	}
+	if manifest.Files == nil {
+		manifest.Files = map[string]*ManifestEntry{}
+	}
+
+	return manifest, nil
+}
+
+func saveManifest(filePath string, manifest *Manifest) error {
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filePath, content, 0644)
+}
+
+// 前回と同じリレーにデプロイする場合のみイベントを再利用できる
+func (s *deployState) canReuseManifestEvents() bool {
+	prev := slices.Clone(s.previousManifest.Relays)
+	curr := slices.Clone(s.allRelays)
+	slices.Sort(prev)
+	slices.Sort(curr)
+	return slices.Equal(prev, curr)
+}
+
+// イベントの内容からハッシュを計算
+func hashEventPayload(kind int, tags nostr.Tags, content string) string {
+	tagsJson, _ := json.Marshal(tags)
+	hash := sha256.New()
+	hash.Write([]byte(strings.Join([]string{strconv.Itoa(kind), string(tagsJson), content}, "\n")))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func hashBytes(content []byte) string {
+	hash := sha256.Sum256(content)
+	return hex.EncodeToString(hash[:])
+}
+
+// 前回と同じ内容のイベントであれば前回のイベントIDを返す
+func (s *deployState) findUnchangedEventID(key, hash string) (string, bool) {
+	if !s.canReuseManifestEvents() {
+		return "", false
+	}
+	entry, ok := s.previousManifest.Files[key]
+	if !ok || entry.Hash != hash || entry.EventID == "" {
+		return "", false
+	}
+	return entry.EventID, true
+}
+
+// 前回と同じ内容のメディアファイルであれば前回のURLを返す
+func (s *deployState) findUnchangedMediaURL(key, hash string) (string, bool) {
+	// アップロード先が変わった場合は再アップロードする
+	previousUploader := s.previousManifest.Uploader
+	if previousUploader == "" {
+		previousUploader = UploaderNostrCheck
+	}
+	if previousUploader != s.currentManifest.Uploader {
+		return "", false
+	}
+
+	entry, ok := s.previousManifest.Files[key]
+	if !ok || entry.Hash != hash || entry.URL == "" {
+		return "", false
+	}
+	return entry.URL, true
+}
+
+// 前回から変更がなければイベントIDを再利用し、変更があればイベントを生成してキューに追加する。
+// keyはサイトルートからの相対パス
+func (s *deployState) generateOrReuseEvent(key string, size int, content string, kind int, tags nostr.Tags) (string, error) {
+	hash := hashEventPayload(kind, tags, content)
+
+	if eventID, ok := s.findUnchangedEventID(key, hash); ok {
+		s.currentManifest.Files[key] = newEventManifestEntry(hash, eventID, kind, tags)
+		s.addEventPlanEntry(key, PlanActionSkip, kind, tags, size, content, eventID)
+		fmt.Fprintln(s.log, "Skipped unchanged", key)
+		return eventID, nil
+	}
+
+	event, err := s.getEvent(content, kind, tags)
+	if err != nil {
+		return "", err
+	}
+
+	s.addNostrEventQueue(event, key)
+	s.currentManifest.Files[key] = newEventManifestEntry(hash, event.ID, kind, tags)
+	s.addEventPlanEntry(key, PlanActionPublish, kind, tags, size, content, event.ID)
+
+	return event.ID, nil
+}
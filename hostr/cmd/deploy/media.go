@@ -4,36 +4,29 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"io/fs"
 	"mime/multipart"
 	"net/http"
-	"os"
+	"sort"
 	"strings"
 	"sync"
 
 	"github.com/nbd-wtf/go-nostr"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/keystore"
 	"github.com/studiokaiji/nostr-webhost/hostr/cmd/tools"
 )
 
-var availableContentSuffixes = []string{
-	".png",
-	".jpg",
-	".jpeg",
-	".gif",
-	".webp",
-	".mp4",
-	".quicktime",
-	".mpeg",
-	".webm",
-	".mpeg",
-	".mpg",
-	".mpeg3",
-	".mp3",
-}
-
 const uploadEndpoint = "https://nostrcheck.me/api/v1/media"
 
+// NIP-98のHTTP認可イベントのkind
+const KindHTTPAuth = 27235
+
+// ErrMediaUploadFailed はアップロードに失敗したメディアがある場合のエラー。
+// 参照を書き換えられないHTMLを公開しないよう、イベントをpublishする前にデプロイを止める
+var ErrMediaUploadFailed = errors.New("failed to upload media files")
+
 type MediaResult struct {
 	Result      bool     `json:"result,omitempty"`
 	Description string   `json:"description"`
@@ -46,83 +39,91 @@ type MediaResult struct {
 	Tags        []string `json:"tags,omitempty"`
 }
 
-// [元パス]:[URL]の形で記録する
-var uploadedMediaFilePathToURL = map[string]string{}
-
-func uploadMediaFiles(basePath string, filePaths []string, requests []*http.Request) {
-	fmt.Println("Uploading media files...")
+func (s *deployState) uploadMediaFiles(filePaths []string, contents [][]byte, hashes []string) {
+	fmt.Fprintln(s.log, "Uploading media files...")
 
-	client := &http.Client{}
-
-	var uploadedMediaFilePathToURLCount = 0
-	var allMediaFilesCount = len(requests)
+	progress := s.startProgress(ProgressStageUpload, len(filePaths))
 
 	var wg sync.WaitGroup
 
-	go func() {
-		wg.Add(1)
-		tools.DisplayProgressBar(&uploadedMediaFilePathToURLCount, &allMediaFilesCount)
-		wg.Done()
-	}()
-
-	var mutex sync.Mutex
-
 	// アップロードを並列処理
-	for i, req := range requests {
+	for i, filePath := range filePaths {
 		wg.Add(1)
-		filePath := filePaths[i]
+		content := contents[i]
+		hash := hashes[i]
 
-		fmt.Println("Added upload request", filePath)
+		fmt.Fprintln(s.log, "Added upload request", filePath)
 
-		go func(filePath string, req *http.Request) {
+		go func(filePath string, content []byte, hash string) {
 			defer wg.Done()
 
-			response, err := client.Do(req)
-			// リクエストを送信
-			if err != nil {
-				fmt.Println("\n❌ Error sending request:", filePath, err)
-				return
-			}
-			defer response.Body.Close()
+			contentType := s.mimeTypes.DetectFileType(s.files.FS(), filePath).ContentType
+			url, err := s.mediaUploader.Upload(filePath, contentType, content, hash)
 
-			if !strings.HasPrefix(fmt.Sprint(response.StatusCode), "2") {
-				fmt.Println("\n❌ Failed to upload:", response.StatusCode, filePath)
-				return
-			}
+			// 失敗した場合も進捗としてカウントアップ
+			defer progress.increment()
 
-			var result *MediaResult
-			// ResultのDecode
-			err = json.NewDecoder(response.Body).Decode(&result)
+			s.mediaMutex.Lock()         // ロックして排他制御
+			defer s.mediaMutex.Unlock() // ロック解除
 
 			if err != nil {
-				fmt.Println("\n❌ Error decoding response:", err)
+				fmt.Fprintln(s.log, "\n❌ Failed to upload file:", filePath, err)
+				s.mediaUploadFailures[filePath] = err.Error()
 				return
 			}
 
-			// アップロードに失敗した場合
-			if !result.Result {
-				fmt.Println("\n❌ Failed to upload file:", filePath, err)
-				return
-			}
-
-			mutex.Lock()                      // ロックして排他制御
-			uploadedMediaFilePathToURLCount++ // カウントアップ
-			uploadedMediaFilePathToURL[strings.Replace(filePath, basePath, "", 1)] = result.Url
-			mutex.Unlock() // ロック解除
-		}(filePath, req)
+			s.uploadedMediaFilePathToURL[filePath] = url
+			s.currentManifest.Files[filePath] = &ManifestEntry{Hash: hash, URL: url}
+		}(filePath, content, hash)
 	}
 
 	wg.Wait()
+	progress.wait()
 }
 
-func filePathToUploadMediaRequest(basePath, filePath, priKey, pubKey string) (*http.Request, error) {
-	// ファイルを開く
-	file, err := os.Open(filePath)
+// nostrcheck.meへアップロードする
+type nostrCheckUploader struct {
+	signer keystore.Signer
+	pubKey string
+}
+
+func (u *nostrCheckUploader) Name() string {
+	return UploaderNostrCheck
+}
+
+func (u *nostrCheckUploader) Upload(filePath, contentType string, content []byte, hash string) (string, error) {
+	request, err := filePathToUploadMediaRequest(filePath, content, u.signer, u.pubKey)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to read %s: %w", filePath, err)
+		return "", err
 	}
-	defer file.Close()
 
+	// リクエストを送信
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return "", fmt.Errorf("Error sending request: %w", err)
+	}
+	defer response.Body.Close()
+
+	if !strings.HasPrefix(fmt.Sprint(response.StatusCode), "2") {
+		return "", fmt.Errorf("Failed to upload: %d", response.StatusCode)
+	}
+
+	var result *MediaResult
+	// ResultのDecode
+	err = json.NewDecoder(response.Body).Decode(&result)
+	if err != nil {
+		return "", fmt.Errorf("Error decoding response: %w", err)
+	}
+
+	// アップロードに失敗した場合
+	if !result.Result {
+		return "", fmt.Errorf("Failed to upload: %s", result.Description)
+	}
+
+	return result.Url, nil
+}
+
+func filePathToUploadMediaRequest(filePath string, content []byte, signer keystore.Signer, pubKey string) (*http.Request, error) {
 	// リクエストボディのバッファを初期化
 	var requestBody bytes.Buffer
 	// multipart writerを作成
@@ -134,7 +135,7 @@ func filePathToUploadMediaRequest(basePath, filePath, priKey, pubKey string) (*h
 		return nil, fmt.Errorf("Error creating form file: %w", err)
 	}
 	// ファイルの内容をpartにコピー
-	_, err = io.Copy(part, file)
+	_, err = part.Write(content)
 	if err != nil {
 		return nil, fmt.Errorf("Error copying file: %w", err)
 	}
@@ -151,62 +152,111 @@ func filePathToUploadMediaRequest(basePath, filePath, priKey, pubKey string) (*h
 		return nil, fmt.Errorf("Error closing writer: %w", err)
 	}
 
-	// タグを追加
-	tags := nostr.Tags{
-		nostr.Tag{"u", uploadEndpoint},
-		nostr.Tag{"method", "POST"},
-		nostr.Tag{"payload", ""},
-	}
-
-	// イベントを生成
-	ev, err := getEvent(priKey, pubKey, "", 27235, tags)
+	// NIP-98の認可ヘッダーを取得
+	auth, err := getHTTPAuthorization(signer, pubKey, uploadEndpoint, "POST", "")
 	if err != nil {
-		return nil, fmt.Errorf("Error get event: %d", err)
-	}
-
-	// イベントをJSONにマーシャル
-	evJson, err := ev.MarshalJSON()
-	if err != nil {
-		return nil, fmt.Errorf("Error marshaling event: %d", err)
+		return nil, err
 	}
 
 	// HTTPリクエストを作成
 	request, err := http.NewRequest("POST", uploadEndpoint, &requestBody)
 	if err != nil {
-		return nil, fmt.Errorf("Error creating request: %d", err)
+		return nil, fmt.Errorf("Error creating request: %w", err)
 	}
 
 	// ヘッダーを設定
-	request.Header.Set("Authorization", "Nostr "+base64.StdEncoding.EncodeToString(evJson))
+	request.Header.Set("Authorization", auth)
 	request.Header.Set("Accept", "application/json")
 	request.Header.Set("Content-Type", writer.FormDataContentType())
 
 	return request, nil
 }
 
-// basePath以下のMedia Fileのパスを全て羅列する
-func listAllValidStaticMediaFilePaths(basePath string) ([]string, error) {
-	return tools.FindFilesWithBasePathBySuffixes(basePath, availableContentSuffixes)
+// NIP-98のkind 27235のイベントをAuthorizationヘッダーの値として取得する
+func getHTTPAuthorization(signer keystore.Signer, pubKey, url, method, payloadHash string) (string, error) {
+	// タグを追加
+	tags := nostr.Tags{
+		nostr.Tag{"u", url},
+		nostr.Tag{"method", method},
+	}
+	// ボディのないリクエストではpayloadタグを省略する
+	if len(payloadHash) > 0 {
+		tags = append(tags, nostr.Tag{"payload", payloadHash})
+	}
+
+	// イベントを生成
+	ev, err := getSignedEvent(signer, pubKey, "", KindHTTPAuth, tags)
+	if err != nil {
+		return "", fmt.Errorf("Error get event: %w", err)
+	}
+
+	// イベントをJSONにマーシャル
+	evJson, err := ev.MarshalJSON()
+	if err != nil {
+		return "", fmt.Errorf("Error marshaling event: %w", err)
+	}
+
+	return "Nostr " + base64.StdEncoding.EncodeToString(evJson), nil
+}
+
+// サイトのMedia Fileのパスを全て羅列する
+func (s *deployState) listAllValidStaticMediaFilePaths() ([]string, error) {
+	return s.findFilesByClass(tools.FileClassMedia)
 }
 
-// basePath以下のMedia Fileのパスを全て羅列しアップロード
-func uploadAllValidStaticMediaFiles(priKey, pubKey, basePath string) error {
-	filesPaths, err := listAllValidStaticMediaFilePaths(basePath)
+// サイトのMedia Fileのパスを全て羅列しアップロード
+func (s *deployState) uploadAllValidStaticMediaFiles() error {
+	filesPaths, err := s.listAllValidStaticMediaFilePaths()
 	if err != nil {
 		return err
 	}
 
-	requests := []*http.Request{}
+	uploadFilePaths := []string{}
+	contents := [][]byte{}
+	hashes := []string{}
 
 	for _, filePath := range filesPaths {
-		request, err := filePathToUploadMediaRequest(basePath, filePath, priKey, pubKey)
+		bytesContent, err := fs.ReadFile(s.files.FS(), filePath)
 		if err != nil {
-			return err
+			return fmt.Errorf("Failed to read %s: %w", filePath, err)
+		}
+
+		// 前回から変更がなければアップロード済みのURLを再利用
+		key := filePath
+		s.mediaFilePaths[key] = true
+		hash := hashBytes(bytesContent)
+		if url, ok := s.findUnchangedMediaURL(key, hash); ok {
+			s.uploadedMediaFilePathToURL[key] = url
+			s.currentManifest.Files[key] = &ManifestEntry{Hash: hash, URL: url}
+			s.addPlanEntry(&PlanEntry{Path: key, Action: PlanActionSkip, Size: len(bytesContent), Reference: url})
+			fmt.Fprintln(s.log, "Skipped unchanged", filePath)
+			continue
 		}
-		requests = append(requests, request)
+
+		s.addPlanEntry(&PlanEntry{Path: key, Action: PlanActionUpload, Size: len(bytesContent)})
+
+		// dry-runの場合はアップロードしない
+		if s.dryRun {
+			continue
+		}
+
+		uploadFilePaths = append(uploadFilePaths, filePath)
+		contents = append(contents, bytesContent)
+		hashes = append(hashes, hash)
 	}
 
-	uploadMediaFiles(basePath, filesPaths, requests)
+	if len(uploadFilePaths) > 0 {
+		s.uploadMediaFiles(uploadFilePaths, contents, hashes)
+	}
+
+	if len(s.mediaUploadFailures) > 0 {
+		failedFilePaths := []string{}
+		for filePath := range s.mediaUploadFailures {
+			failedFilePaths = append(failedFilePaths, filePath)
+		}
+		sort.Strings(failedFilePaths)
+		return fmt.Errorf("%w: %s", ErrMediaUploadFailed, strings.Join(failedFilePaths, ", "))
+	}
 
 	return nil
 }
@@ -0,0 +1,317 @@
+package deploy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/keystore"
+)
+
+const nip96WellKnownPath = "/.well-known/nostr/nip96.json"
+
+// 処理中のアップロードの完了を待つ間隔と回数
+const (
+	nip96ProcessingInterval = 2 * time.Second
+	nip96ProcessingRetries  = 30
+)
+
+// NIP96Plan はNIP-96サーバーのプランごとの制限
+type NIP96Plan struct {
+	Name        string `json:"name"`
+	MaxByteSize int64  `json:"max_byte_size"`
+}
+
+// NIP96ServerInfo は/.well-known/nostr/nip96.jsonの内容
+type NIP96ServerInfo struct {
+	APIURL            string               `json:"api_url"`
+	DownloadURL       string               `json:"download_url,omitempty"`
+	DelegatedToURL    string               `json:"delegated_to_url,omitempty"`
+	SupportedNIPs     []int                `json:"supported_nips,omitempty"`
+	ContentTypes      []string             `json:"content_types,omitempty"`
+	Plans             map[string]NIP96Plan `json:"plans,omitempty"`
+	TermsOfServiceURL string               `json:"tos_url,omitempty"`
+}
+
+// NIP96UploadResult はアップロードのレスポンス
+type NIP96UploadResult struct {
+	Status        string `json:"status"`
+	Message       string `json:"message"`
+	ProcessingURL string `json:"processing_url,omitempty"`
+	NIP94Event    struct {
+		Tags    nostr.Tags `json:"tags"`
+		Content string     `json:"content"`
+	} `json:"nip94_event"`
+}
+
+// NIP-96に準拠したサーバーへアップロードする
+type nip96Uploader struct {
+	server string
+	signer keystore.Signer
+	pubKey string
+	client *http.Client
+	info   *NIP96ServerInfo
+	mutex  sync.Mutex
+	// サーバーがメディアを変換した場合の警告の出力先
+	log io.Writer
+}
+
+func newNIP96Uploader(server string, signer keystore.Signer, pubKey string, log io.Writer) *nip96Uploader {
+	if log == nil {
+		log = io.Discard
+	}
+	return &nip96Uploader{
+		server: strings.TrimSuffix(server, "/"),
+		signer: signer,
+		pubKey: pubKey,
+		client: &http.Client{},
+		log:    log,
+	}
+}
+
+func (u *nip96Uploader) Name() string {
+	return UploaderNIP96 + ":" + u.server
+}
+
+func (u *nip96Uploader) Upload(filePath, contentType string, content []byte, hash string) (string, error) {
+	info, err := u.getServerInfo()
+	if err != nil {
+		return "", err
+	}
+
+	// サーバーの制限を確認する
+	if !isNIP96ContentTypeSupported(info.ContentTypes, contentType) {
+		return "", fmt.Errorf("Content-Type %s is not supported by %s", contentType, u.server)
+	}
+	if plan, ok := info.Plans["free"]; ok && plan.MaxByteSize > 0 && int64(len(content)) > plan.MaxByteSize {
+		return "", fmt.Errorf("File size %d exceeds the limit of %d bytes", len(content), plan.MaxByteSize)
+	}
+
+	// リクエストボディを作成
+	var requestBody bytes.Buffer
+	writer := multipart.NewWriter(&requestBody)
+
+	part, err := writer.CreateFormFile("file", filepath.Base(filePath))
+	if err != nil {
+		return "", fmt.Errorf("Error creating form file: %w", err)
+	}
+	_, err = part.Write(content)
+	if err != nil {
+		return "", fmt.Errorf("Error copying file: %w", err)
+	}
+	for _, field := range [][2]string{
+		{"size", fmt.Sprint(len(content))},
+		{"content_type", contentType},
+	} {
+		err = writer.WriteField(field[0], field[1])
+		if err != nil {
+			return "", fmt.Errorf("Error writing field: %w", err)
+		}
+	}
+	err = writer.Close()
+	if err != nil {
+		return "", fmt.Errorf("Error closing writer: %w", err)
+	}
+
+	// NIP-98の認可ヘッダーを取得
+	auth, err := getHTTPAuthorization(u.signer, u.pubKey, info.APIURL, "POST", hashBytes(requestBody.Bytes()))
+	if err != nil {
+		return "", err
+	}
+
+	request, err := http.NewRequest("POST", info.APIURL, &requestBody)
+	if err != nil {
+		return "", fmt.Errorf("Error creating request: %w", err)
+	}
+	request.Header.Set("Authorization", auth)
+	request.Header.Set("Accept", "application/json")
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+
+	result, err := u.doUploadRequest(request)
+	if err != nil {
+		return "", err
+	}
+
+	// 処理中の場合は完了するまで待つ
+	for i := 0; i < nip96ProcessingRetries && result.NIP94Event.Tags.GetFirst([]string{"url"}) == nil; i++ {
+		if len(result.ProcessingURL) < 1 {
+			break
+		}
+		time.Sleep(nip96ProcessingInterval)
+
+		request, err := http.NewRequest("GET", result.ProcessingURL, nil)
+		if err != nil {
+			return "", fmt.Errorf("Error creating request: %w", err)
+		}
+		result, err = u.doUploadRequest(request)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// NIP-94のタグからURLとハッシュを取得する
+	urlTag := result.NIP94Event.Tags.GetFirst([]string{"url"})
+	if urlTag == nil {
+		return "", fmt.Errorf("Failed to upload: %s", result.Message)
+	}
+	if originalHash := result.NIP94Event.Tags.GetFirst([]string{"ox"}); originalHash != nil && originalHash.Value() != hash {
+		return "", fmt.Errorf("Hash mismatch: expected %s but got %s", hash, originalHash.Value())
+	}
+	if mimeType := result.NIP94Event.Tags.GetFirst([]string{"m"}); mimeType != nil && mimeType.Value() != contentType {
+		fmt.Fprintln(u.log, "\n⚠️ Media type of", filePath, "was converted to", mimeType.Value())
+	}
+
+	return urlTag.Value(), nil
+}
+
+// NIP-98の認可ヘッダーを付けて<api_url>/<sha256>(.ext)にDELETEリクエストを送る
+func (u *nip96Uploader) Delete(fileURL, hash string) error {
+	info, err := u.getServerInfo()
+	if err != nil {
+		return err
+	}
+
+	deleteURL := info.APIURL + "/" + hash
+	if parsed, err := url.Parse(fileURL); err == nil {
+		deleteURL += strings.ToLower(path.Ext(parsed.Path))
+	}
+
+	auth, err := getHTTPAuthorization(u.signer, u.pubKey, deleteURL, http.MethodDelete, "")
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest(http.MethodDelete, deleteURL, nil)
+	if err != nil {
+		return fmt.Errorf("Error creating request: %w", err)
+	}
+	request.Header.Set("Authorization", auth)
+	request.Header.Set("Accept", "application/json")
+
+	response, err := u.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("Error sending request: %w", err)
+	}
+	defer response.Body.Close()
+
+	// 既に削除されている場合も成功とみなす
+	if response.StatusCode == http.StatusNotFound {
+		return nil
+	}
+
+	var result NIP96UploadResult
+	json.NewDecoder(response.Body).Decode(&result)
+	if response.StatusCode < 200 || response.StatusCode > 299 || result.Status == "error" {
+		return fmt.Errorf("Failed to delete: %d %s", response.StatusCode, result.Message)
+	}
+
+	return nil
+}
+
+func (u *nip96Uploader) doUploadRequest(request *http.Request) (*NIP96UploadResult, error) {
+	response, err := u.client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("Error sending request: %w", err)
+	}
+	defer response.Body.Close()
+
+	var result NIP96UploadResult
+	err = json.NewDecoder(response.Body).Decode(&result)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to upload: %d", response.StatusCode)
+	}
+
+	if response.StatusCode < 200 || response.StatusCode > 299 || result.Status == "error" {
+		return nil, fmt.Errorf("Failed to upload: %d %s", response.StatusCode, result.Message)
+	}
+
+	return &result, nil
+}
+
+// サーバーの情報を取得する。委譲されている場合は委譲先の情報を取得する
+func (u *nip96Uploader) getServerInfo() (*NIP96ServerInfo, error) {
+	// アップロードは並列に行われるので排他制御する
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.info != nil {
+		return u.info, nil
+	}
+
+	// 情報を取得したサーバー。委譲されている場合は委譲先
+	infoServer := u.server
+	info, err := fetchNIP96ServerInfo(u.client, infoServer)
+	if err != nil {
+		return nil, err
+	}
+	if len(info.APIURL) < 1 && len(info.DelegatedToURL) > 0 {
+		infoServer = strings.TrimSuffix(info.DelegatedToURL, "/")
+		info, err = fetchNIP96ServerInfo(u.client, infoServer)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(info.APIURL) < 1 {
+		return nil, fmt.Errorf("api_url is not specified by %s", infoServer)
+	}
+
+	// api_urlは相対URLの場合があり、情報を取得したサーバーを基準に解決する
+	base, err := url.Parse(infoServer + "/")
+	if err != nil {
+		return nil, err
+	}
+	apiURL, err := base.Parse(info.APIURL)
+	if err != nil {
+		return nil, err
+	}
+	info.APIURL = apiURL.String()
+
+	u.info = info
+	return info, nil
+}
+
+func fetchNIP96ServerInfo(client *http.Client, server string) (*NIP96ServerInfo, error) {
+	response, err := client.Get(server + nip96WellKnownPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch server info: %w", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to fetch server info: %d", response.StatusCode)
+	}
+
+	var info NIP96ServerInfo
+	err = json.NewDecoder(response.Body).Decode(&info)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding server info: %w", err)
+	}
+
+	return &info, nil
+}
+
+// content_typesが空の場合はすべて許可される。"image/*"のようなワイルドカードにも対応する
+func isNIP96ContentTypeSupported(contentTypes []string, contentType string) bool {
+	if len(contentTypes) < 1 {
+		return true
+	}
+	for _, supported := range contentTypes {
+		if supported == contentType {
+			return true
+		}
+		if strings.HasSuffix(supported, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(supported, "*")) {
+			return true
+		}
+	}
+	return false
+}
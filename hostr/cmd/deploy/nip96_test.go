@@ -0,0 +1,221 @@
+package deploy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/keystore"
+)
+
+// NIP-96サーバーの代わりに使うテスト用サーバー
+type fakeNIP96Server struct {
+	*httptest.Server
+	pubKey string
+	// アップロードに返すステータスコード
+	uploadStatus int
+	// 受け取った認可イベント
+	authEvent *nostr.Event
+	// 受け取ったファイルの内容
+	uploaded []byte
+}
+
+func newFakeNIP96Server(t *testing.T, pubKey string) *fakeNIP96Server {
+	server := &fakeNIP96Server{pubKey: pubKey, uploadStatus: http.StatusOK}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(nip96WellKnownPath, func(w http.ResponseWriter, r *http.Request) {
+		// api_urlは相対URLでも解決される
+		json.NewEncoder(w).Encode(NIP96ServerInfo{
+			APIURL:       "/api/upload",
+			ContentTypes: []string{"image/*"},
+			Plans:        map[string]NIP96Plan{"free": {Name: "Free", MaxByteSize: 1024}},
+		})
+	})
+	mux.HandleFunc("/api/upload", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		server.authEvent = server.verifyAuthorization(t, r, body)
+
+		if server.uploadStatus != http.StatusOK {
+			w.WriteHeader(server.uploadStatus)
+			json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "quota exceeded"})
+			return
+		}
+
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			t.Errorf("file field is missing: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		server.uploaded, _ = io.ReadAll(file)
+
+		hash := sha256.Sum256(server.uploaded)
+		result := NIP96UploadResult{Status: "success", Message: "Upload successful."}
+		result.NIP94Event.Tags = nostr.Tags{
+			{"url", server.URL + "/media/" + hex.EncodeToString(hash[:]) + ".png"},
+			{"ox", hex.EncodeToString(hash[:])},
+			{"m", r.FormValue("content_type")},
+		}
+		json.NewEncoder(w).Encode(result)
+	})
+	server.Server = httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// NIP-98のAuthorizationヘッダーを検証し、認可イベントを返す。
+// ハンドラーのgoroutineから呼ばれるのでt.Fatalは使わない
+func (s *fakeNIP96Server) verifyAuthorization(t *testing.T, r *http.Request, body []byte) *nostr.Event {
+	t.Helper()
+
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Nostr ") {
+		t.Errorf("Authorization header = %q, want Nostr scheme", header)
+		return nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(header, "Nostr "))
+	if err != nil {
+		t.Errorf("failed to decode Authorization header: %v", err)
+		return nil
+	}
+
+	var ev nostr.Event
+	if err := json.Unmarshal(decoded, &ev); err != nil {
+		t.Errorf("failed to unmarshal auth event: %v", err)
+		return nil
+	}
+	if ok, err := ev.CheckSignature(); !ok || err != nil {
+		t.Errorf("auth event signature is invalid: %v", err)
+	}
+	if ev.Kind != KindHTTPAuth {
+		t.Errorf("auth event kind = %d, want %d", ev.Kind, KindHTTPAuth)
+	}
+	if ev.PubKey != s.pubKey {
+		t.Errorf("auth event pubkey = %s, want %s", ev.PubKey, s.pubKey)
+	}
+	if u := ev.Tags.GetFirst([]string{"u"}); u == nil || u.Value() != s.URL+"/api/upload" {
+		t.Errorf("u tag = %v, want %s", u, s.URL+"/api/upload")
+	}
+	if method := ev.Tags.GetFirst([]string{"method"}); method == nil || method.Value() != r.Method {
+		t.Errorf("method tag = %v, want %s", method, r.Method)
+	}
+	bodyHash := sha256.Sum256(body)
+	if payload := ev.Tags.GetFirst([]string{"payload"}); payload == nil || payload.Value() != hex.EncodeToString(bodyHash[:]) {
+		t.Errorf("payload tag = %v, want sha256 of the request body", payload)
+	}
+
+	return &ev
+}
+
+func newTestNIP96Uploader(t *testing.T) (*nip96Uploader, *fakeNIP96Server) {
+	secretKey := nostr.GeneratePrivateKey()
+	signer := keystore.NewKeySigner(secretKey)
+	pubKey, _ := signer.GetPublicKey()
+
+	server := newFakeNIP96Server(t, pubKey)
+	return newNIP96Uploader(server.URL+"/", signer, pubKey, io.Discard), server
+}
+
+func TestNIP96Upload(t *testing.T) {
+	uploader, server := newTestNIP96Uploader(t)
+
+	content := []byte("\x89PNG fake image")
+	hash := hashBytes(content)
+
+	url, err := uploader.Upload("img/logo.png", "image/png", content, hash)
+	if err != nil {
+		t.Fatalf("Upload() error = %v", err)
+	}
+	if want := server.URL + "/media/" + hash + ".png"; url != want {
+		t.Errorf("Upload() = %s, want %s", url, want)
+	}
+	if string(server.uploaded) != string(content) {
+		t.Errorf("server received %q, want %q", server.uploaded, content)
+	}
+	if server.authEvent == nil {
+		t.Fatal("server did not receive an auth event")
+	}
+	if uploader.info == nil || uploader.info.APIURL != server.URL+"/api/upload" {
+		t.Errorf("api_url was not resolved against the server: %+v", uploader.info)
+	}
+}
+
+// 委譲先の相対的なapi_urlは委譲先のサーバーを基準に解決する
+func TestNIP96DelegatedServer(t *testing.T) {
+	secretKey := nostr.GeneratePrivateKey()
+	signer := keystore.NewKeySigner(secretKey)
+	pubKey, _ := signer.GetPublicKey()
+
+	delegated := newFakeNIP96Server(t, pubKey)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(NIP96ServerInfo{DelegatedToURL: delegated.URL + "/"})
+	}))
+	defer server.Close()
+	uploader := newNIP96Uploader(server.URL, signer, pubKey, io.Discard)
+
+	content := []byte("\x89PNG fake image")
+	if _, err := uploader.Upload("logo.png", "image/png", content, hashBytes(content)); err != nil {
+		t.Fatalf("Upload() error = %v", err)
+	}
+	if uploader.info.APIURL != delegated.URL+"/api/upload" {
+		t.Errorf("api_url = %s, want it resolved against the delegated server", uploader.info.APIURL)
+	}
+	if string(delegated.uploaded) != string(content) {
+		t.Errorf("delegated server received %q, want %q", delegated.uploaded, content)
+	}
+}
+
+func TestNIP96UploadErrorStatus(t *testing.T) {
+	uploader, server := newTestNIP96Uploader(t)
+	server.uploadStatus = http.StatusPaymentRequired
+
+	content := []byte("\x89PNG fake image")
+	_, err := uploader.Upload("logo.png", "image/png", content, hashBytes(content))
+	if err == nil {
+		t.Fatal("Upload() error = nil, want an error for status 402")
+	}
+	if !strings.Contains(err.Error(), "402") || !strings.Contains(err.Error(), "quota exceeded") {
+		t.Errorf("Upload() error = %v, want status and message", err)
+	}
+}
+
+func TestNIP96UploadServerLimits(t *testing.T) {
+	uploader, _ := newTestNIP96Uploader(t)
+
+	content := []byte("font")
+	if _, err := uploader.Upload("font.woff2", "font/woff2", content, hashBytes(content)); err == nil {
+		t.Error("Upload() of an unsupported content type succeeded")
+	}
+
+	large := make([]byte, 2048)
+	if _, err := uploader.Upload("large.png", "image/png", large, hashBytes(large)); err == nil {
+		t.Error("Upload() larger than max_byte_size succeeded")
+	}
+}
+
+func TestNIP96DiscoveryFailure(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	secretKey := nostr.GeneratePrivateKey()
+	signer := keystore.NewKeySigner(secretKey)
+	pubKey, _ := signer.GetPublicKey()
+	uploader := newNIP96Uploader(server.URL, signer, pubKey, io.Discard)
+
+	content := []byte("\x89PNG fake image")
+	_, err := uploader.Upload("logo.png", "image/png", content, hashBytes(content))
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Upload() error = %v, want a server info error with status 404", err)
+	}
+}
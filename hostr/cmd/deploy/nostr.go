@@ -5,16 +5,41 @@ import (
 	"fmt"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/nbd-wtf/go-nostr"
-	"github.com/nbd-wtf/go-nostr/nip19"
 	"github.com/studiokaiji/nostr-webhost/hostr/cmd/consts"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/keystore"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/relays"
 	"github.com/studiokaiji/nostr-webhost/hostr/cmd/tools"
 )
 
-var allRelays []string
+// キューに追加するイベントを生成する。
+// dry-runの場合とリモートの署名者を使う場合はIDのみ計算し、publishの直前にまとめて署名する
+func (s *deployState) getEvent(content string, kind int, tags nostr.Tags) (*nostr.Event, error) {
+	ev := nostr.Event{
+		PubKey:    s.pubKey,
+		CreatedAt: nostr.Now(),
+		Kind:      kind,
+		Content:   content,
+		Tags:      tags,
+	}
+
+	if _, ok := s.signer.(keystore.BatchSigner); s.dryRun || ok {
+		ev.ID = ev.GetID()
+		return &ev, nil
+	}
+
+	err := s.signer.SignEvent(&ev)
+	if err != nil {
+		return nil, err
+	}
 
-func getEvent(priKey, pubKey, content string, kind int, tags nostr.Tags) (*nostr.Event, error) {
+	return &ev, err
+}
+
+// HTTPの認可のようにすぐに送るイベントを署名して生成する
+func getSignedEvent(signer keystore.Signer, pubKey, content string, kind int, tags nostr.Tags) (*nostr.Event, error) {
 	ev := nostr.Event{
 		PubKey:    pubKey,
 		CreatedAt: nostr.Now(),
@@ -23,124 +48,285 @@ func getEvent(priKey, pubKey, content string, kind int, tags nostr.Tags) (*nostr
 		Tags:      tags,
 	}
 
-	err := ev.Sign(priKey)
+	err := signer.SignEvent(&ev)
 	if err != nil {
 		return nil, err
 	}
 
-	return &ev, err
+	return &ev, nil
+}
+
+// キューとサイトのマニフェストのうち署名されていないイベントに署名する。
+// リモートの署名者にはリクエストをまとめて送る
+func (s *deployState) signEventsFromQueue() error {
+	unsigned := []*nostr.Event{}
+	for _, event := range s.nostrEventsQueue {
+		if len(event.Sig) < 1 {
+			unsigned = append(unsigned, event)
+		}
+	}
+	if s.siteManifestEvent != nil && len(s.siteManifestEvent.Sig) < 1 {
+		unsigned = append(unsigned, s.siteManifestEvent)
+	}
+	if len(unsigned) < 1 {
+		return nil
+	}
+
+	batchSigner, ok := s.signer.(keystore.BatchSigner)
+	if !ok {
+		for _, event := range unsigned {
+			if err := s.signer.SignEvent(event); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	fmt.Fprintln(s.log, "✍️ Requesting", len(unsigned), "signatures from the remote signer...")
+	return batchSigner.SignEvents(unsigned)
 }
 
 func isValidBasicFileType(str string) bool {
-	return strings.HasSuffix(str, ".html") || strings.HasSuffix(str, ".css") || strings.HasSuffix(str, ".js")
+	return len(tools.PageExt(str)) > 0
 }
-func publishEventsFromQueue(replaceable bool) (string, string) {
+
+const (
+	publishTimeout       = 10 * time.Second
+	publishRetryInterval = time.Second
+)
+
+// publish先のリレー
+type publishRelay struct {
+	url   string
+	relay *nostr.Relay
+}
+
+// 署名者はNIP-42のAUTHを要求するリレーへの応答にも使う
+func (s *deployState) publishEventsFromQueue() (*PublishReport, error) {
 	ctx := context.Background()
+	report := newPublishReport(s.allRelays, s.minRelays)
+
+	if len(s.nostrEventsQueue) < 1 && s.siteManifestEvent == nil {
+		fmt.Fprintln(s.log, "No changes to publish.")
+		return report, nil
+	}
 
-	fmt.Println("Publishing...")
+	// 署名できなかった場合も何もpublishせず、次回のデプロイですべて再度publishする
+	if err := s.signEventsFromQueue(); err != nil {
+		s.discardQueuedManifestEntries()
+		return report, fmt.Errorf("failed to sign events: %w", err)
+	}
 
 	// 各リレーに接続
-	var relays []*nostr.Relay
+	var relays []*publishRelay
 
-	for _, url := range allRelays {
-		relay, err := nostr.RelayConnect(ctx, url)
+	for _, url := range s.allRelays {
+		relay, err := s.connectRelay(ctx, url)
 		if err != nil {
-			fmt.Println("❌ Failed to connect to:", url)
+			fmt.Fprintln(s.log, "❌ Failed to connect to:", url)
+			report.addConnectionError(url, err)
 			continue
 		}
-		relays = append(relays, relay)
+		relays = append(relays, &publishRelay{url: url, relay: relay})
 	}
 
-	// Publishの進捗状況を表示
-	allEventsCount := len(nostrEventsQueue)
-	uploadedMediaFilePathToURLCount := 0
+	// 接続できたリレーが足りない場合は何もpublishせず、次回のデプロイですべて再度publishする
+	if len(relays) < s.minRelays {
+		s.discardQueuedManifestEntries()
+		report.Write(s.log)
+		return report, fmt.Errorf("%w: connected to %d relays but %d are required", ErrQuorumNotMet, len(relays), s.minRelays)
+	}
 
-	var wg sync.WaitGroup
+	fmt.Fprintln(s.log, "Publishing...")
 
-	go func() {
-		wg.Add(1)
-		tools.DisplayProgressBar(&uploadedMediaFilePathToURLCount, &allEventsCount)
-		wg.Done()
-	}()
+	// Publishの進捗状況を表示
+	allEventsCount := len(s.nostrEventsQueue)
+	if s.siteManifestEvent != nil {
+		allEventsCount++
+	}
+	progress := s.startProgress(ProgressStagePublish, allEventsCount)
+
+	var eventsWg sync.WaitGroup
 
-	var mutex sync.Mutex
+	// イベントIDからマニフェストのキーを取得できるようにする
+	eventIDToPath := map[string]string{}
+	for key, entry := range s.currentManifest.Files {
+		eventIDToPath[entry.EventID] = key
+	}
 
 	// リレーへpublish
-	for _, ev := range nostrEventsQueue {
-		wg.Add(1)
+	for _, ev := range s.nostrEventsQueue {
+		eventsWg.Add(1)
 		go func(event *nostr.Event) {
-			for _, relay := range relays {
-				_, err := relay.Publish(ctx, *event)
-				if err != nil {
-					fmt.Println(err)
-					continue
-				}
-			}
-			mutex.Lock()                      // ロックして排他制御
-			uploadedMediaFilePathToURLCount++ // カウントアップ
-			mutex.Unlock()                    // ロック解除
-			wg.Done()                         // ゴルーチンの終了を通知
+			report.addEvent(s.publishEvent(ctx, relays, event, eventIDToPath[event.ID]))
+			progress.increment() // カウントアップ
+			eventsWg.Done()      // ゴルーチンの終了を通知
 		}(ev)
 	}
 
-	wg.Wait()
+	eventsWg.Wait()
 
-	if uploadedMediaFilePathToURLCount < allEventsCount {
-		fmt.Println("Failed to deploy", allEventsCount-uploadedMediaFilePathToURLCount, "files.")
+	// マニフェストは参照するすべてのイベントのpublishが終わってからpublishする。
+	// 受け付けられなかったイベントがある場合は以前のバージョンを表示し続けるためにpublishしない
+	failedBeforeManifest := len(report.FailedEvents())
+	if s.siteManifestEvent != nil {
+		if failedBeforeManifest < 1 {
+			report.addEvent(s.publishEvent(ctx, relays, s.siteManifestEvent, siteManifestKey))
+		} else {
+			delete(s.currentManifest.Files, siteManifestKey)
+		}
+		progress.increment()
 	}
 
-	indexEvent := nostrEventsQueue[len(nostrEventsQueue)-1]
+	progress.wait()
 
-	encoded := ""
-	if !replaceable {
-		if enc, err := nip19.EncodeEvent(indexEvent.ID, allRelays, indexEvent.PubKey); err == nil {
-			encoded = enc
-		} else {
-			fmt.Println("❌ Failed to covert nevent:", err)
+	for _, relay := range relays {
+		relay.relay.Close()
+	}
+
+	report.Write(s.log)
+
+	failed := report.FailedEvents()
+	if len(failed) < 1 {
+		return report, nil
+	}
+
+	// 受け付けられなかったイベントは次回のデプロイで再度publishする
+	for _, event := range failed {
+		if entry, ok := s.currentManifest.Files[event.Path]; ok && entry.EventID == event.EventID {
+			delete(s.currentManifest.Files, event.Path)
 		}
 	}
+	if failedBeforeManifest > 0 && s.siteManifestEvent != nil {
+		fmt.Fprintln(s.log, "⚠️ Site manifest was not published because some files were not accepted by enough relays")
+	}
 
-	return indexEvent.ID, encoded
+	return report, fmt.Errorf("%w: %d of %d events were accepted by fewer than %d relays", ErrQuorumNotMet, len(failed), allEventsCount, s.minRelays)
 }
 
-func pathToKind(path string, replaceable bool) (int, error) {
-	// パスを分割
-	separatedPath := strings.Split(path, ".")
-	// 拡張子を取得
-	ex := separatedPath[len(separatedPath)-1]
-	// replaceable(NIP-33)の場合はReplaceableなkindを返す
-	switch ex {
-	case "html":
-		if replaceable {
-			return consts.KindWebhostHTML, nil
-		} else {
-			return consts.KindWebhostReplaceableHTML, nil
+// キューのイベントをマニフェストから取り除き、次回のデプロイで再度publishされるようにする
+func (s *deployState) discardQueuedManifestEntries() {
+	for _, event := range s.nostrEventsQueue {
+		for key, entry := range s.currentManifest.Files {
+			if entry.EventID == event.ID {
+				delete(s.currentManifest.Files, key)
+			}
 		}
-	case "css":
-		if replaceable {
-			return consts.KindWebhostReplaceableCSS, nil
-		} else {
-			return consts.KindWebhostCSS, nil
+	}
+	delete(s.currentManifest.Files, siteManifestKey)
+}
+
+// 失敗した場合は間隔を空けて再試行しながらリレーに接続する
+func (s *deployState) connectRelay(ctx context.Context, url string) (*nostr.Relay, error) {
+	var err error
+	for attempt := 0; attempt <= s.publishRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(getRetryInterval(attempt))
 		}
-	case "js":
-		if replaceable {
-			return consts.KindWebhostReplaceableJS, nil
-		} else {
-			return consts.KindWebhostJS, nil
+
+		connectCtx, cancel := context.WithTimeout(ctx, publishTimeout)
+		var relay *nostr.Relay
+		relay, err = relays.Connect(connectCtx, url, s.signer, 0)
+		cancel()
+		if err == nil {
+			return relay, nil
+		}
+	}
+	return nil, err
+}
+
+// イベントを各リレーへ並列にpublishする
+func (s *deployState) publishEvent(ctx context.Context, relays []*publishRelay, event *nostr.Event, path string) *EventPublishResult {
+	result := &EventPublishResult{
+		Path:    path,
+		EventID: event.ID,
+		Kind:    event.Kind,
+		Relays:  make([]*RelayResult, len(relays)),
+	}
+
+	var wg sync.WaitGroup
+	for i, relay := range relays {
+		wg.Add(1)
+		go func(i int, relay *publishRelay) {
+			result.Relays[i] = s.publishEventToRelay(ctx, relay, event)
+			wg.Done()
+		}(i, relay)
+	}
+	wg.Wait()
+
+	return result
+}
+
+// 失敗した場合は間隔を空けて再試行しながらリレーにpublishする
+func (s *deployState) publishEventToRelay(ctx context.Context, relay *publishRelay, event *nostr.Event) *RelayResult {
+	result := &RelayResult{Relay: relay.url}
+
+	for attempt := 0; attempt <= s.publishRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(getRetryInterval(attempt))
+		}
+		result.Attempts = attempt + 1
+
+		publishCtx, cancel := context.WithTimeout(ctx, publishTimeout)
+		status, err := relay.relay.Publish(publishCtx, *event)
+		cancel()
+
+		switch {
+		case status == nostr.PublishStatusSucceeded:
+			result.Status = RelayStatusOK
+			result.Message = ""
+			return result
+		case status == nostr.PublishStatusSent:
+			// OKが返ってくる前にタイムアウトした
+			result.Status = RelayStatusTimeout
+			result.Message = "no response from relay"
+		case err != nil && strings.HasPrefix(err.Error(), "msg: "):
+			result.Status = RelayStatusRejected
+			result.Message = strings.TrimPrefix(err.Error(), "msg: ")
+			// レート制限と認証前の拒否以外は再試行しても結果は変わらない
+			if !strings.HasPrefix(result.Message, "rate-limited:") && !strings.HasPrefix(result.Message, "auth-required:") {
+				return result
+			}
+		default:
+			result.Status = RelayStatusError
+			result.Message = fmt.Sprint(err)
 		}
+	}
+
+	return result
+}
+
+// 再試行の間隔。回数ごとに倍にする
+func getRetryInterval(attempt int) time.Duration {
+	return publishRetryInterval << (attempt - 1)
+}
+
+// ファイルのkindを取得する。Replaceableなサイトでも各ファイルは置き換えられないイベントとして公開し、
+// サイトのマニフェストだけを置き換え可能にすることで、マニフェストが参照するイベントを残す
+func pathToKind(path string) (int, error) {
+	// .htmや.mjs、大文字の拡張子も正規化して判定する
+	switch tools.PageExt(path) {
+	case ".html":
+		return consts.KindWebhostHTML, nil
+	case ".css":
+		return consts.KindWebhostCSS, nil
+	case ".js":
+		return consts.KindWebhostJS, nil
 	default:
 		return 0, fmt.Errorf("Invalid path")
 	}
 }
 
-// Replaceableにする場合のidentifier(dタグ)を取得
+// Replaceableなサイトでファイルを参照するパスを取得。hostr startはサイトのマニフェストから解決する。
+// filePathはサイトルートからの相対パス
 func getReplaceableIdentifier(indexHtmlIdentifier, filePath string) string {
-	return indexHtmlIdentifier + "/" + filePath[1:]
+	if filePath == "index.html" {
+		return indexHtmlIdentifier
+	}
+	return indexHtmlIdentifier + "/" + strings.TrimPrefix(filePath, "/")
 }
 
-var nostrEventsQueue []*nostr.Event
-
-func addNostrEventQueue(event *nostr.Event, filePath string) {
-	nostrEventsQueue = append(nostrEventsQueue, event)
-	fmt.Println("Added", filePath, "event to publish queue")
+func (s *deployState) addNostrEventQueue(event *nostr.Event, filePath string) {
+	s.nostrEventsQueue = append(s.nostrEventsQueue, event)
+	fmt.Fprintln(s.log, "Added", filePath, "event to publish queue")
 }
@@ -0,0 +1,106 @@
+package deploy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+const (
+	PlanActionPublish = "publish"
+	PlanActionSkip    = "skip"
+	PlanActionUpload  = "upload"
+)
+
+// PlanEntry はデプロイされるファイル1つ分の計画
+type PlanEntry struct {
+	Path   string `json:"path"`
+	Action string `json:"action"`
+	Kind   int    `json:"kind,omitempty"`
+	DTag   string `json:"dTag,omitempty"`
+	// 元のファイルのバイト数
+	Size int `json:"size"`
+	// 圧縮・エンコードしたイベントのcontentのバイト数。アップロードするメディアでは0
+	EncodedSize int    `json:"encodedSize,omitempty"`
+	Reference   string `json:"reference,omitempty"`
+}
+
+// Plan はデプロイ全体の計画
+type Plan struct {
+	Identifier  string       `json:"identifier,omitempty"`
+	Replaceable bool         `json:"replaceable"`
+	Relays      []string     `json:"relays"`
+	Files       []*PlanEntry `json:"files"`
+}
+
+func (s *deployState) addPlanEntry(entry *PlanEntry) {
+	s.plan.Files = append(s.plan.Files, entry)
+}
+
+// イベントから計画を追加する。sizeは元のファイルのバイト数。参照先はReplaceableの場合はdタグ、そうでない場合はnevent
+func (s *deployState) addEventPlanEntry(path, action string, kind int, tags nostr.Tags, size int, content, eventID string) {
+	entry := &PlanEntry{
+		Path:        path,
+		Action:      action,
+		Kind:        kind,
+		Size:        size,
+		EncodedSize: len(content),
+	}
+
+	if dTag := tags.GetFirst([]string{"d"}); dTag != nil {
+		entry.DTag = dTag.Value()
+		entry.Reference = entry.DTag
+	} else if s.replaceable && !strings.Contains(path, "#") {
+		// Replaceableなサイトのファイルはサイトのマニフェストから解決されるパスで参照する
+		entry.Reference = getReplaceableIdentifier(s.indexHtmlIdentifier, path)
+	} else if nevent, err := nip19.EncodeEvent(eventID, s.allRelays, s.pubKey); err == nil {
+		entry.Reference = nevent
+	}
+
+	s.addPlanEntry(entry)
+}
+
+// Write はデプロイ計画をtextまたはjson形式で出力する
+func (p *Plan) Write(w io.Writer, format string) error {
+	sort.Slice(p.Files, func(i, j int) bool {
+		return p.Files[i].Path < p.Files[j].Path
+	})
+
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(p)
+	case "text":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "PATH\tACTION\tKIND\tD TAG\tSIZE\tENCODED\tREFERENCE")
+		for _, entry := range p.Files {
+			kind := "-"
+			if entry.Kind != 0 {
+				kind = fmt.Sprint(entry.Kind)
+			}
+			dTag := "-"
+			if entry.DTag != "" {
+				dTag = entry.DTag
+			}
+			encodedSize := "-"
+			if entry.EncodedSize != 0 {
+				encodedSize = fmt.Sprint(entry.EncodedSize)
+			}
+			reference := "-"
+			if entry.Reference != "" {
+				reference = entry.Reference
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", entry.Path, entry.Action, kind, dTag, entry.Size, encodedSize, reference)
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("Invalid output format: %s", format)
+	}
+}
@@ -0,0 +1,164 @@
+package deploy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"text/tabwriter"
+)
+
+const (
+	RelayStatusOK       = "ok"
+	RelayStatusRejected = "rejected"
+	RelayStatusTimeout  = "timeout"
+	RelayStatusError    = "error"
+)
+
+// ErrQuorumNotMet は--min-relays以上のリレーに受け付けられなかったイベントがある場合のエラー
+var ErrQuorumNotMet = errors.New("not enough relays accepted the events")
+
+// RelayResult は1つのリレーへのpublishの結果
+type RelayResult struct {
+	Relay    string `json:"relay"`
+	Status   string `json:"status"`
+	Message  string `json:"message,omitempty"`
+	Attempts int    `json:"attempts"`
+}
+
+// EventPublishResult は1つのイベントのリレーごとのpublishの結果
+type EventPublishResult struct {
+	Path    string         `json:"path"`
+	EventID string         `json:"eventId"`
+	Kind    int            `json:"kind"`
+	Relays  []*RelayResult `json:"relays"`
+}
+
+// PublishReport はデプロイ全体のpublishの結果
+type PublishReport struct {
+	MinRelays        int                   `json:"minRelays"`
+	ConnectionErrors map[string]string     `json:"connectionErrors,omitempty"`
+	Events           []*EventPublishResult `json:"events"`
+	// publish先のリレー
+	relays []string
+	mutex  sync.Mutex
+}
+
+func newPublishReport(relays []string, minRelays int) *PublishReport {
+	return &PublishReport{
+		relays:           relays,
+		MinRelays:        minRelays,
+		ConnectionErrors: map[string]string{},
+		Events:           []*EventPublishResult{},
+	}
+}
+
+func (r *PublishReport) addConnectionError(url string, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.ConnectionErrors[url] = err.Error()
+}
+
+func (r *PublishReport) addEvent(result *EventPublishResult) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.Events = append(r.Events, result)
+}
+
+// 受け付けたリレーの数
+func (e *EventPublishResult) acceptedCount() int {
+	count := 0
+	for _, relay := range e.Relays {
+		if relay.Status == RelayStatusOK {
+			count++
+		}
+	}
+	return count
+}
+
+// MinRelays以上のリレーに受け付けられなかったイベントを返す
+func (r *PublishReport) FailedEvents() []*EventPublishResult {
+	failed := []*EventPublishResult{}
+	for _, event := range r.Events {
+		if event.acceptedCount() < r.MinRelays {
+			failed = append(failed, event)
+		}
+	}
+	return failed
+}
+
+// リレーごとの集計と失敗したイベントの一覧を表形式で出力する
+func (r *PublishReport) Write(w io.Writer) {
+	if len(r.Events) < 1 && len(r.ConnectionErrors) < 1 {
+		return
+	}
+
+	type relaySummary struct {
+		ok, rejected, timeout, failed int
+	}
+	summaries := map[string]*relaySummary{}
+	for _, url := range r.relays {
+		summaries[url] = &relaySummary{}
+	}
+	for _, event := range r.Events {
+		for _, relay := range event.Relays {
+			summary, ok := summaries[relay.Relay]
+			if !ok {
+				summary = &relaySummary{}
+				summaries[relay.Relay] = summary
+			}
+			switch relay.Status {
+			case RelayStatusOK:
+				summary.ok++
+			case RelayStatusRejected:
+				summary.rejected++
+			case RelayStatusTimeout:
+				summary.timeout++
+			default:
+				summary.failed++
+			}
+		}
+	}
+
+	urls := []string{}
+	for url := range summaries {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+
+	fmt.Fprintln(w, "")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "RELAY\tOK\tREJECTED\tTIMEOUT\tERROR")
+	for _, url := range urls {
+		if err, ok := r.ConnectionErrors[url]; ok {
+			fmt.Fprintf(tw, "%s\t-\t-\t-\tconnection failed: %s\n", url, err)
+			continue
+		}
+		summary := summaries[url]
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\n", url, summary.ok, summary.rejected, summary.timeout, summary.failed)
+	}
+	tw.Flush()
+
+	failed := r.FailedEvents()
+	if len(failed) < 1 {
+		return
+	}
+
+	sort.Slice(failed, func(i, j int) bool {
+		return failed[i].Path < failed[j].Path
+	})
+
+	fmt.Fprintf(w, "\n%d events were accepted by fewer than %d relays:\n", len(failed), r.MinRelays)
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PATH\tRELAY\tSTATUS\tATTEMPTS\tMESSAGE")
+	for _, event := range failed {
+		for _, relay := range event.Relays {
+			if relay.Status == RelayStatusOK {
+				continue
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n", event.Path, relay.Relay, relay.Status, relay.Attempts, relay.Message)
+		}
+	}
+	tw.Flush()
+}
@@ -0,0 +1,160 @@
+package deploy
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/fs"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/consts"
+)
+
+const (
+	MediaModeUpload = "upload"
+	MediaModeRelay  = "relay"
+)
+
+// リレーが上限を公開していない場合のcontentの最大長
+const defaultMaxContentLength = 64 * 1024
+
+// イベントのcontent以外の部分に見込む長さ
+const eventEnvelopeOverhead = 2 * 1024
+
+// すべてのリレーに受け付けられるイベントの上限。0は上限が公開されていないことを表す
+type relayLimits struct {
+	maxContentLength int
+	maxMessageLength int
+	maxEventTags     int
+}
+
+// すべてのリレーの上限のうち最も小さいものをNIP-11から取得する
+func getRelayLimits(relayURLs []string) relayLimits {
+	limits := relayLimits{}
+
+	for _, url := range relayURLs {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		info, err := nip11.Fetch(ctx, url)
+		cancel()
+		if err != nil || info.Limitation == nil {
+			continue
+		}
+
+		limits.maxContentLength = minLimit(limits.maxContentLength, info.Limitation.MaxContentLength)
+		limits.maxMessageLength = minLimit(limits.maxMessageLength, info.Limitation.MaxMessageLength)
+		limits.maxEventTags = minLimit(limits.maxEventTags, info.Limitation.MaxEventTags)
+	}
+
+	return limits
+}
+
+// 0を上限なしとして小さい方の上限を返す
+func minLimit(current, limit int) int {
+	if limit > 0 && (current < 1 || limit < current) {
+		return limit
+	}
+	return current
+}
+
+// すべてのリレーの上限。リレーのNIP-11から1度だけ取得する
+func (s *deployState) getCachedRelayLimits() relayLimits {
+	if s.relayLimits == nil {
+		limits := getRelayLimits(s.allRelays)
+		s.relayLimits = &limits
+	}
+	return *s.relayLimits
+}
+
+// すべてのリレーに受け付けられるcontentの最大長
+func (s *deployState) getCachedMaxContentLength() int {
+	limits := s.getCachedRelayLimits()
+
+	maxContentLength := limits.maxContentLength
+	if limits.maxMessageLength > 0 {
+		maxContentLength = minLimit(maxContentLength, limits.maxMessageLength-eventEnvelopeOverhead)
+	}
+	if maxContentLength < 1 {
+		return defaultMaxContentLength
+	}
+	return maxContentLength
+}
+
+// サイトのMedia FileをNIP-95のイベントとして生成しキューに追加
+func (s *deployState) generateEventsAndAddQueueAllValidStaticMediaFiles() error {
+	filePaths, err := s.listAllValidStaticMediaFilePaths()
+	if err != nil {
+		return err
+	}
+
+	for _, filePath := range filePaths {
+		_, err := s.generateFileEvent(filePath, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ファイルをNIP-95のイベントとして生成し、変更があればキューに追加する。
+// contentの最大長を超えるファイルは分割したチャンクのイベントと、それらを順番に参照するインデックスのイベントにする。
+// filePathはサイトルートからの相対パス
+func (s *deployState) generateFileEvent(filePath string, compress bool) (string, error) {
+	bytesContent, err := fs.ReadFile(s.files.FS(), filePath)
+	if err != nil {
+		return "", err
+	}
+
+	// Replaceableなサイトでも置き換えられないイベントにし、サイトのマニフェストから参照する
+	kind := consts.KindTextFile
+	baseTags := nostr.Tags{nostr.Tag{"type", s.mimeTypes.DetectFileType(s.files.FS(), filePath).ContentType}}
+
+	// ファイル内容をbase64エンコード
+	content := base64.StdEncoding.EncodeToString(bytesContent)
+	tags := baseTags
+	if compress {
+		content, tags = s.compressEventContent(bytesContent, content, baseTags)
+	}
+
+	limit := s.getCachedMaxContentLength()
+	if len(content) > limit {
+		// チャンクに分割してそれぞれイベントを生成する
+		// base64エンコード後にlimitに収まるバイト数
+		chunkSize := limit / 4 * 3
+		chunkCount := (len(bytesContent) + chunkSize - 1) / chunkSize
+
+		content = ""
+		tags = append(nostr.Tags{}, baseTags...)
+		for i := 0; i < chunkCount; i++ {
+			end := min((i+1)*chunkSize, len(bytesContent))
+			chunkContent := base64.StdEncoding.EncodeToString(bytesContent[i*chunkSize : end])
+			chunkTags := nostr.Tags{
+				nostr.Tag{"type", "application/octet-stream"},
+				nostr.Tag{"part", fmt.Sprint(i), fmt.Sprint(chunkCount)},
+			}
+
+			chunkID, err := s.generateOrReuseEvent(fmt.Sprintf("%s#%d", filePath, i), end-i*chunkSize, chunkContent, consts.KindTextFile, chunkTags)
+			if err != nil {
+				return "", err
+			}
+
+			tags = append(tags, nostr.Tag{"chunk", chunkID})
+		}
+		tags = append(tags,
+			nostr.Tag{"size", fmt.Sprint(len(bytesContent))},
+			nostr.Tag{"x", hashBytes(bytesContent)},
+		)
+	}
+
+	// eventを取得し、変更があればキューに追加
+	eventID, err := s.generateOrReuseEvent(filePath, len(bytesContent), content, kind, tags)
+	if err != nil {
+		return "", err
+	}
+
+	s.textFilePathToEventID[filePath] = eventID
+
+	return eventID, nil
+}
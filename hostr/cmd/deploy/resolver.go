@@ -0,0 +1,376 @@
+package deploy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/tools"
+	"golang.org/x/net/html"
+)
+
+// CSSのurl()と@importを検出する
+var cssURLPattern = regexp.MustCompile(`url\(\s*(['"]?)([^'"()]*)(['"]?)\s*\)`)
+var cssImportPattern = regexp.MustCompile(`@import\s+(['"])([^'"]+)(['"])`)
+
+// 参照を書き換える対象外のスキーム
+var nonLocalReferencePrefixes = []string{"#", "//", "data:", "mailto:", "tel:", "javascript:", "blob:", "nevent", "naddr"}
+
+// 参照をサイトルートからの相対パスに解決する。ローカルファイルでない場合はokがfalseになる
+func (s *deployState) resolveLocalPath(fromPath, ref string) (filePath string, suffix string, ok bool) {
+	ref = strings.TrimSpace(ref)
+	if len(ref) < 1 || isExternalURL(ref) {
+		return "", "", false
+	}
+	for _, prefix := range nonLocalReferencePrefixes {
+		if strings.HasPrefix(ref, prefix) {
+			return "", "", false
+		}
+	}
+
+	// クエリとフラグメントを切り離す
+	refPath := ref
+	if i := strings.IndexAny(ref, "?#"); i >= 0 {
+		refPath, suffix = ref[:i], ref[i:]
+	}
+	if unescaped, err := url.PathUnescape(refPath); err == nil {
+		refPath = unescaped
+	}
+	if len(refPath) < 1 {
+		return "", "", false
+	}
+
+	// 絶対パスはサイトルート、相対パスは参照元のディレクトリから解決する
+	if strings.HasPrefix(refPath, "/") {
+		filePath = path.Clean(strings.TrimPrefix(refPath, "/"))
+	} else {
+		filePath = path.Join(path.Dir(fromPath), refPath)
+	}
+
+	// サイトルートの外は対象外
+	if filePath == ".." || strings.HasPrefix(filePath, "../") {
+		return "", "", false
+	}
+
+	info, err := fs.Stat(s.files.FS(), filePath)
+	if err != nil {
+		return "", "", false
+	}
+
+	// ディレクトリの場合はその中のindex.htmlを参照する
+	if info.IsDir() {
+		filePath = path.Join(filePath, "index.html")
+		info, err = fs.Stat(s.files.FS(), filePath)
+		if err != nil || info.IsDir() {
+			return "", "", false
+		}
+	}
+
+	// 除外されたファイルは公開しない
+	if s.files.IsIgnored(filePath) {
+		return "", "", false
+	}
+
+	return filePath, suffix, true
+}
+
+// 参照元から見た参照先を取得する。
+// メディアはアップロード先のURL、Replaceableの場合はdタグへの相対パス、そうでない場合はneventを返す
+func (s *deployState) resolveReference(fromPath, ref string) (string, bool) {
+	filePath, suffix, ok := s.resolveLocalPath(fromPath, ref)
+	if !ok {
+		return "", false
+	}
+
+	if url, ok := s.uploadedMediaFilePathToURL[filePath]; ok {
+		return url + suffix, true
+	}
+	// アップロードされていないメディアは変換しない
+	if s.mediaFilePaths[filePath] {
+		if !s.dryRun {
+			fmt.Fprintln(s.log, "❌ Media file is not uploaded:", filePath)
+		}
+		return "", false
+	}
+
+	eventID, err := s.publishFile(filePath)
+	if errors.Is(err, errCircularReference) {
+		s.warnCircularReference(filePath)
+		return "", false
+	}
+	if err != nil {
+		fmt.Fprintln(s.log, "❌ Failed to resolve", ref, "in", fromPath, ":", err)
+		return "", false
+	}
+
+	if s.replaceable {
+		from := getReplaceableIdentifier(s.indexHtmlIdentifier, fromPath)
+		to := getReplaceableIdentifier(s.indexHtmlIdentifier, filePath)
+		rel, err := filepath.Rel(filepath.FromSlash(path.Dir(from)), filepath.FromSlash(to))
+		if err != nil {
+			return "", false
+		}
+		// JSのモジュール指定子として解釈されるよう、相対パスであることを明示する
+		rel = filepath.ToSlash(rel)
+		if path.Base(rel) == "." || path.Base(rel) == ".." {
+			// 参照先が参照元の祖先ディレクトリと同じdタグの場合は末尾にスラッシュを付けずに参照する
+			rel = path.Join(rel, "..", path.Base(to))
+		}
+		if !strings.HasPrefix(rel, "../") {
+			rel = "./" + rel
+		}
+		return rel + suffix, true
+	}
+
+	nevent, err := nip19.EncodeEvent(eventID, s.allRelays, s.pubKey)
+	if err != nil {
+		fmt.Fprintln(s.log, "❌ Failed to encode event", filePath, ":", err)
+		return "", false
+	}
+	return nevent + suffix, true
+}
+
+// Replaceableでないサイトの循環参照。event idは参照先のidを含むcontentから決まるので、循環するリンクは書き換えられない
+var errCircularReference = errors.New("circular reference")
+
+// 循環参照になるリンクを書き換えずに残すことを、参照先ごとに1度だけ警告する
+func (s *deployState) warnCircularReference(filePath string) {
+	if s.circularReferences[filePath] {
+		return
+	}
+	s.circularReferences[filePath] = true
+	fmt.Fprintf(s.log, "⚠️  Links back to %s form a cycle and are left as local paths, which the gateway cannot resolve. Non-replaceable sites can only link in one direction, because an event id depends on the links in its content. Deploy with --replaceable to link pages to each other.\n", filePath)
+}
+
+// ファイルの参照を書き換えてeventを生成しキューに追加する。生成済みの場合はevent idのみ返す
+func (s *deployState) publishFile(filePath string) (string, error) {
+	if eventID, ok := s.textFilePathToEventID[filePath]; ok {
+		return eventID, nil
+	}
+	if eventID, ok := s.publishedFilePathToEventID[filePath]; ok {
+		return eventID, nil
+	}
+
+	// 循環参照の場合、Replaceableであればdタグで参照できる
+	if s.resolvingFilePaths[filePath] {
+		if s.replaceable {
+			return "", nil
+		}
+		return "", fmt.Errorf("%w: %s", errCircularReference, filePath)
+	}
+	s.resolvingFilePaths[filePath] = true
+	defer delete(s.resolvingFilePaths, filePath)
+
+	if !isValidBasicFileType(filePath) {
+		return "", fmt.Errorf("Unsupported file type: %s", filePath)
+	}
+
+	// kindを取得
+	kind, err := pathToKind(filePath)
+	if err != nil {
+		return "", err
+	}
+
+	// contentを取得
+	bytesContent, err := fs.ReadFile(s.files.FS(), filePath)
+	if err != nil {
+		return "", err
+	}
+
+	// ファイルの種類に応じて参照を書き換える
+	var content string
+	switch tools.PageExt(filePath) {
+	case ".html":
+		content, err = s.convertHTML(filePath, bytesContent)
+		if err != nil {
+			return "", err
+		}
+	case ".css":
+		content = s.convertCSS(filePath, string(bytesContent))
+	case ".js":
+		content = s.convertJS(filePath, string(bytesContent))
+	}
+
+	// 圧縮する
+	content, tags := s.compressEventContent([]byte(content), content, nostr.Tags{})
+
+	// 変更があればキューに追加
+	eventID, err := s.generateOrReuseEvent(filePath, len(bytesContent), content, kind, tags)
+	if err != nil {
+		return "", err
+	}
+
+	s.publishedFilePathToEventID[filePath] = eventID
+
+	return eventID, nil
+}
+
+func (s *deployState) convertHTML(filePath string, content []byte) (string, error) {
+	// HTMLの解析
+	doc, err := html.Parse(bytes.NewReader(content))
+	if err != nil {
+		return "", err
+	}
+
+	// リンクの解析と変換
+	s.convertLinks(filePath, doc)
+
+	// 更新されたHTML
+	var buf bytes.Buffer
+	err = html.Render(&buf, doc)
+	if err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// 参照を持ち得る属性
+var referenceAttributes = map[string]bool{
+	"src":    true,
+	"poster": true,
+	"data":   true,
+}
+
+// hrefで参照を持つ要素
+var hrefElements = map[string]bool{
+	"link": true,
+	"a":    true,
+	"area": true,
+}
+
+func (s *deployState) convertLinks(filePath string, n *html.Node) {
+	if n.Type == html.ElementNode {
+		for i, a := range n.Attr {
+			switch {
+			case referenceAttributes[a.Key] || (a.Key == "href" && hrefElements[n.Data]):
+				if ref, ok := s.resolveReference(filePath, a.Val); ok {
+					n.Attr[i].Val = ref
+				}
+			case a.Key == "srcset":
+				n.Attr[i].Val = s.convertSrcset(filePath, a.Val)
+			case a.Key == "style":
+				n.Attr[i].Val = s.convertCSS(filePath, a.Val)
+			}
+		}
+
+		// インラインの<style>と<script>の中身も変換する
+		if (n.Data == "style" || n.Data == "script") && n.FirstChild != nil && n.FirstChild.Type == html.TextNode {
+			if n.Data == "style" {
+				n.FirstChild.Data = s.convertCSS(filePath, n.FirstChild.Data)
+			} else {
+				n.FirstChild.Data = s.convertJS(filePath, n.FirstChild.Data)
+			}
+		}
+	}
+
+	// 子ノードに対して再帰的に処理
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		s.convertLinks(filePath, c)
+	}
+}
+
+// srcsetの各候補のURLを変換する
+func (s *deployState) convertSrcset(filePath, srcset string) string {
+	candidates := strings.Split(srcset, ",")
+	for i, candidate := range candidates {
+		fields := strings.Fields(candidate)
+		if len(fields) < 1 {
+			continue
+		}
+		if ref, ok := s.resolveReference(filePath, fields[0]); ok {
+			fields[0] = ref
+		}
+		candidates[i] = strings.Join(fields, " ")
+	}
+	return strings.Join(candidates, ", ")
+}
+
+// CSSのurl()と@importを変換する
+func (s *deployState) convertCSS(filePath, content string) string {
+	content = cssURLPattern.ReplaceAllStringFunc(content, func(match string) string {
+		submatches := cssURLPattern.FindStringSubmatch(match)
+		ref, ok := s.resolveReference(filePath, submatches[2])
+		if !ok {
+			return match
+		}
+		return "url(" + submatches[1] + ref + submatches[3] + ")"
+	})
+
+	return cssImportPattern.ReplaceAllStringFunc(content, func(match string) string {
+		submatches := cssImportPattern.FindStringSubmatch(match)
+		ref, ok := s.resolveReference(filePath, submatches[2])
+		if !ok {
+			return match
+		}
+		return "@import " + submatches[1] + ref + submatches[3]
+	})
+}
+
+// JSの文字列リテラルのうち、サイト内のファイルを指すものを変換する
+func (s *deployState) convertJS(filePath, content string) string {
+	var buf strings.Builder
+
+	for i := 0; i < len(content); i++ {
+		quote := content[i]
+		if quote != '"' && quote != '\'' && quote != '`' {
+			buf.WriteByte(quote)
+			continue
+		}
+
+		// 閉じクォートを探す
+		end := -1
+		for j := i + 1; j < len(content); j++ {
+			if content[j] == '\\' {
+				j++
+				continue
+			}
+			if content[j] == quote {
+				end = j
+				break
+			}
+			// テンプレートリテラル以外は改行を跨がない
+			if content[j] == '\n' && quote != '`' {
+				break
+			}
+		}
+		if end < 0 {
+			buf.WriteByte(quote)
+			continue
+		}
+
+		literal := content[i+1 : end]
+		if ref, ok := s.resolveReferenceInJS(filePath, literal); ok {
+			literal = ref
+		}
+
+		buf.WriteByte(quote)
+		buf.WriteString(literal)
+		buf.WriteByte(quote)
+		i = end
+	}
+
+	return buf.String()
+}
+
+// JS内の参照はモジュールからの相対パスを優先し、見つからなければサイトルートから解決する
+func (s *deployState) resolveReferenceInJS(filePath, literal string) (string, bool) {
+	if strings.ContainsAny(literal, " \t\n${}") || !strings.Contains(literal, ".") {
+		return "", false
+	}
+	if ref, ok := s.resolveReference(filePath, literal); ok {
+		return ref, true
+	}
+	if !strings.HasPrefix(literal, ".") && !strings.HasPrefix(literal, "/") {
+		return s.resolveReference(filePath, "/"+literal)
+	}
+	return "", false
+}
@@ -0,0 +1,123 @@
+package deploy
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// ResultFile はデプロイされたファイル1つ分の結果
+type ResultFile struct {
+	Path    string `json:"path"`
+	EventID string `json:"eventId,omitempty"`
+	Kind    int    `json:"kind,omitempty"`
+	// Replaceableの場合はnaddr、そうでない場合はnevent
+	Reference string `json:"reference,omitempty"`
+	// アップロードしたメディアのURL
+	URL string `json:"url,omitempty"`
+}
+
+// ResultFailure はpublishまたはアップロードに失敗したファイル
+type ResultFailure struct {
+	Path    string         `json:"path"`
+	EventID string         `json:"eventId,omitempty"`
+	Error   string         `json:"error,omitempty"`
+	Relays  []*RelayResult `json:"relays,omitempty"`
+}
+
+// Result はCIで読み取るためのデプロイ全体の結果
+type Result struct {
+	Success     bool     `json:"success"`
+	ExitCode    int      `json:"exitCode"`
+	Error       string   `json:"error,omitempty"`
+	PubKey      string   `json:"pubkey,omitempty"`
+	Npub        string   `json:"npub,omitempty"`
+	Identifier  string   `json:"identifier,omitempty"`
+	Replaceable bool     `json:"replaceable"`
+	Relays      []string `json:"relays"`
+	// index.htmlのイベント
+	EventID string `json:"eventId,omitempty"`
+	Naddr   string `json:"naddr,omitempty"`
+	Nevent  string `json:"nevent,omitempty"`
+	// サイトのマニフェストのイベント
+	SiteManifestEventID string            `json:"siteManifestEventId,omitempty"`
+	URLs                map[string]string `json:"urls,omitempty"`
+	Files               []*ResultFile     `json:"files"`
+	Failures            []*ResultFailure  `json:"failures"`
+	// 接続できなかったリレーとエラー
+	ConnectionErrors map[string]string `json:"connectionErrors,omitempty"`
+	// dry-runの場合のデプロイ計画
+	Plan *Plan `json:"-"`
+	// publishの結果。publishしなかった場合はnil
+	PublishReport *PublishReport `json:"-"`
+}
+
+// 今回のマニフェストとpublishの結果から、ファイルごとの結果と失敗を記録する
+func (s *deployState) collectResult(report *PublishReport) {
+	result := s.result
+	result.PublishReport = report
+	result.Files = []*ResultFile{}
+	for path, entry := range s.currentManifest.Files {
+		if path == siteManifestKey {
+			result.SiteManifestEventID = entry.EventID
+			continue
+		}
+
+		file := &ResultFile{Path: path, EventID: entry.EventID, Kind: entry.Kind, URL: entry.URL}
+		if len(entry.DTag) > 0 {
+			file.Reference, _ = nip19.EncodeEntity(s.pubKey, entry.Kind, entry.DTag, s.allRelays)
+		} else if len(entry.EventID) > 0 {
+			file.Reference, _ = nip19.EncodeEvent(entry.EventID, s.allRelays, s.pubKey)
+		}
+		result.Files = append(result.Files, file)
+	}
+	sort.Slice(result.Files, func(i, j int) bool {
+		return result.Files[i].Path < result.Files[j].Path
+	})
+
+	result.Failures = []*ResultFailure{}
+	for path, err := range s.mediaUploadFailures {
+		result.Failures = append(result.Failures, &ResultFailure{Path: path, Error: err})
+	}
+	if report != nil {
+		for _, event := range report.FailedEvents() {
+			failure := &ResultFailure{Path: event.Path, EventID: event.EventID}
+			for _, relay := range event.Relays {
+				if relay.Status != RelayStatusOK {
+					failure.Relays = append(failure.Relays, relay)
+				}
+			}
+			result.Failures = append(result.Failures, failure)
+		}
+		if len(report.ConnectionErrors) > 0 {
+			result.ConnectionErrors = report.ConnectionErrors
+		}
+	}
+	sort.Slice(result.Failures, func(i, j int) bool {
+		return result.Failures[i].Path < result.Failures[j].Path
+	})
+}
+
+// Write はデプロイの結果をjsonで出力する
+func (r *Result) Write(w io.Writer, err error, exitCode int) error {
+	r.Success = err == nil
+	r.ExitCode = exitCode
+	if err != nil {
+		r.Error = err.Error()
+	}
+	if r.Relays == nil {
+		r.Relays = []string{}
+	}
+	if r.Files == nil {
+		r.Files = []*ResultFile{}
+	}
+	if r.Failures == nil {
+		r.Failures = []*ResultFailure{}
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
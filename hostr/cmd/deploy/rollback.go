@@ -0,0 +1,294 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/consts"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/relays"
+)
+
+// リレーからイベントを取得する際に待つ時間
+const rollbackQueryTimeout = 30 * time.Second
+
+// Replaceableなサイトを以前のバージョンに戻す。
+// toにはデプロイ履歴のバージョン番号、またはサイトのマニフェストイベントのID(hexまたはnevent)を指定する。
+// 空の場合は1つ前のバージョンに戻す
+func (d *Deployer) Rollback(htmlIdentifier, to string) (int, error) {
+	s, err := d.newState()
+	if err != nil {
+		fmt.Fprintln(d.logWriter(), "❌ Failed to prepare rollback:", err)
+		return 0, err
+	}
+	return s.rollback(htmlIdentifier, to)
+}
+
+func (s *deployState) rollback(htmlIdentifier, to string) (int, error) {
+	historyDir, err := getHistoryDirectory(s.pubKey, htmlIdentifier)
+	if err != nil {
+		fmt.Fprintln(s.log, "❌ Failed to get deploy history path:", err)
+		return 0, err
+	}
+	versions, err := loadDeployHistory(historyDir)
+	if err != nil {
+		fmt.Fprintln(s.log, "❌ Failed to load deploy history:", err)
+		return 0, err
+	}
+
+	// 戻す先のバージョンのファイル一覧を取得
+	targetVersion, files, err := s.findRollbackTarget(htmlIdentifier, versions, to)
+	if err != nil {
+		fmt.Fprintln(s.log, "❌ Failed to find version to roll back to:", err)
+		return 0, err
+	}
+	if targetVersion > 0 {
+		fmt.Fprintln(s.log, "⏪ Rolling back", htmlIdentifier, "to version", targetVersion)
+	} else {
+		fmt.Fprintln(s.log, "⏪ Rolling back", htmlIdentifier, "to site manifest", to)
+	}
+
+	// ローカルの履歴にないイベントはリレーから取得する
+	events := map[string]*nostr.Event{}
+	missingIDs := []string{}
+	for key, entry := range files {
+		if key == siteManifestKey || len(entry.EventID) < 1 {
+			continue
+		}
+		event, err := loadHistoryEvent(historyDir, entry.EventID)
+		if err != nil {
+			fmt.Fprintln(s.log, "❌ Failed to load event:", err)
+			return 0, err
+		}
+		if event == nil {
+			missingIDs = append(missingIDs, entry.EventID)
+			continue
+		}
+		events[event.ID] = event
+	}
+	for id, event := range s.fetchEventsByIDs(missingIDs) {
+		events[id] = event
+	}
+
+	// Replaceableなイベントは新しいcreated_atで署名し直し、それ以外はそのまま再送する
+	for key, entry := range files {
+		if key == siteManifestKey {
+			continue
+		}
+		if len(entry.EventID) < 1 {
+			// アップロードされたメディアはURLをそのまま使う
+			s.currentManifest.Files[key] = entry
+			continue
+		}
+
+		event, ok := events[entry.EventID]
+		if !ok {
+			err := fmt.Errorf("event %s of %s was not found in the deploy history or on relays", entry.EventID, key)
+			fmt.Fprintln(s.log, "❌ Failed to restore file:", err)
+			return 0, err
+		}
+
+		if !isAddressableKind(event.Kind) {
+			s.addNostrEventQueue(event, key)
+			s.currentManifest.Files[key] = entry
+			continue
+		}
+
+		resigned, err := s.getEvent(event.Content, event.Kind, event.Tags)
+		if err != nil {
+			fmt.Fprintln(s.log, "❌ Failed to sign event:", err)
+			return 0, err
+		}
+		s.addNostrEventQueue(resigned, key)
+		s.currentManifest.Files[key] = newEventManifestEntry(entry.Hash, resigned.ID, resigned.Kind, resigned.Tags)
+	}
+
+	// 戻す先のバージョンのルーティングを引き継ぐ
+	if entry, ok := files[siteManifestKey]; ok && len(entry.EventID) > 0 {
+		manifest, err := loadHistoryEvent(historyDir, entry.EventID)
+		if err != nil {
+			fmt.Fprintln(s.log, "❌ Failed to load event:", err)
+			return 0, err
+		}
+		if manifest == nil {
+			manifest = s.fetchEventsByIDs([]string{entry.EventID})[entry.EventID]
+		}
+		if manifest != nil {
+			s.siteRoutingTags = getRoutingTags(manifest)
+		}
+	}
+
+	// 戻したファイルを参照するマニフェストを生成
+	_, err = s.generateSiteManifestEvent(htmlIdentifier)
+	if err != nil {
+		fmt.Fprintln(s.log, "❌ Failed to get site manifest event:", err)
+		return 0, err
+	}
+
+	_, publishErr := s.publishEventsFromQueue()
+
+	// 次回のデプロイで差分を検出できるようにマニフェストを更新する
+	manifestFilePath, err := getManifestFilePath(s.pubKey, "", true, htmlIdentifier)
+	if err != nil {
+		fmt.Fprintln(s.log, "❌ Failed to get manifest path:", err)
+		return 0, err
+	}
+	if manifest, err := loadManifest(manifestFilePath); err == nil {
+		s.currentManifest.Uploader = manifest.Uploader
+	}
+	s.currentManifest.Relays = s.allRelays
+	err = saveManifest(manifestFilePath, s.currentManifest)
+	if err != nil {
+		fmt.Fprintln(s.log, "❌ Failed to save manifest:", err)
+		return 0, err
+	}
+
+	if publishErr != nil {
+		fmt.Fprintln(s.log, "❌ Failed to publish:", publishErr)
+		return 0, publishErr
+	}
+
+	// ロールバックする前の最新のバージョンを、取り消したバージョンとして記録する
+	rolledBackFrom := 0
+	if len(versions) > 0 {
+		rolledBackFrom = versions[len(versions)-1].Version
+	}
+	version, err := s.saveDeployHistory(htmlIdentifier, rolledBackFrom, targetVersion)
+	if err != nil {
+		fmt.Fprintln(s.log, "❌ Failed to save deploy history:", err)
+		return 0, err
+	}
+
+	return version.Version, nil
+}
+
+// デプロイ履歴またはリレーから戻す先のバージョンとファイル一覧を取得する
+func (s *deployState) findRollbackTarget(htmlIdentifier string, versions []*DeployVersion, to string) (int, map[string]*ManifestEntry, error) {
+	// 指定がない場合は1つ前のバージョン
+	if len(to) < 1 {
+		version := findPreviousVersion(versions)
+		if version == nil {
+			return 0, nil, fmt.Errorf("no previous version of %s in the deploy history", htmlIdentifier)
+		}
+		return version.Version, version.Files, nil
+	}
+
+	// バージョン番号
+	if number, err := strconv.Atoi(to); err == nil {
+		for _, version := range versions {
+			if version.Version == number {
+				return version.Version, version.Files, nil
+			}
+		}
+		return 0, nil, fmt.Errorf("version %d is not in the deploy history", number)
+	}
+
+	// サイトのマニフェストイベントのID
+	manifestEventID := to
+	if strings.HasPrefix(to, "nevent") {
+		_, data, err := nip19.Decode(to)
+		if err != nil {
+			return 0, nil, err
+		}
+		pointer, ok := data.(nostr.EventPointer)
+		if !ok {
+			return 0, nil, fmt.Errorf("failed to decode nevent")
+		}
+		manifestEventID = pointer.ID
+	}
+	for _, version := range versions {
+		if version.SiteManifestEventID == manifestEventID {
+			return version.Version, version.Files, nil
+		}
+	}
+
+	// 履歴にない場合は古いイベントを保持しているリレーから取得する
+	manifest, ok := s.fetchEventsByIDs([]string{manifestEventID})[manifestEventID]
+	if !ok || manifest.Kind != consts.KindWebhostSiteManifest {
+		return 0, nil, fmt.Errorf("site manifest %s was not found in the deploy history or on relays", manifestEventID)
+	}
+	if dTag := manifest.Tags.GetFirst([]string{"d", ""}); dTag == nil || dTag.Value() != htmlIdentifier {
+		return 0, nil, fmt.Errorf("site manifest %s does not belong to %s", manifestEventID, htmlIdentifier)
+	}
+
+	files := map[string]*ManifestEntry{}
+	for _, tag := range manifest.Tags.GetAll([]string{"file"}) {
+		if len(tag) < 4 {
+			continue
+		}
+		entry := &ManifestEntry{EventID: tag[2], Hash: tag[3]}
+		if len(tag) > 4 {
+			entry.EventID = ""
+			entry.URL = tag[4]
+		}
+		files[tag[1]] = entry
+	}
+	files[siteManifestKey] = &ManifestEntry{EventID: manifest.ID}
+
+	return 0, files, nil
+}
+
+// 署名者の公開鍵で署名されたイベントをIDで取得する
+// 署名者はNIP-42のAUTHを要求するリレーへの応答にも使う
+func (s *deployState) fetchEventsByIDs(ids []string) map[string]*nostr.Event {
+	events := map[string]*nostr.Event{}
+	if len(ids) < 1 {
+		return events
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rollbackQueryTimeout)
+	defer cancel()
+
+	pool := relays.NewPool(ctx, s.signer)
+	defer pool.Close()
+	for event := range pool.SubManyEose(ctx, s.allRelays, nostr.Filters{{
+		IDs:     ids,
+		Authors: []string{s.pubKey},
+	}}) {
+		// 再署名するので改ざんされていないことを確認する
+		if ok, err := event.CheckSignature(); err != nil || !ok {
+			continue
+		}
+		events[event.ID] = event
+	}
+
+	return events
+}
+
+// NIP-33のParameterized Replaceableなkindかどうか
+func isAddressableKind(kind int) bool {
+	return kind >= 30000 && kind < 40000
+}
+
+// 最新のバージョンの1つ前のバージョンを返す。ロールバックで取り消されたバージョンは飛ばす。
+// 最新のバージョンがロールバックで戻したものの場合は、戻した先のバージョンの1つ前を返すので、
+// 続けてロールバックすると取り消したバージョンに戻らず、さらに古いバージョンに戻る
+func findPreviousVersion(versions []*DeployVersion) *DeployVersion {
+	indexes := map[int]int{}
+	rolledBack := map[int]bool{}
+	for i, version := range versions {
+		indexes[version.Version] = i
+		if version.RolledBackFrom > 0 {
+			rolledBack[version.RolledBackFrom] = true
+		}
+	}
+
+	i := len(versions) - 1
+	for i >= 0 {
+		if restored, ok := indexes[versions[i].RestoredVersion]; ok && versions[i].RestoredVersion > 0 && restored < i {
+			i = restored
+			continue
+		}
+		for j := i - 1; j >= 0; j-- {
+			if !rolledBack[versions[j].Version] {
+				return versions[j]
+			}
+		}
+		break
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package deploy
+
+import "testing"
+
+func TestFindPreviousVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		versions []*DeployVersion
+		want     int
+	}{
+		{"no history", []*DeployVersion{}, 0},
+		{"single version", []*DeployVersion{{Version: 1}}, 0},
+		{"previous deploy", []*DeployVersion{{Version: 1}, {Version: 2}, {Version: 3}}, 2},
+		// 2回続けてロールバックしても、取り消したバージョン3には戻らない
+		{"after a rollback", []*DeployVersion{
+			{Version: 1},
+			{Version: 2},
+			{Version: 3},
+			{Version: 4, RolledBackFrom: 3, RestoredVersion: 2},
+		}, 1},
+		{"back to the first version", []*DeployVersion{
+			{Version: 1},
+			{Version: 2},
+			{Version: 3, RolledBackFrom: 2, RestoredVersion: 1},
+		}, 0},
+		// ロールバックの後のデプロイからは、ロールバックしたバージョンに戻る
+		{"deploy after a rollback", []*DeployVersion{
+			{Version: 1},
+			{Version: 2},
+			{Version: 3, RolledBackFrom: 2, RestoredVersion: 1},
+			{Version: 4},
+		}, 3},
+		// 履歴にないマニフェストに戻した後は、取り消したバージョンを飛ばす
+		{"rollback to a manifest outside the history", []*DeployVersion{
+			{Version: 1},
+			{Version: 2},
+			{Version: 3, RolledBackFrom: 2},
+		}, 1},
+	}
+
+	for _, test := range tests {
+		got := 0
+		if version := findPreviousVersion(test.versions); version != nil {
+			got = version.Version
+		}
+		if got != test.want {
+			t.Errorf("%s: findPreviousVersion() = %d, want %d", test.name, got, test.want)
+		}
+	}
+}
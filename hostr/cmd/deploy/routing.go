@@ -0,0 +1,117 @@
+package deploy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"slices"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/tools"
+)
+
+// SPAモードで一致するファイルがないパスに返すページ
+const spaFallbackPath = "index.html"
+
+// _redirectsで指定できるステータスコード。200はURLを変えずに別のファイルを返す
+var redirectStatuses = []string{"200", "301", "302", "303", "307", "308", "404"}
+
+// SPAモードと_redirectsからルーティングのタグを生成する。
+// タグは ["fallback", パス] と ["redirect", 転送元, 転送先, ステータスコード] の形式。
+// ステータスコードの末尾の!は、一致するファイルがあってもルールを優先することを表す
+func generateRoutingTags(fsys fs.FS, spa bool) (nostr.Tags, error) {
+	tags := nostr.Tags{}
+
+	redirects, err := parseRedirectsFile(fsys, tools.RedirectsFileName)
+	if err != nil {
+		return nil, err
+	}
+	tags = append(tags, redirects...)
+
+	if spa {
+		tags = append(tags, nostr.Tag{"fallback", spaFallbackPath})
+	}
+
+	return tags, nil
+}
+
+// Netlify形式の_redirectsを読み込む。存在しない場合は空のタグを返す
+// 1行に `転送元 転送先 [ステータスコード][!]` を記述し、転送元には:placeholderと末尾の*を使える
+func parseRedirectsFile(fsys fs.FS, filePath string) (nostr.Tags, error) {
+	tags := nostr.Tags{}
+
+	file, err := fsys.Open(filePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return tags, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) < 1 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		tag, err := parseRedirectRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", tools.RedirectsFileName, lineNumber, err)
+		}
+		tags = append(tags, tag)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return tags, nil
+}
+
+func parseRedirectRule(line string) (nostr.Tag, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		return nil, fmt.Errorf("expected 'from to [status]' but got %q", line)
+	}
+
+	from, to, status := fields[0], fields[1], "301"
+	if len(fields) > 2 {
+		status = fields[2]
+	}
+
+	if !strings.HasPrefix(from, "/") {
+		return nil, fmt.Errorf("source %q must start with /", from)
+	}
+	if index := strings.Index(from, "*"); index >= 0 && index != len(from)-1 {
+		return nil, fmt.Errorf("source %q may only contain * at the end", from)
+	}
+
+	external := strings.HasPrefix(to, "http://") || strings.HasPrefix(to, "https://")
+	if !strings.HasPrefix(to, "/") && !external {
+		return nil, fmt.Errorf("destination %q must start with / or be an absolute URL", to)
+	}
+
+	code := strings.TrimSuffix(status, "!")
+	if !slices.Contains(redirectStatuses, code) {
+		return nil, fmt.Errorf("unsupported status %q", status)
+	}
+	// リレー上のファイルしか返せないので外部URLのプロキシはできない
+	if external && (code == "200" || code == "404") {
+		return nil, fmt.Errorf("status %s cannot be used with the external destination %q", code, to)
+	}
+
+	return nostr.Tag{"redirect", from, to, status}, nil
+}
+
+// サイトのマニフェストイベントからルーティングのタグを取得する
+func getRoutingTags(manifest *nostr.Event) nostr.Tags {
+	tags := nostr.Tags{}
+	for _, tag := range manifest.Tags {
+		if len(tag) > 0 && (tag[0] == "redirect" || tag[0] == "fallback") {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
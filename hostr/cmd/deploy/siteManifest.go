@@ -0,0 +1,107 @@
+package deploy
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/consts"
+)
+
+// ローカルのマニフェストでサイトのマニフェストイベントを記録するキー
+const siteManifestKey = "#site-manifest"
+
+// デプロイしたすべてのファイルを記録したサイトのマニフェストイベントを生成する。
+// タグは ["file", パス, event id, ハッシュ, メディアのURL] の形式で、その後にルーティングのタグが続く
+func (s *deployState) generateSiteManifestEvent(indexHtmlIdentifier string) (string, error) {
+	paths := []string{}
+	for path := range s.currentManifest.Files {
+		// チャンクはインデックスのイベントから辿れるので含めない
+		if strings.Contains(path, "#") {
+			continue
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	tags := nostr.Tags{nostr.Tag{"d", indexHtmlIdentifier}}
+	for _, path := range paths {
+		entry := s.currentManifest.Files[path]
+		tag := nostr.Tag{"file", path, entry.EventID, entry.Hash}
+		if len(entry.URL) > 0 {
+			tag = append(tag, entry.URL)
+		}
+		tags = append(tags, tag)
+	}
+	// SPAモードと_redirectsのルールはhostr startが参照する
+	tags = append(tags, s.siteRoutingTags...)
+
+	if err := s.checkSiteManifestLimits(tags); err != nil {
+		return "", err
+	}
+
+	kind := consts.KindWebhostSiteManifest
+	key := siteManifestKey
+	hash := hashEventPayload(kind, tags, "")
+
+	// どのファイルにも変更がなければ前回のマニフェストを再利用する
+	if eventID, ok := s.findUnchangedEventID(key, hash); ok {
+		s.currentManifest.Files[key] = newEventManifestEntry(hash, eventID, kind, tags)
+		s.addEventPlanEntry(key, PlanActionSkip, kind, tags, 0, "", eventID)
+		fmt.Fprintln(s.log, "Skipped unchanged site manifest")
+		return eventID, nil
+	}
+
+	event, err := s.getEvent("", kind, tags)
+	if err != nil {
+		return "", err
+	}
+
+	s.siteManifestEvent = event
+	s.currentManifest.Files[key] = newEventManifestEntry(hash, event.ID, kind, tags)
+	s.addEventPlanEntry(key, PlanActionPublish, kind, tags, 0, "", event.ID)
+	fmt.Fprintln(s.log, "Added site manifest event to publish queue")
+
+	return event.ID, nil
+}
+
+// サイトのマニフェストはファイルごとにタグを持つので、リレーが公開している上限に収まるか確認する
+func (s *deployState) checkSiteManifestLimits(tags nostr.Tags) error {
+	limits := s.getCachedRelayLimits()
+
+	if limits.maxEventTags > 0 && len(tags) > limits.maxEventTags {
+		return fmt.Errorf("the site manifest has %d tags, but a relay accepts at most %d. Reduce the number of files or use other relays", len(tags), limits.maxEventTags)
+	}
+
+	if limits.maxMessageLength > 0 {
+		size, err := estimateEventSize(tags, "")
+		if err != nil {
+			return err
+		}
+		if size > limits.maxMessageLength {
+			return fmt.Errorf("the site manifest is about %d bytes, but a relay accepts messages of at most %d bytes. Reduce the number of files or use other relays", size, limits.maxMessageLength)
+		}
+	}
+
+	return nil
+}
+
+// 署名したイベントをリレーに送るメッセージの長さを見積もる
+func estimateEventSize(tags nostr.Tags, content string) (int, error) {
+	ev := nostr.Event{
+		ID:        strings.Repeat("0", 64),
+		PubKey:    strings.Repeat("0", 64),
+		CreatedAt: nostr.Now(),
+		Tags:      tags,
+		Content:   content,
+		Sig:       strings.Repeat("0", 128),
+	}
+	encoded, err := json.Marshal(ev)
+	if err != nil {
+		return 0, err
+	}
+	// ["EVENT",...]の分
+	return len(encoded) + len(`["EVENT",]`), nil
+}
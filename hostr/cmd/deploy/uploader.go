@@ -0,0 +1,56 @@
+package deploy
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/keystore"
+)
+
+const (
+	UploaderNostrCheck = "nostrcheck"
+	UploaderBlossom    = "blossom"
+	UploaderNIP96      = "nip96"
+)
+
+// Uploader はメディアファイルのアップロード先
+type Uploader interface {
+	// Name はマニフェストに記録するアップロード先の名前を返す
+	Name() string
+	// Upload はファイルをアップロードし、公開URLを返す。filePathはサイトルートからの相対パス
+	Upload(filePath, contentType string, content []byte, hash string) (string, error)
+}
+
+// Deleter はアップロードしたメディアを削除できるUploader
+type Deleter interface {
+	// Delete はUploadで返されたURLとファイルのハッシュからメディアを削除する
+	Delete(url, hash string) error
+}
+
+// マニフェストに記録されたアップロード先の名前からUploaderを生成する
+func newUploaderFromName(name string, signer keystore.Signer, pubKey string, log io.Writer) (Uploader, error) {
+	uploaderName, server, _ := strings.Cut(name, ":")
+	return NewUploader(uploaderName, server, signer, pubKey, log)
+}
+
+// NewUploader は名前(nostrcheck, blossom, nip96)とサーバーからUploaderを生成する。
+// logにはサーバーがメディアを変換した場合などの警告を出力する。nilの場合は出力しない
+func NewUploader(name, server string, signer keystore.Signer, pubKey string, log io.Writer) (Uploader, error) {
+	switch name {
+	case "", UploaderNostrCheck:
+		return &nostrCheckUploader{signer: signer, pubKey: pubKey}, nil
+	case UploaderBlossom:
+		if len(server) < 1 {
+			return nil, fmt.Errorf("Upload server is required for %s", name)
+		}
+		return newBlossomUploader(server, signer, pubKey), nil
+	case UploaderNIP96:
+		if len(server) < 1 {
+			return nil, fmt.Errorf("Upload server is required for %s", name)
+		}
+		return newNIP96Uploader(server, signer, pubKey, log), nil
+	default:
+		return nil, fmt.Errorf("Invalid uploader: %s", name)
+	}
+}
@@ -0,0 +1,257 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/relays"
+)
+
+const (
+	VerifyStatusOK      = "ok"
+	VerifyStatusMissing = "missing"
+	VerifyStatusStale   = "stale"
+	VerifyStatusInvalid = "invalid"
+	VerifyStatusError   = "error"
+)
+
+// ErrVerificationFailed はリレーに保存されたイベントが今回のデプロイと一致しない場合のエラー
+var ErrVerificationFailed = errors.New("some relays do not hold the deployed events")
+
+// 1回のクエリで問い合わせるイベントの数
+const verifyBatchSize = 50
+
+const verifyQueryTimeout = 30 * time.Second
+
+// VerifyResult は1つのリレーに保存された1つのファイルの検証結果
+type VerifyResult struct {
+	Path    string `json:"path"`
+	Relay   string `json:"relay"`
+	EventID string `json:"eventId"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// VerifyReport はデプロイ全体の検証結果
+type VerifyReport struct {
+	Results []*VerifyResult `json:"results"`
+	// 検証したリレー
+	relays []string
+	mutex  sync.Mutex
+}
+
+func (r *VerifyReport) add(result *VerifyResult) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.Results = append(r.Results, result)
+}
+
+// OKでない検証結果を返す
+func (r *VerifyReport) Problems() []*VerifyResult {
+	problems := []*VerifyResult{}
+	for _, result := range r.Results {
+		if result.Status != VerifyStatusOK {
+			problems = append(problems, result)
+		}
+	}
+	return problems
+}
+
+// Verify はローカルのマニフェストに記録されたReplaceableなサイトのイベントをすべてのリレーから読み出して検証する
+func (d *Deployer) Verify(htmlIdentifier string) (*VerifyReport, error) {
+	s, err := d.newState()
+	if err != nil {
+		fmt.Fprintln(d.logWriter(), "❌ Failed to prepare verify:", err)
+		return nil, err
+	}
+
+	manifestFilePath, err := getManifestFilePath(s.pubKey, "", true, htmlIdentifier)
+	if err != nil {
+		fmt.Fprintln(s.log, "❌ Failed to get manifest path:", err)
+		return nil, err
+	}
+	manifest, err := loadManifest(manifestFilePath)
+	if err != nil {
+		fmt.Fprintln(s.log, "❌ Failed to load manifest:", err)
+		return nil, err
+	}
+	if len(manifest.Files) < 1 {
+		err := fmt.Errorf("no deploy of %s is recorded on this machine", htmlIdentifier)
+		fmt.Fprintln(s.log, "❌ Failed to verify:", err)
+		return nil, err
+	}
+
+	return s.verifyManifest(manifest)
+}
+
+// マニフェストのイベントを各リレーから取得し、署名とcontentのハッシュを検証する
+func (s *deployState) verifyManifest(manifest *Manifest) (*VerifyReport, error) {
+	fmt.Fprintln(s.log, "🔍 Verifying...")
+
+	entries := map[string]*ManifestEntry{}
+	for key, entry := range manifest.Files {
+		// アップロードされたメディアはイベントではないので対象外
+		if len(entry.EventID) > 0 {
+			entries[key] = entry
+		}
+	}
+
+	report := &VerifyReport{Results: []*VerifyResult{}, relays: s.allRelays}
+
+	var wg sync.WaitGroup
+	for _, url := range s.allRelays {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			for _, result := range s.verifyRelay(url, entries) {
+				report.add(result)
+			}
+		}(url)
+	}
+	wg.Wait()
+
+	report.Write(s.log)
+
+	if problems := report.Problems(); len(problems) > 0 {
+		return report, fmt.Errorf("%w: %d problems found", ErrVerificationFailed, len(problems))
+	}
+	return report, nil
+}
+
+// 1つのリレーについてすべてのファイルを検証する
+func (s *deployState) verifyRelay(url string, entries map[string]*ManifestEntry) []*VerifyResult {
+	results := []*VerifyResult{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), verifyQueryTimeout)
+	defer cancel()
+
+	relay, err := relays.Connect(ctx, url, s.signer, relays.AuthWaitTimeout)
+	if err != nil {
+		return append(results, &VerifyResult{Path: "*", Relay: url, Status: VerifyStatusError, Message: err.Error()})
+	}
+	defer relay.Close()
+
+	ids := []string{}
+	for _, entry := range entries {
+		ids = append(ids, entry.EventID)
+	}
+	found := map[string]*nostr.Event{}
+	for start := 0; start < len(ids); start += verifyBatchSize {
+		batch := ids[start:min(start+verifyBatchSize, len(ids))]
+		events, err := relay.QuerySync(ctx, nostr.Filter{IDs: batch, Authors: []string{s.pubKey}, Limit: len(batch)})
+		if err != nil {
+			continue
+		}
+		for _, event := range events {
+			found[event.ID] = event
+		}
+	}
+
+	// 見つからなかったReplaceableなイベントはdタグで取得して古いバージョンが残っていないか確認する
+	latestByDTag := map[string]*nostr.Event{}
+	for key, entry := range entries {
+		if _, ok := found[entry.EventID]; ok || len(entry.DTag) < 1 {
+			continue
+		}
+		events, err := relay.QuerySync(ctx, nostr.Filter{
+			Kinds:   []int{entry.Kind},
+			Authors: []string{s.pubKey},
+			Tags:    nostr.TagMap{"d": []string{entry.DTag}},
+			Limit:   1,
+		})
+		if err == nil && len(events) > 0 {
+			latestByDTag[key] = events[0]
+		}
+	}
+
+	for key, entry := range entries {
+		result := &VerifyResult{Path: key, Relay: url, EventID: entry.EventID, Status: VerifyStatusOK}
+
+		event, ok := found[entry.EventID]
+		if !ok {
+			result.Status = VerifyStatusMissing
+			if latest, ok := latestByDTag[key]; ok {
+				result.Status = VerifyStatusStale
+				result.Message = fmt.Sprintf("relay holds %s created at %s", latest.ID, latest.CreatedAt.Time().Format(time.RFC3339))
+			}
+		} else if ok, err := event.CheckSignature(); err != nil || !ok {
+			result.Status = VerifyStatusInvalid
+			result.Message = "invalid signature"
+		} else if hashEventPayload(event.Kind, event.Tags, event.Content) != entry.Hash {
+			result.Status = VerifyStatusInvalid
+			result.Message = "content hash mismatch"
+		}
+
+		results = append(results, result)
+	}
+
+	return results
+}
+
+// リレーごとの集計と問題のあるファイルの一覧を表形式で出力する
+func (r *VerifyReport) Write(w io.Writer) {
+	type relaySummary struct {
+		ok, missing, stale, invalid, failed int
+	}
+	summaries := map[string]*relaySummary{}
+	for _, url := range r.relays {
+		summaries[url] = &relaySummary{}
+	}
+	for _, result := range r.Results {
+		summary := summaries[result.Relay]
+		switch result.Status {
+		case VerifyStatusOK:
+			summary.ok++
+		case VerifyStatusMissing:
+			summary.missing++
+		case VerifyStatusStale:
+			summary.stale++
+		case VerifyStatusInvalid:
+			summary.invalid++
+		default:
+			summary.failed++
+		}
+	}
+
+	urls := []string{}
+	for url := range summaries {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+
+	fmt.Fprintln(w, "")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "RELAY\tOK\tMISSING\tSTALE\tINVALID\tERROR")
+	for _, url := range urls {
+		summary := summaries[url]
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\n", url, summary.ok, summary.missing, summary.stale, summary.invalid, summary.failed)
+	}
+	tw.Flush()
+
+	problems := r.Problems()
+	if len(problems) < 1 {
+		return
+	}
+
+	sort.Slice(problems, func(i, j int) bool {
+		if problems[i].Path == problems[j].Path {
+			return problems[i].Relay < problems[j].Relay
+		}
+		return problems[i].Path < problems[j].Path
+	})
+
+	fmt.Fprintln(w, "")
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PATH\tRELAY\tSTATUS\tMESSAGE")
+	for _, result := range problems {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", result.Path, result.Relay, result.Status, result.Message)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,94 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"maps"
+	"time"
+
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/tools"
+)
+
+// Watchがサイトの変更を確認する間隔
+const WatchInterval = 500 * time.Millisecond
+
+// 変更を検出するためのファイルのサイズと更新日時
+type fileStamp struct {
+	size    int64
+	modTime int64
+}
+
+// Watch はサイトをデプロイした後、ctxがキャンセルされるまでサイトの変更を監視し、変更があるたびにデプロイし直す。
+// 変更されていないファイルはマニフェストによってスキップされるので、変更されたファイルと参照先が変わったHTMLだけがpublishされる。
+// ビルドツールが続けてファイルを書き込む間は待ち、変更がWatchIntervalの間止まってからデプロイする。
+// onDeployはデプロイのたびに結果を受け取る。デプロイに失敗しても監視は続ける
+func (d *Deployer) Watch(ctx context.Context, basePath string, replaceable bool, htmlIdentifier string, onDeploy func(*Result, error)) error {
+	// Forceは最初のデプロイだけに適用し、以降は差分だけをpublishする
+	deployer := *d
+
+	lastStamps, _ := deployer.snapshotSite(basePath)
+	result, err := deployer.Deploy(basePath, replaceable, htmlIdentifier)
+	if onDeploy != nil {
+		onDeploy(result, err)
+	}
+	deployer.Options.Force = false
+
+	fmt.Fprintln(deployer.logWriter(), "👀 Watching for changes. Press Ctrl+C to stop.")
+
+	ticker := time.NewTicker(WatchInterval)
+	defer ticker.Stop()
+
+	changed := false
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		// 削除されたディレクトリなどで読み込めない場合も変更として扱い、デプロイでエラーを報告する
+		stamps, _ := deployer.snapshotSite(basePath)
+		if !maps.Equal(stamps, lastStamps) {
+			lastStamps = stamps
+			changed = true
+			continue
+		}
+		if !changed {
+			continue
+		}
+		changed = false
+
+		fmt.Fprintln(deployer.logWriter(), "🔁 Change detected, redeploying...")
+		result, err := deployer.Deploy(basePath, replaceable, htmlIdentifier)
+		if onDeploy != nil {
+			onDeploy(result, err)
+		}
+	}
+}
+
+// デプロイ対象のファイルと除外パターンのファイルのサイズと更新日時を取得する
+func (d *Deployer) snapshotSite(basePath string) (map[string]fileStamp, error) {
+	files, err := d.loadSiteFiles(basePath)
+	if err != nil {
+		return nil, err
+	}
+
+	stamps := map[string]fileStamp{}
+	addStamp := func(filePath string) {
+		info, err := fs.Stat(files.FS(), filePath)
+		if err != nil {
+			return
+		}
+		stamps[filePath] = fileStamp{size: info.Size(), modTime: info.ModTime().UnixNano()}
+	}
+
+	err = files.Walk(addStamp, func(tools.IgnoredFile) {})
+	if err != nil {
+		return nil, err
+	}
+	addStamp(tools.HostrIgnoreFileName)
+	addStamp(tools.GitIgnoreFileName)
+
+	return stamps, nil
+}
@@ -1,40 +1,92 @@
 package keystore
 
 import (
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/nbd-wtf/go-nostr/nip19"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/nip49"
 	"github.com/studiokaiji/nostr-webhost/hostr/cmd/paths"
 )
 
+// NIP-49のncryptsecで暗号化した秘密鍵を保存するファイル
 const PATH = ".nostr_account_secret"
 
+// パスフレーズなしで公開鍵を表示できるよう、秘密鍵と一緒に保存する公開鍵
+const PUBLIC_PATH = ".nostr_account_public"
+
+// CIなどで保存した鍵の代わりに使う秘密鍵(nsec, hexまたはncryptsec)を渡す環境変数
+const SECRET_KEY_ENV = "HOSTR_SECRET_KEY"
+
+// 1回の実行で何度もパスフレーズを入力しなくてよいよう、復号した秘密鍵をファイルのパスごとに保持する
+var cachedSecrets = map[string]string{}
+
 func SetSecret(key string) error {
-	// nsecから始まる場合はデコードする
-	if key[0:4] == "nsec" {
-		_, v, err := nip19.Decode(key)
-		if err != nil {
-			panic(err)
-		}
-		key = v.(string)
+	key, err := DecodeSecretKey(key)
+	if err != nil {
+		return err
 	}
 
-	dir, err := paths.GetSettingsDirectory()
+	passphrase, err := readNewPassphrase()
+	if err != nil {
+		return err
+	}
+	ncryptsec, err := nip49.Encrypt(key, passphrase, nip49.DefaultLogN, nip49.KeySecurityUnknown)
 	if err != nil {
 		return err
 	}
 
-	filePath := filepath.Join(dir, PATH)
+	err = writeSecret(ncryptsec, key)
 	if err != nil {
 		return err
 	}
 
-	// キーをファイルに書き込み
-	return os.WriteFile(filePath, []byte(key), 0644)
+	// 秘密鍵を設定した場合はリモートの署名者を使わない
+	return RemoveBunker()
+}
+
+// ImportSecret はncryptsecをパスフレーズで復号できることを確認してから、そのまま保存する
+func ImportSecret(ncryptsec string) error {
+	if !nip49.IsNcryptsec(ncryptsec) {
+		return errors.New("Please specify a ncryptsec. Use set-private for nsec or hex keys")
+	}
+
+	passphrase, err := readPassphrase("🔑 Passphrase of the ncryptsec: ")
+	if err != nil {
+		return err
+	}
+	key, _, err := nip49.Decrypt(ncryptsec, passphrase)
+	if err != nil {
+		return err
+	}
+
+	err = writeSecret(ncryptsec, key)
+	if err != nil {
+		return err
+	}
+	return RemoveBunker()
+}
+
+// ExportSecret は保存している秘密鍵をncryptsecで返す
+func ExportSecret() (string, error) {
+	// 平文で保存されている場合は先に暗号化する
+	if _, err := GetSecret(); err != nil {
+		return "", err
+	}
+
+	content, err := readSecretFile()
+	if err != nil {
+		return "", err
+	}
+	if !nip49.IsNcryptsec(content) {
+		return "", errors.New("Secret key is not encrypted yet. Please set " + PASSPHRASE_ENV + " or run in a terminal")
+	}
+	return content, nil
 }
 
 func ShowPublic() (string, string, error) {
@@ -48,6 +100,31 @@ func ShowPublic() (string, string, error) {
 }
 
 func GetPublic() (string, error) {
+	if secret, ok, err := getSecretFromEnv(); ok || err != nil {
+		if err != nil {
+			return "", err
+		}
+		return nostr.GetPublicKey(secret)
+	}
+
+	// リモートの署名者を使う場合は接続せずに保存した公開鍵を返す
+	config, err := loadBunkerConfig()
+	if err != nil {
+		return "", err
+	}
+	if config != nil {
+		return config.PubKey, nil
+	}
+
+	// 秘密鍵と一緒に保存した公開鍵があれば復号せずに返す
+	public, err := readPublicFile()
+	if err != nil {
+		return "", err
+	}
+	if len(public) > 0 {
+		return public, nil
+	}
+
 	secret, err := GetSecret()
 	if err != nil {
 		return "", err
@@ -56,13 +133,176 @@ func GetPublic() (string, error) {
 	return hex, err
 }
 
+// PeekPublic はパスフレーズを入力せずにわかる場合のみ公開鍵を返す。わからない場合は空文字を返す
+func PeekPublic() (string, error) {
+	if _, ok := os.LookupEnv(SECRET_KEY_ENV); ok {
+		return "", nil
+	}
+	config, err := loadBunkerConfig()
+	if err != nil {
+		return "", err
+	}
+	if config != nil {
+		return config.PubKey, nil
+	}
+	return readPublicFile()
+}
+
 func GetSecret() (string, error) {
-	dir, err := paths.GetSettingsDirectory()
+	if secret, ok, err := getSecretFromEnv(); ok || err != nil {
+		return secret, err
+	}
+
+	filePath, err := getSecretPath()
+	if err != nil {
+		return "", err
+	}
+	if secret, ok := cachedSecrets[filePath]; ok {
+		return secret, nil
+	}
+
+	content, err := readSecretFile()
+	if err != nil {
+		return "", err
+	}
+
+	if !nip49.IsNcryptsec(content) {
+		return migrateSecret(content)
+	}
+
+	passphrase, err := readPassphrase("🔑 Passphrase for the secret key: ")
 	if err != nil {
 		return "", err
 	}
+	secret, _, err := nip49.Decrypt(content, passphrase)
+	if err != nil {
+		return "", err
+	}
+
+	cachedSecrets[filePath] = secret
+	return secret, nil
+}
+
+// 以前のバージョンで平文で保存された秘密鍵をncryptsecで暗号化して保存し直す
+func migrateSecret(secret string) (string, error) {
+	passphrase, err := readNewPassphrase()
+	if err != nil {
+		// パスフレーズを入力できない環境では、平文のまま本人以外が読めないようにだけする
+		fmt.Fprintln(os.Stderr, "⚠️  Secret key is stored in plaintext:", err)
+		filePath, pathErr := getSecretPath()
+		if pathErr == nil {
+			os.Chmod(filePath, 0600)
+			cachedSecrets[filePath] = secret
+		}
+		return secret, nil
+	}
+
+	// 平文で保存されていたので安全でない扱いをされた鍵として記録する
+	ncryptsec, err := nip49.Encrypt(secret, passphrase, nip49.DefaultLogN, nip49.KeySecurityInsecure)
+	if err != nil {
+		return "", err
+	}
+	err = writeSecret(ncryptsec, secret)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintln(os.Stderr, "🔐 Encrypted the stored secret key with NIP-49")
+
+	return secret, nil
+}
+
+// ncryptsecと公開鍵をファイルに書き込む
+func writeSecret(ncryptsec, secret string) error {
+	pubKey, err := nostr.GetPublicKey(secret)
+	if err != nil {
+		return err
+	}
+
+	filePath, err := getSecretPath()
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(filePath, []byte(ncryptsec), 0600)
+	if err != nil {
+		return err
+	}
+	// 既存のファイルはWriteFileでパーミッションが変わらないので明示的に変更する
+	err = os.Chmod(filePath, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(filepath.Join(filepath.Dir(filePath), PUBLIC_PATH), []byte(pubKey), 0644)
+	if err != nil {
+		return err
+	}
+
+	cachedSecrets[filePath] = secret
+	return nil
+}
 
-	filePath := filepath.Join(dir, PATH)
+// 環境変数で渡された秘密鍵を返す。設定されていない場合はfalseを返す
+func getSecretFromEnv() (string, bool, error) {
+	key := strings.TrimSpace(os.Getenv(SECRET_KEY_ENV))
+	if len(key) < 1 {
+		return "", false, nil
+	}
+	if secret, ok := cachedSecrets[SECRET_KEY_ENV]; ok {
+		return secret, true, nil
+	}
+
+	var secret string
+	var err error
+	if nip49.IsNcryptsec(key) {
+		var passphrase string
+		passphrase, err = readPassphrase("🔑 Passphrase for " + SECRET_KEY_ENV + ": ")
+		if err != nil {
+			return "", true, err
+		}
+		secret, _, err = nip49.Decrypt(key, passphrase)
+	} else {
+		secret, err = DecodeSecretKey(key)
+	}
+	if err != nil {
+		return "", true, fmt.Errorf("%s: %w", SECRET_KEY_ENV, err)
+	}
+
+	cachedSecrets[SECRET_KEY_ENV] = secret
+	return secret, true, nil
+}
+
+// DecodeSecretKey はnsecまたはhexの秘密鍵をhexにする。64文字のhexでない場合はエラーを返す
+func DecodeSecretKey(key string) (string, error) {
+	// nsecから始まる場合はデコードする
+	if strings.HasPrefix(key, "nsec") {
+		_, v, err := nip19.Decode(key)
+		if err != nil {
+			return "", err
+		}
+		key = v.(string)
+	}
+	if decoded, err := hex.DecodeString(key); err != nil || len(decoded) != 32 {
+		return "", errors.New("Invalid secret key. Please specify a nsec or hex private key")
+	}
+	return key, nil
+}
+
+func readPublicFile() (string, error) {
+	dir, err := paths.GetProfileDirectory()
+	if err != nil {
+		return "", err
+	}
+	public, err := os.ReadFile(filepath.Join(dir, PUBLIC_PATH))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(public)), nil
+}
+
+func readSecretFile() (string, error) {
+	filePath, err := getSecretPath()
 	if err != nil {
 		return "", err
 	}
@@ -71,5 +311,13 @@ func GetSecret() (string, error) {
 	if err != nil {
 		return "", errors.New("Could not read secret")
 	}
-	return string(secretBytes), nil
+	return strings.TrimSpace(string(secretBytes)), nil
+}
+
+func getSecretPath() (string, error) {
+	dir, err := paths.GetProfileDirectory()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, PATH), nil
 }
@@ -0,0 +1,71 @@
+package keystore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/term"
+)
+
+// CIなど対話的に入力できない環境でパスフレーズを渡す環境変数
+const PASSPHRASE_ENV = "HOSTR_PASSPHRASE"
+
+// falseの場合はターミナルでもパスフレーズの入力を求めない
+var interactive = true
+
+// SetInteractive はCIなどでパスフレーズの入力を求めないようにする
+func SetInteractive(enabled bool) {
+	interactive = enabled
+}
+
+var errNoPassphrase = errors.New("Passphrase is required. Please run in a terminal or set " + PASSPHRASE_ENV)
+
+// 秘密鍵を復号するためのパスフレーズを環境変数、またはターミナルから読み込む
+func readPassphrase(prompt string) (string, error) {
+	if passphrase, ok := os.LookupEnv(PASSPHRASE_ENV); ok {
+		return passphrase, nil
+	}
+	return promptPassphrase(prompt)
+}
+
+// 秘密鍵を暗号化するための新しいパスフレーズを読み込む。入力ミスを防ぐため2回入力させる
+func readNewPassphrase() (string, error) {
+	if passphrase, ok := os.LookupEnv(PASSPHRASE_ENV); ok {
+		if len(passphrase) < 1 {
+			return "", errors.New(PASSPHRASE_ENV + " must not be empty")
+		}
+		return passphrase, nil
+	}
+
+	passphrase, err := promptPassphrase("🔑 New passphrase to encrypt the secret key: ")
+	if err != nil {
+		return "", err
+	}
+	if len(passphrase) < 1 {
+		return "", errors.New("Passphrase must not be empty")
+	}
+	confirmation, err := promptPassphrase("🔑 Confirm passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if passphrase != confirmation {
+		return "", errors.New("Passphrases do not match")
+	}
+	return passphrase, nil
+}
+
+func promptPassphrase(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !interactive || !term.IsTerminal(fd) {
+		return "", errNoPassphrase
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	return string(passphrase), nil
+}
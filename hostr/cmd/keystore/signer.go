@@ -0,0 +1,215 @@
+package keystore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/nip46"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/paths"
+)
+
+// set-bunkerで設定したリモートの署名者を保存するファイル
+const BUNKER_PATH = ".nostr_bunker"
+
+// ユーザーの承認を含めてリモートの署名者の応答を待つ時間
+const bunkerTimeout = 2 * time.Minute
+
+// Signer はイベントに署名する鍵。ローカルの秘密鍵、またはNIP-46のリモートの署名者
+type Signer interface {
+	GetPublicKey() (string, error)
+	SignEvent(ev *nostr.Event) error
+}
+
+// BatchSigner は複数のイベントにまとめて署名できるSigner。
+// 1回の署名に時間がかかるので、デプロイするイベントはpublishの直前にまとめて署名する
+type BatchSigner interface {
+	Signer
+	SignEvents(evs []*nostr.Event) error
+}
+
+// ローカルの秘密鍵で署名する
+type keySigner struct {
+	secretKey string
+}
+
+func NewKeySigner(secretKey string) Signer {
+	return &keySigner{secretKey: secretKey}
+}
+
+func (s *keySigner) GetPublicKey() (string, error) {
+	return nostr.GetPublicKey(s.secretKey)
+}
+
+func (s *keySigner) SignEvent(ev *nostr.Event) error {
+	return ev.Sign(s.secretKey)
+}
+
+// NIP-46のリモートの署名者に署名を依頼する
+type bunkerSigner struct {
+	client *nip46.Client
+}
+
+func (s *bunkerSigner) GetPublicKey() (string, error) {
+	return s.client.GetPublicKey(), nil
+}
+
+func (s *bunkerSigner) SignEvent(ev *nostr.Event) error {
+	ctx, cancel := context.WithTimeout(context.Background(), bunkerTimeout)
+	defer cancel()
+	return s.client.SignEvent(ctx, ev)
+}
+
+// 並行して送れる数には上限があるので、全体ではなくイベントごとにbunkerTimeoutまで待つ
+func (s *bunkerSigner) SignEvents(evs []*nostr.Event) error {
+	return s.client.SignEvents(context.Background(), evs, bunkerTimeout)
+}
+
+// リモートの署名者の設定
+type bunkerConfig struct {
+	URL string `json:"url"`
+	// 署名者がこのマシンを識別するためのクライアントの鍵
+	ClientSecretKey string `json:"clientSecretKey"`
+	// 署名するユーザーの公開鍵
+	PubKey string `json:"pubKey"`
+}
+
+// GetSigner はHOSTR_SECRET_KEY、set-bunkerで設定したリモートの署名者、set-privateで設定した秘密鍵の順にSignerを返す
+func GetSigner() (Signer, error) {
+	// 環境変数で秘密鍵が渡された場合は保存した鍵やリモートの署名者より優先する
+	if secret, ok, err := getSecretFromEnv(); ok || err != nil {
+		if err != nil {
+			return nil, err
+		}
+		return NewKeySigner(secret), nil
+	}
+
+	config, err := loadBunkerConfig()
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		secret, err := GetSecret()
+		if err != nil {
+			return nil, err
+		}
+		return NewKeySigner(secret), nil
+	}
+
+	client, err := connectBunker(config.URL, config.ClientSecretKey)
+	if err != nil {
+		return nil, err
+	}
+	if client.GetPublicKey() != config.PubKey {
+		client.Close()
+		return nil, fmt.Errorf("bunker signs for %s but %s was configured. Please run set-bunker again", client.GetPublicKey(), config.PubKey)
+	}
+	return &bunkerSigner{client: client}, nil
+}
+
+// SetBunker はリモートの署名者に接続して、以降の署名に使うよう保存する。署名するユーザーの公開鍵を返す
+func SetBunker(bunkerURL string) (string, error) {
+	if _, _, _, err := nip46.ParseBunkerURL(bunkerURL); err != nil {
+		return "", err
+	}
+
+	clientSecretKey := nostr.GeneratePrivateKey()
+	client, err := connectBunker(bunkerURL, clientSecretKey)
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+
+	// secretは最初の接続でのみ使われるので保存しない
+	parsed, err := url.Parse(bunkerURL)
+	if err != nil {
+		return "", err
+	}
+	query := parsed.Query()
+	query.Del("secret")
+	parsed.RawQuery = query.Encode()
+
+	config := bunkerConfig{
+		URL:             parsed.String(),
+		ClientSecretKey: clientSecretKey,
+		PubKey:          client.GetPublicKey(),
+	}
+	content, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	filePath, err := getBunkerConfigPath()
+	if err != nil {
+		return "", err
+	}
+	// クライアントの鍵を含むので本人のみ読み書きできるようにする
+	err = os.WriteFile(filePath, content, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	return config.PubKey, nil
+}
+
+// RemoveBunker はリモートの署名者の設定を削除し、ローカルの秘密鍵を使うようにする
+func RemoveBunker() error {
+	filePath, err := getBunkerConfigPath()
+	if err != nil {
+		return err
+	}
+	err = os.Remove(filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func connectBunker(bunkerURL, clientSecretKey string) (*nip46.Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), bunkerTimeout)
+	defer cancel()
+
+	// 署名者の準備中の表示は、コマンドの出力と混ざらないよう標準エラー出力に出す
+	fmt.Fprintln(os.Stderr, "🔌 Connecting to bunker...")
+	return nip46.Connect(ctx, bunkerURL, clientSecretKey, func(authURL string) {
+		fmt.Fprintln(os.Stderr, "🔐 Please approve hostr in your signer:", authURL)
+	})
+}
+
+func getBunkerConfigPath() (string, error) {
+	dir, err := paths.GetProfileDirectory()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, BUNKER_PATH), nil
+}
+
+// 設定されていない場合はnilを返す
+func loadBunkerConfig() (*bunkerConfig, error) {
+	filePath, err := getBunkerConfigPath()
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := os.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	config := &bunkerConfig{}
+	if err := json.Unmarshal(content, config); err != nil {
+		return nil, err
+	}
+	if len(config.URL) < 1 || len(config.ClientSecretKey) < 1 || len(config.PubKey) < 1 {
+		return nil, errors.New("Invalid bunker setting. Please run set-bunker again")
+	}
+	return config, nil
+}
@@ -0,0 +1,164 @@
+package nip44
+
+import (
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+
+	"github.com/nbd-wtf/go-nostr/nip04"
+	"golang.org/x/crypto/chacha20"
+)
+
+// NIP-44のバージョン2の暗号化
+const version = 2
+
+const (
+	minPlaintextSize = 1
+	maxPlaintextSize = 65535
+)
+
+// GenerateConversationKey はsecretKeyとpubKey(いずれもhex)から会話鍵を生成する
+func GenerateConversationKey(pubKey, secretKey string) ([]byte, error) {
+	// ECDHの共有点のx座標はNIP-04と同じ
+	shared, err := nip04.ComputeSharedSecret(pubKey, secretKey)
+	if err != nil {
+		return nil, err
+	}
+	return hkdf.Extract(sha256.New, shared, []byte("nip44-v2"))
+}
+
+// Encrypt はplaintextを会話鍵で暗号化し、base64のペイロードを返す
+func Encrypt(plaintext string, conversationKey []byte) (string, error) {
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return encrypt(plaintext, conversationKey, nonce)
+}
+
+func encrypt(plaintext string, conversationKey, nonce []byte) (string, error) {
+	chachaKey, chachaNonce, hmacKey, err := getMessageKeys(conversationKey, nonce)
+	if err != nil {
+		return "", err
+	}
+
+	padded, err := pad(plaintext)
+	if err != nil {
+		return "", err
+	}
+
+	cipher, err := chacha20.NewUnauthenticatedCipher(chachaKey, chachaNonce)
+	if err != nil {
+		return "", err
+	}
+	ciphertext := make([]byte, len(padded))
+	cipher.XORKeyStream(ciphertext, padded)
+
+	payload := []byte{version}
+	payload = append(payload, nonce...)
+	payload = append(payload, ciphertext...)
+	payload = append(payload, getMAC(hmacKey, nonce, ciphertext)...)
+
+	return base64.StdEncoding.EncodeToString(payload), nil
+}
+
+// Decrypt はbase64のペイロードを会話鍵で復号する
+func Decrypt(payload string, conversationKey []byte) (string, error) {
+	if len(payload) < 1 || payload[0] == '#' {
+		return "", errors.New("unknown encryption version")
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return "", fmt.Errorf("invalid base64: %w", err)
+	}
+	if len(decoded) < 99 || len(decoded) > 65603 {
+		return "", errors.New("invalid payload length")
+	}
+	if decoded[0] != version {
+		return "", fmt.Errorf("unknown encryption version %d", decoded[0])
+	}
+
+	nonce := decoded[1:33]
+	ciphertext := decoded[33 : len(decoded)-32]
+	mac := decoded[len(decoded)-32:]
+
+	chachaKey, chachaNonce, hmacKey, err := getMessageKeys(conversationKey, nonce)
+	if err != nil {
+		return "", err
+	}
+	if !hmac.Equal(mac, getMAC(hmacKey, nonce, ciphertext)) {
+		return "", errors.New("invalid MAC")
+	}
+
+	cipher, err := chacha20.NewUnauthenticatedCipher(chachaKey, chachaNonce)
+	if err != nil {
+		return "", err
+	}
+	padded := make([]byte, len(ciphertext))
+	cipher.XORKeyStream(padded, ciphertext)
+
+	return unpad(padded)
+}
+
+// 会話鍵とnonceからメッセージごとの鍵を導出する
+func getMessageKeys(conversationKey, nonce []byte) ([]byte, []byte, []byte, error) {
+	if len(conversationKey) != 32 {
+		return nil, nil, nil, errors.New("invalid conversation key length")
+	}
+	if len(nonce) != 32 {
+		return nil, nil, nil, errors.New("invalid nonce length")
+	}
+
+	keys, err := hkdf.Expand(sha256.New, conversationKey, string(nonce), 76)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return keys[0:32], keys[32:44], keys[44:76], nil
+}
+
+func getMAC(hmacKey, nonce, ciphertext []byte) []byte {
+	h := hmac.New(sha256.New, hmacKey)
+	h.Write(nonce)
+	h.Write(ciphertext)
+	return h.Sum(nil)
+}
+
+// メッセージの長さを隠すためのパディング後の長さ
+func calcPaddedLength(length int) int {
+	if length <= 32 {
+		return 32
+	}
+	nextPower := 1 << bits.Len(uint(length-1))
+	chunk := 32
+	if nextPower > 256 {
+		chunk = nextPower / 8
+	}
+	return chunk * ((length-1)/chunk + 1)
+}
+
+func pad(plaintext string) ([]byte, error) {
+	length := len(plaintext)
+	if length < minPlaintextSize || length > maxPlaintextSize {
+		return nil, errors.New("invalid plaintext length")
+	}
+
+	padded := make([]byte, 2+calcPaddedLength(length))
+	binary.BigEndian.PutUint16(padded, uint16(length))
+	copy(padded[2:], plaintext)
+	return padded, nil
+}
+
+func unpad(padded []byte) (string, error) {
+	length := int(binary.BigEndian.Uint16(padded))
+	if length < minPlaintextSize || length > maxPlaintextSize || len(padded) != 2+calcPaddedLength(length) {
+		return "", errors.New("invalid padding")
+	}
+	return string(padded[2 : 2+length]), nil
+}
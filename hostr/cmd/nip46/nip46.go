@@ -0,0 +1,385 @@
+package nip46
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip04"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/nip44"
+)
+
+// NIP-46のリクエストとレスポンスのkind
+const KindNostrConnect = 24133
+
+// 同時に送る署名リクエストの数。リモートの署名者に負荷をかけすぎないよう制限する
+const maxConcurrentRequests = 16
+
+// リレーへの接続とリクエストのpublishを待つ時間
+const publishTimeout = 10 * time.Second
+
+// 署名者の時計が遅れていてもレスポンスを受け取れるよう、購読の開始時刻を早める幅。
+// 古いレスポンスはリクエストのIDが一致しないので無視される
+const clockSkewMargin = 60
+
+type request struct {
+	ID     string   `json:"id"`
+	Method string   `json:"method"`
+	Params []string `json:"params"`
+}
+
+type response struct {
+	ID     string `json:"id"`
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Client はbunker://のURLで指定されたリモートの署名者にリクエストを送る
+type Client struct {
+	clientSecretKey string
+	clientPubKey    string
+	remotePubKey    string
+	userPubKey      string
+
+	conversationKey []byte
+	// NIP-04で応答する古い署名者のための共有鍵
+	sharedSecret []byte
+
+	relays []*nostr.Relay
+	// 認可が必要な場合に署名者から送られるURLを受け取る
+	onAuthURL func(string)
+
+	mutex   sync.Mutex
+	pending map[string]chan response
+}
+
+// ParseBunkerURL はbunker://<リモートの署名者のpubkey>?relay=...&secret=... を解析する
+func ParseBunkerURL(bunkerURL string) (string, []string, string, error) {
+	parsed, err := url.Parse(bunkerURL)
+	if err != nil {
+		return "", nil, "", err
+	}
+	if parsed.Scheme != "bunker" {
+		return "", nil, "", fmt.Errorf("invalid bunker URL: scheme must be bunker://")
+	}
+
+	remotePubKey := parsed.Host
+	if decoded, err := hex.DecodeString(remotePubKey); err != nil || len(decoded) != 32 {
+		return "", nil, "", fmt.Errorf("invalid bunker URL: %q is not a hex public key", remotePubKey)
+	}
+
+	query := parsed.Query()
+	relays := query["relay"]
+	if len(relays) < 1 {
+		return "", nil, "", fmt.Errorf("invalid bunker URL: no relay specified")
+	}
+
+	return remotePubKey, relays, query.Get("secret"), nil
+}
+
+// Connect はbunkerのリレーに接続してconnectリクエストを送り、署名するユーザーの公開鍵を取得する。
+// clientSecretKeyは署名者がこのクライアントを識別するための鍵で、接続ごとに同じものを使う
+func Connect(ctx context.Context, bunkerURL, clientSecretKey string, onAuthURL func(string)) (*Client, error) {
+	remotePubKey, relayURLs, secret, err := ParseBunkerURL(bunkerURL)
+	if err != nil {
+		return nil, err
+	}
+
+	clientPubKey, err := nostr.GetPublicKey(clientSecretKey)
+	if err != nil {
+		return nil, err
+	}
+	conversationKey, err := nip44.GenerateConversationKey(remotePubKey, clientSecretKey)
+	if err != nil {
+		return nil, err
+	}
+	sharedSecret, err := nip04.ComputeSharedSecret(remotePubKey, clientSecretKey)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		clientSecretKey: clientSecretKey,
+		clientPubKey:    clientPubKey,
+		remotePubKey:    remotePubKey,
+		conversationKey: conversationKey,
+		sharedSecret:    sharedSecret,
+		onAuthURL:       onAuthURL,
+		pending:         map[string]chan response{},
+	}
+
+	since := nostr.Now() - clockSkewMargin
+	for _, relayURL := range relayURLs {
+		connectCtx, cancel := context.WithTimeout(ctx, publishTimeout)
+		relay, err := nostr.RelayConnect(connectCtx, relayURL)
+		cancel()
+		if err != nil {
+			continue
+		}
+
+		sub, err := relay.Subscribe(context.Background(), nostr.Filters{{
+			Kinds:   []int{KindNostrConnect},
+			Authors: []string{remotePubKey},
+			Tags:    nostr.TagMap{"p": []string{clientPubKey}},
+			Since:   &since,
+		}})
+		if err != nil {
+			relay.Close()
+			continue
+		}
+
+		c.relays = append(c.relays, relay)
+		go func() {
+			for ev := range sub.Events {
+				c.handleResponse(ev)
+			}
+		}()
+	}
+	if len(c.relays) < 1 {
+		return nil, fmt.Errorf("could not connect to any bunker relay")
+	}
+
+	result, err := c.request(ctx, "connect", remotePubKey, secret)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if result != "ack" && (len(secret) < 1 || result != secret) {
+		c.Close()
+		return nil, fmt.Errorf("unexpected connect response: %s", result)
+	}
+
+	c.userPubKey, err = c.request(ctx, "get_public_key")
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// GetPublicKey は署名するユーザーの公開鍵を返す
+func (c *Client) GetPublicKey() string {
+	return c.userPubKey
+}
+
+// SignEvent はイベントにリモートの署名者の署名を付ける
+func (c *Client) SignEvent(ctx context.Context, ev *nostr.Event) error {
+	return c.signEvent(ctx, ev)
+}
+
+// SignEvents は複数のsign_eventリクエストを並行して送り、すべてのイベントに署名を付ける。
+// timeoutは1つのイベントの署名を待つ時間で、リクエストを送った時点から数える。
+// 返されたイベントのIDが元のイベントと異なる場合はエラーにする
+func (c *Client) SignEvents(ctx context.Context, events []*nostr.Event, timeout time.Duration) error {
+	var wg sync.WaitGroup
+	var errMutex sync.Mutex
+	var firstErr error
+	semaphore := make(chan struct{}, maxConcurrentRequests)
+
+	for _, ev := range events {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(ev *nostr.Event) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+
+			signCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			err := c.signEvent(signCtx, ev)
+			if err != nil {
+				errMutex.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				errMutex.Unlock()
+			}
+		}(ev)
+	}
+	wg.Wait()
+
+	return firstErr
+}
+
+func (c *Client) signEvent(ctx context.Context, ev *nostr.Event) error {
+	ev.PubKey = c.userPubKey
+	unsigned, err := json.Marshal(map[string]any{
+		"kind":       ev.Kind,
+		"content":    ev.Content,
+		"tags":       ev.Tags,
+		"created_at": ev.CreatedAt,
+		"pubkey":     ev.PubKey,
+	})
+	if err != nil {
+		return err
+	}
+
+	result, err := c.request(ctx, "sign_event", string(unsigned))
+	if err != nil {
+		return err
+	}
+
+	var signed nostr.Event
+	if err := json.Unmarshal([]byte(result), &signed); err != nil {
+		return fmt.Errorf("invalid sign_event response: %w", err)
+	}
+
+	// 署名者がcreated_atなどを書き換えるとデプロイ済みの参照と一致しなくなる
+	id := ev.GetID()
+	if signed.ID != id || signed.GetID() != id {
+		return fmt.Errorf("remote signer returned a different event for %s", id)
+	}
+	if ok, err := signed.CheckSignature(); !ok || err != nil {
+		return fmt.Errorf("remote signer returned an invalid signature for %s", id)
+	}
+
+	ev.ID = id
+	ev.Sig = signed.Sig
+	return nil
+}
+
+// リクエストをpublishし、同じIDのレスポンスを待つ
+func (c *Client) request(ctx context.Context, method string, params ...string) (string, error) {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", err
+	}
+	req := request{ID: hex.EncodeToString(idBytes), Method: method, Params: params}
+
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	content, err := nip44.Encrypt(string(payload), c.conversationKey)
+	if err != nil {
+		return "", err
+	}
+
+	ev := nostr.Event{
+		PubKey:    c.clientPubKey,
+		CreatedAt: nostr.Now(),
+		Kind:      KindNostrConnect,
+		Tags:      nostr.Tags{nostr.Tag{"p", c.remotePubKey}},
+		Content:   content,
+	}
+	if err := ev.Sign(c.clientSecretKey); err != nil {
+		return "", err
+	}
+
+	// auth_urlと複数のリレーからの重複を受け取れるよう余裕を持たせる
+	responses := make(chan response, 8)
+	c.mutex.Lock()
+	c.pending[req.ID] = responses
+	c.mutex.Unlock()
+	defer func() {
+		c.mutex.Lock()
+		delete(c.pending, req.ID)
+		c.mutex.Unlock()
+	}()
+
+	if err := c.publish(ctx, ev); err != nil {
+		return "", err
+	}
+
+	shownAuthURL := ""
+	for {
+		select {
+		case res := <-responses:
+			// ユーザーの承認が必要な場合はURLを表示して本来のレスポンスを待つ
+			if res.Result == "auth_url" {
+				if c.onAuthURL != nil && res.Error != shownAuthURL {
+					c.onAuthURL(res.Error)
+				}
+				shownAuthURL = res.Error
+				continue
+			}
+			if len(res.Error) > 0 {
+				return "", fmt.Errorf("%s: %s", method, res.Error)
+			}
+			return res.Result, nil
+		case <-ctx.Done():
+			return "", fmt.Errorf("%s: %w", method, ctx.Err())
+		}
+	}
+}
+
+// いずれかのリレーに受け付けられればよい
+func (c *Client) publish(ctx context.Context, ev nostr.Event) error {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	errs := []error{}
+	published := false
+
+	for _, relay := range c.relays {
+		wg.Add(1)
+		go func(relay *nostr.Relay) {
+			defer wg.Done()
+			publishCtx, cancel := context.WithTimeout(ctx, publishTimeout)
+			defer cancel()
+
+			status, err := relay.Publish(publishCtx, ev)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if status == nostr.PublishStatusSucceeded {
+				published = true
+			} else if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", relay.URL, err))
+			}
+		}(relay)
+	}
+	wg.Wait()
+
+	if !published {
+		return fmt.Errorf("failed to send request to bunker: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// 署名者からのレスポンスを復号し、待っているリクエストに渡す
+func (c *Client) handleResponse(ev *nostr.Event) {
+	var plaintext string
+	var err error
+	if strings.Contains(ev.Content, "?iv=") {
+		plaintext, err = nip04.Decrypt(ev.Content, c.sharedSecret)
+	} else {
+		plaintext, err = nip44.Decrypt(ev.Content, c.conversationKey)
+	}
+	if err != nil {
+		return
+	}
+
+	var res response
+	if err := json.Unmarshal([]byte(plaintext), &res); err != nil {
+		return
+	}
+
+	c.mutex.Lock()
+	responses, ok := c.pending[res.ID]
+	c.mutex.Unlock()
+	if !ok {
+		return
+	}
+
+	// 複数のリレーから同じレスポンスが届く場合があるので、受け取れない分は捨てる
+	select {
+	case responses <- res:
+	default:
+	}
+}
+
+func (c *Client) Close() {
+	for _, relay := range c.relays {
+		relay.Close()
+	}
+}
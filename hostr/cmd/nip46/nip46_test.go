@@ -0,0 +1,374 @@
+package nip46
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/nip44"
+	"golang.org/x/net/websocket"
+)
+
+// テスト用のリレー。受け取ったイベントを保存し、購読中のフィルターに一致するものを配信する
+type testRelay struct {
+	*httptest.Server
+	mutex  sync.Mutex
+	events []*nostr.Event
+	subs   map[*testRelayConn]map[string]nostr.Filters
+}
+
+type testRelayConn struct {
+	ws    *websocket.Conn
+	mutex sync.Mutex
+}
+
+func (c *testRelayConn) send(envelope nostr.Envelope) {
+	message, err := envelope.MarshalJSON()
+	if err != nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	websocket.Message.Send(c.ws, string(message))
+}
+
+func newTestRelay(t *testing.T) *testRelay {
+	relay := &testRelay{subs: map[*testRelayConn]map[string]nostr.Filters{}}
+	// go-nostrのクライアントはOriginを送らないので、Originを確認しないServerを使う
+	relay.Server = httptest.NewServer(websocket.Server{Handler: relay.handle})
+	t.Cleanup(relay.Close)
+	return relay
+}
+
+func (r *testRelay) URL() string {
+	return "ws" + strings.TrimPrefix(r.Server.URL, "http")
+}
+
+func (r *testRelay) handle(ws *websocket.Conn) {
+	conn := &testRelayConn{ws: ws}
+	r.mutex.Lock()
+	r.subs[conn] = map[string]nostr.Filters{}
+	r.mutex.Unlock()
+	defer func() {
+		r.mutex.Lock()
+		delete(r.subs, conn)
+		r.mutex.Unlock()
+	}()
+
+	for {
+		var message string
+		if err := websocket.Message.Receive(ws, &message); err != nil {
+			return
+		}
+
+		switch envelope := nostr.ParseMessage([]byte(message)).(type) {
+		case *nostr.EventEnvelope:
+			event := envelope.Event
+			conn.send(&nostr.OKEnvelope{EventID: event.ID, OK: true})
+			r.publish(&event)
+		case *nostr.ReqEnvelope:
+			r.mutex.Lock()
+			r.subs[conn][envelope.SubscriptionID] = envelope.Filters
+			stored := append([]*nostr.Event{}, r.events...)
+			r.mutex.Unlock()
+
+			for _, event := range stored {
+				if envelope.Filters.Match(event) {
+					conn.send(&nostr.EventEnvelope{SubscriptionID: &envelope.SubscriptionID, Event: *event})
+				}
+			}
+			eose := nostr.EOSEEnvelope(envelope.SubscriptionID)
+			conn.send(&eose)
+		case *nostr.CloseEnvelope:
+			r.mutex.Lock()
+			delete(r.subs[conn], string(*envelope))
+			r.mutex.Unlock()
+		}
+	}
+}
+
+func (r *testRelay) publish(event *nostr.Event) {
+	r.mutex.Lock()
+	r.events = append(r.events, event)
+	type delivery struct {
+		conn *testRelayConn
+		id   string
+	}
+	deliveries := []delivery{}
+	for conn, subs := range r.subs {
+		for id, filters := range subs {
+			if filters.Match(event) {
+				deliveries = append(deliveries, delivery{conn, id})
+			}
+		}
+	}
+	r.mutex.Unlock()
+
+	for _, d := range deliveries {
+		d.conn.send(&nostr.EventEnvelope{SubscriptionID: &d.id, Event: *event})
+	}
+}
+
+// テスト用のリモートの署名者
+type fakeBunker struct {
+	secretKey     string
+	pubKey        string
+	userSecretKey string
+	userPubKey    string
+	secret        string
+	// 空でない場合はsign_eventの前にauth_urlを返す
+	authURL string
+	// trueの場合はsign_eventに応答しない
+	ignoreSignEvent bool
+	// レスポンスのcreated_atをずらす秒数。署名者の時計が遅れている場合を再現する
+	clockSkew nostr.Timestamp
+
+	relay *nostr.Relay
+}
+
+func newFakeBunker(t *testing.T, relayURL, secret string) *fakeBunker {
+	b := &fakeBunker{
+		secretKey:     nostr.GeneratePrivateKey(),
+		userSecretKey: nostr.GeneratePrivateKey(),
+		secret:        secret,
+	}
+	b.pubKey, _ = nostr.GetPublicKey(b.secretKey)
+	b.userPubKey, _ = nostr.GetPublicKey(b.userSecretKey)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	relay, err := nostr.RelayConnect(ctx, relayURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.relay = relay
+	t.Cleanup(func() { relay.Close() })
+
+	sub, err := relay.Subscribe(context.Background(), nostr.Filters{{
+		Kinds: []int{KindNostrConnect},
+		Tags:  nostr.TagMap{"p": []string{b.pubKey}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for ev := range sub.Events {
+			b.handleRequest(t, ev)
+		}
+	}()
+
+	return b
+}
+
+func (b *fakeBunker) url(relayURL string) string {
+	return "bunker://" + b.pubKey + "?relay=" + relayURL + "&secret=" + b.secret
+}
+
+func (b *fakeBunker) handleRequest(t *testing.T, ev *nostr.Event) {
+	conversationKey, err := nip44.GenerateConversationKey(ev.PubKey, b.secretKey)
+	if err != nil {
+		t.Errorf("failed to generate conversation key: %v", err)
+		return
+	}
+	plaintext, err := nip44.Decrypt(ev.Content, conversationKey)
+	if err != nil {
+		t.Errorf("failed to decrypt request: %v", err)
+		return
+	}
+	var req request
+	if err := json.Unmarshal([]byte(plaintext), &req); err != nil {
+		t.Errorf("invalid request: %v", err)
+		return
+	}
+
+	res := response{ID: req.ID}
+	switch req.Method {
+	case "connect":
+		if len(req.Params) < 2 || req.Params[0] != b.pubKey || req.Params[1] != b.secret {
+			res.Error = "invalid secret"
+		} else {
+			res.Result = "ack"
+		}
+	case "get_public_key":
+		res.Result = b.userPubKey
+	case "sign_event":
+		if b.ignoreSignEvent {
+			return
+		}
+		if len(b.authURL) > 0 {
+			b.respond(t, ev.PubKey, conversationKey, response{ID: req.ID, Result: "auth_url", Error: b.authURL})
+		}
+		var unsigned nostr.Event
+		if err := json.Unmarshal([]byte(req.Params[0]), &unsigned); err != nil {
+			res.Error = err.Error()
+			break
+		}
+		if err := unsigned.Sign(b.userSecretKey); err != nil {
+			res.Error = err.Error()
+			break
+		}
+		signed, _ := json.Marshal(unsigned)
+		res.Result = string(signed)
+	default:
+		res.Error = "unsupported method " + req.Method
+	}
+
+	b.respond(t, ev.PubKey, conversationKey, res)
+}
+
+func (b *fakeBunker) respond(t *testing.T, clientPubKey string, conversationKey []byte, res response) {
+	payload, _ := json.Marshal(res)
+	content, err := nip44.Encrypt(string(payload), conversationKey)
+	if err != nil {
+		t.Errorf("failed to encrypt response: %v", err)
+		return
+	}
+	ev := nostr.Event{
+		CreatedAt: nostr.Now() - b.clockSkew,
+		Kind:      KindNostrConnect,
+		Tags:      nostr.Tags{nostr.Tag{"p", clientPubKey}},
+		Content:   content,
+	}
+	if err := ev.Sign(b.secretKey); err != nil {
+		t.Errorf("failed to sign response: %v", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	b.relay.Publish(ctx, ev)
+}
+
+func connectTestClient(t *testing.T, bunkerURL string, onAuthURL func(string)) (*Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := Connect(ctx, bunkerURL, nostr.GeneratePrivateKey(), onAuthURL)
+	if err == nil {
+		t.Cleanup(client.Close)
+	}
+	return client, err
+}
+
+func TestConnect(t *testing.T) {
+	relay := newTestRelay(t)
+	bunker := newFakeBunker(t, relay.URL(), "s3cret")
+
+	client, err := connectTestClient(t, bunker.url(relay.URL()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.GetPublicKey() != bunker.userPubKey {
+		t.Errorf("GetPublicKey() = %s, want %s", client.GetPublicKey(), bunker.userPubKey)
+	}
+}
+
+// 署名者の時計が遅れていてもレスポンスを受け取る
+func TestConnectClockSkew(t *testing.T) {
+	relay := newTestRelay(t)
+	bunker := newFakeBunker(t, relay.URL(), "s3cret")
+	bunker.clockSkew = 30
+
+	client, err := connectTestClient(t, bunker.url(relay.URL()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.GetPublicKey() != bunker.userPubKey {
+		t.Errorf("GetPublicKey() = %s, want %s", client.GetPublicKey(), bunker.userPubKey)
+	}
+}
+
+func TestConnectWrongSecret(t *testing.T) {
+	relay := newTestRelay(t)
+	bunker := newFakeBunker(t, relay.URL(), "s3cret")
+
+	bunkerURL := strings.Replace(bunker.url(relay.URL()), "secret=s3cret", "secret=wrong", 1)
+	if _, err := connectTestClient(t, bunkerURL, nil); err == nil || !strings.Contains(err.Error(), "invalid secret") {
+		t.Errorf("Connect with a wrong secret: err = %v", err)
+	}
+}
+
+func TestSignEvents(t *testing.T) {
+	relay := newTestRelay(t)
+	bunker := newFakeBunker(t, relay.URL(), "s3cret")
+
+	client, err := connectTestClient(t, bunker.url(relay.URL()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := []*nostr.Event{}
+	for _, content := range []string{"<html></html>", "body {}", "console.log(1)"} {
+		events = append(events, &nostr.Event{Kind: 5392, Content: content, CreatedAt: nostr.Now(), Tags: nostr.Tags{}})
+	}
+	if err := client.SignEvents(context.Background(), events, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ev := range events {
+		if ev.PubKey != bunker.userPubKey {
+			t.Errorf("pubkey = %s, want %s", ev.PubKey, bunker.userPubKey)
+		}
+		if ok, err := ev.CheckSignature(); !ok || err != nil {
+			t.Errorf("event %s has an invalid signature: %v", ev.ID, err)
+		}
+	}
+}
+
+func TestSignEventAuthURL(t *testing.T) {
+	relay := newTestRelay(t)
+	bunker := newFakeBunker(t, relay.URL(), "s3cret")
+	bunker.authURL = "https://bunker.example.com/approve"
+
+	var mutex sync.Mutex
+	authURLs := []string{}
+	client, err := connectTestClient(t, bunker.url(relay.URL()), func(url string) {
+		mutex.Lock()
+		authURLs = append(authURLs, url)
+		mutex.Unlock()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ev := &nostr.Event{Kind: 5392, Content: "<html></html>", CreatedAt: nostr.Now(), Tags: nostr.Tags{}}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.SignEvent(ctx, ev); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := ev.CheckSignature(); !ok {
+		t.Errorf("event has an invalid signature")
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(authURLs) != 1 || authURLs[0] != bunker.authURL {
+		t.Errorf("auth URLs = %v, want [%s]", authURLs, bunker.authURL)
+	}
+}
+
+// 応答のない署名リクエストはイベントごとのtimeoutで打ち切る
+func TestSignEventsTimeout(t *testing.T) {
+	relay := newTestRelay(t)
+	bunker := newFakeBunker(t, relay.URL(), "s3cret")
+	bunker.ignoreSignEvent = true
+
+	client, err := connectTestClient(t, bunker.url(relay.URL()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ev := &nostr.Event{Kind: 5392, Content: "<html></html>", CreatedAt: nostr.Now(), Tags: nostr.Tags{}}
+	started := time.Now()
+	err = client.SignEvents(context.Background(), []*nostr.Event{ev}, 300*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+		t.Errorf("SignEvents without a response: err = %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("SignEvents took %s", elapsed)
+	}
+}
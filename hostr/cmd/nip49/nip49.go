@@ -0,0 +1,131 @@
+package nip49
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcutil/bech32"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/text/unicode/norm"
+)
+
+// NIP-49の暗号化された秘密鍵のbech32のプレフィックス
+const Prefix = "ncryptsec"
+
+const version = 0x02
+
+// scryptのコストの既定値。2^16回で64MiBのメモリを使う
+const DefaultLogN = 16
+
+// 秘密鍵がこれまでどのように扱われたかを表す、暗号文の追加データ
+type KeySecurity byte
+
+const (
+	// 平文で保存されたことがあるなど、安全でない扱いをされたことがわかっている
+	KeySecurityInsecure KeySecurity = 0x00
+	// 安全でない扱いをされたことがない
+	KeySecuritySecure KeySecurity = 0x01
+	// 扱われ方がわからない
+	KeySecurityUnknown KeySecurity = 0x02
+)
+
+// version(1) + log_n(1) + salt(16) + nonce(24) + key_security(1) + 暗号文(32) + タグ(16)
+const payloadLength = 91
+
+// Encrypt はhexの秘密鍵をパスフレーズで暗号化し、ncryptsecを返す
+func Encrypt(secretKey, passphrase string, logN uint8, security KeySecurity) (string, error) {
+	key, err := hex.DecodeString(secretKey)
+	if err != nil || len(key) != 32 {
+		return "", errors.New("invalid secret key")
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	symmetricKey, err := deriveKey(passphrase, salt, logN)
+	if err != nil {
+		return "", err
+	}
+	aead, err := chacha20poly1305.NewX(symmetricKey)
+	if err != nil {
+		return "", err
+	}
+
+	payload := []byte{version, logN}
+	payload = append(payload, salt...)
+	payload = append(payload, nonce...)
+	payload = append(payload, byte(security))
+	payload = aead.Seal(payload, nonce, key, []byte{byte(security)})
+
+	data, err := bech32.ConvertBits(payload, 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+	return bech32.Encode(Prefix, data)
+}
+
+// Decrypt はncryptsecをパスフレーズで復号し、hexの秘密鍵を返す
+func Decrypt(ncryptsec, passphrase string) (string, KeySecurity, error) {
+	// 鍵の長さがbech32の90文字の制限を超えるため制限なしでデコードする
+	prefix, data, err := bech32.DecodeNoLimit(ncryptsec)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid ncryptsec: %w", err)
+	}
+	if prefix != Prefix {
+		return "", 0, fmt.Errorf("invalid ncryptsec: unexpected prefix %q", prefix)
+	}
+	payload, err := bech32.ConvertBits(data, 5, 8, false)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid ncryptsec: %w", err)
+	}
+	if len(payload) != payloadLength {
+		return "", 0, errors.New("invalid ncryptsec: unexpected length")
+	}
+	if payload[0] != version {
+		return "", 0, fmt.Errorf("invalid ncryptsec: unknown version %d", payload[0])
+	}
+
+	logN := payload[1]
+	salt := payload[2:18]
+	nonce := payload[18:42]
+	security := payload[42:43]
+	ciphertext := payload[43:]
+
+	symmetricKey, err := deriveKey(passphrase, salt, logN)
+	if err != nil {
+		return "", 0, err
+	}
+	aead, err := chacha20poly1305.NewX(symmetricKey)
+	if err != nil {
+		return "", 0, err
+	}
+	key, err := aead.Open(nil, nonce, ciphertext, security)
+	if err != nil {
+		return "", 0, errors.New("wrong passphrase")
+	}
+
+	return hex.EncodeToString(key), KeySecurity(security[0]), nil
+}
+
+// IsNcryptsec はsがncryptsecの形式かどうかを返す
+func IsNcryptsec(s string) bool {
+	return len(s) > len(Prefix) && s[:len(Prefix)+1] == Prefix+"1"
+}
+
+func deriveKey(passphrase string, salt []byte, logN uint8) ([]byte, error) {
+	// 同じパスフレーズが入力方法によって異なるバイト列にならないよう正規化する
+	normalized := norm.NFKC.String(passphrase)
+	if logN < 1 || logN > 30 {
+		return nil, fmt.Errorf("unsupported scrypt cost 2^%d", logN)
+	}
+	return scrypt.Key([]byte(normalized), salt, 1<<logN, 8, 1, 32)
+}
@@ -0,0 +1,110 @@
+package nip49
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// NIP-49の仕様に記載されているテストベクター
+func TestDecryptSpecVector(t *testing.T) {
+	ncryptsec := "ncryptsec1qgg9947rlpvqu76pj5ecreduf9jxhselq2nae2kghhvd5g7dgjtcxfqtd67p9m0w57lspw8gsq6yphnm8623nsl8xn9j4jdzz84zm3frztj3z7s35vpzmqf6ksu8r89qk5z2zxfmu5gv8th8wclt0h4p"
+
+	secretKey, security, err := Decrypt(ncryptsec, "nostr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secretKey != "3501454135014541350145413501453fefb02227e449e57cf4d3a3ce05378683" {
+		t.Errorf("secret key = %s", secretKey)
+	}
+	if security != KeySecurityInsecure {
+		t.Errorf("key security = %#x, want %#x", security, KeySecurityInsecure)
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	tests := []struct {
+		secretKey  string
+		passphrase string
+		logN       uint8
+		security   KeySecurity
+	}{
+		{"14c226dbdd865d5e1645e72c7470fd0a17feb42cc87b750bab6538171b3a3f8a", ".ksjabdk.aselqwe", 1, KeySecurityInsecure},
+		{"f7f2f77f98890885462764afb15b68eb5f69979c8046ecb08cad7c4ae6b221ab", "skjdaklrnçurbç l", 2, KeySecuritySecure},
+		{"11b25a101667dd9208db93c0827c6bdad66729a5b521156a7e9d3b22b3ae8944", "777z7z7z7z7z7z7z", 3, KeySecurityUnknown},
+		{"11b25a101667dd9208db93c0827c6bdad66729a5b521156a7e9d3b22b3ae8944", "", 4, KeySecuritySecure},
+	}
+
+	for _, test := range tests {
+		ncryptsec, err := Encrypt(test.secretKey, test.passphrase, test.logN, test.security)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !IsNcryptsec(ncryptsec) {
+			t.Errorf("Encrypt returned %s", ncryptsec)
+		}
+
+		secretKey, security, err := Decrypt(ncryptsec, test.passphrase)
+		if err != nil {
+			t.Errorf("Decrypt(%q): %v", test.passphrase, err)
+			continue
+		}
+		if secretKey != test.secretKey || security != test.security {
+			t.Errorf("Decrypt(%q) = %s, %#x, want %s, %#x", test.passphrase, secretKey, security, test.secretKey, test.security)
+		}
+	}
+}
+
+func TestDecryptWrongPassphrase(t *testing.T) {
+	ncryptsec, err := Encrypt("14c226dbdd865d5e1645e72c7470fd0a17feb42cc87b750bab6538171b3a3f8a", "correct horse", 4, KeySecuritySecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := Decrypt(ncryptsec, "battery staple"); err == nil || err.Error() != "wrong passphrase" {
+		t.Errorf("Decrypt with a wrong passphrase: err = %v", err)
+	}
+}
+
+func TestDecryptInvalid(t *testing.T) {
+	valid, err := Encrypt("14c226dbdd865d5e1645e72c7470fd0a17feb42cc87b750bab6538171b3a3f8a", "nostr", 1, KeySecuritySecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ncryptsec := range []string{
+		"",
+		"nsec1vl029mgpspedva04g90vltkh6fvh240zqtv9k0t9af8935ke9laqsnlfe5",
+		// チェックサムが一致しない
+		replaceLastChar(valid),
+	} {
+		if _, _, err := Decrypt(ncryptsec, "nostr"); err == nil {
+			t.Errorf("Decrypt(%q) succeeded", ncryptsec)
+		}
+	}
+}
+
+func replaceLastChar(s string) string {
+	last := "q"
+	if strings.HasSuffix(s, "q") {
+		last = "p"
+	}
+	return s[:len(s)-1] + last
+}
+
+// パスフレーズは入力方法によらず同じ鍵になるようNFKCで正規化する
+func TestDeriveKeyNormalizesPassphrase(t *testing.T) {
+	salt := bytes.Repeat([]byte{1}, 16)
+
+	composed, err := deriveKey("ÅΩṩ", salt, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decomposed, err := deriveKey("ÅΩẛ̣", salt, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(composed, decomposed) {
+		t.Errorf("keys derived from the same passphrase in different Unicode forms differ")
+	}
+}
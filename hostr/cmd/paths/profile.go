@@ -0,0 +1,194 @@
+package paths
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// 設定ディレクトリ直下の鍵とリレーを使うプロファイル
+const DefaultProfile = "default"
+
+// 名前付きのプロファイルを保存するディレクトリ
+const ProfilesDirName = "profiles"
+
+// hostr key useで選択したプロファイルを保存するファイル
+const CurrentProfileFileName = ".nostr_profile"
+
+var profileNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// --profileで指定されたプロファイル。指定されていない場合はhostr key useで選択したものを使う
+var profile string
+
+func SetProfile(name string) error {
+	if err := ValidateProfileName(name); err != nil {
+		return err
+	}
+	if name != DefaultProfile && !ProfileExists(name) {
+		return fmt.Errorf("Profile %q does not exist. Please run 'hostr key add %s'", name, name)
+	}
+	profile = name
+	return nil
+}
+
+// GetProfile は使用するプロファイルの名前を返す
+func GetProfile() (string, error) {
+	if len(profile) > 0 {
+		return profile, nil
+	}
+
+	dir, err := GetSettingsDirectory()
+	if err != nil {
+		return "", err
+	}
+	content, err := os.ReadFile(filepath.Join(dir, CurrentProfileFileName))
+	if os.IsNotExist(err) {
+		return DefaultProfile, nil
+	} else if err != nil {
+		return "", err
+	}
+
+	name := strings.TrimSpace(string(content))
+	if len(name) < 1 {
+		return DefaultProfile, nil
+	}
+	// 削除されたプロファイルの代わりにdefaultを使うと、別の鍵で署名してしまう
+	if !ProfileExists(name) {
+		return "", fmt.Errorf("Profile %q does not exist. Please run 'hostr key add %s' or 'hostr key use %s'", name, name, DefaultProfile)
+	}
+	return name, nil
+}
+
+// UseProfile は以降のコマンドで使うプロファイルを保存する
+func UseProfile(name string) error {
+	if err := ValidateProfileName(name); err != nil {
+		return err
+	}
+
+	dir, err := GetSettingsDirectory()
+	if err != nil {
+		return err
+	}
+	filePath := filepath.Join(dir, CurrentProfileFileName)
+
+	if name == DefaultProfile {
+		err = os.Remove(filePath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if !ProfileExists(name) {
+		return fmt.Errorf("Profile %q does not exist. Please run 'hostr key add %s'", name, name)
+	}
+	return os.WriteFile(filePath, []byte(name), 0644)
+}
+
+// GetProfileDirectory は使用するプロファイルの鍵とリレーを保存するディレクトリを返す
+func GetProfileDirectory() (string, error) {
+	name, err := GetProfile()
+	if err != nil {
+		return "", err
+	}
+	return getProfileDirectory(name)
+}
+
+// CreateProfile はプロファイルのディレクトリを作成する
+func CreateProfile(name string) error {
+	if err := ValidateProfileName(name); err != nil {
+		return err
+	}
+	if name == DefaultProfile || ProfileExists(name) {
+		return fmt.Errorf("Profile %q already exists", name)
+	}
+
+	dir, err := getProfileDirectory(name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(dir, 0700)
+}
+
+// RemoveProfile はプロファイルの鍵とリレーを削除する。選択中の場合はdefaultに戻す
+func RemoveProfile(name string) error {
+	if err := ValidateProfileName(name); err != nil {
+		return err
+	}
+	if name == DefaultProfile {
+		return errors.New("The default profile cannot be removed")
+	}
+	if !ProfileExists(name) {
+		return fmt.Errorf("Profile %q does not exist", name)
+	}
+
+	current, err := GetProfile()
+	if err != nil {
+		return err
+	}
+	if current == name {
+		if err := UseProfile(DefaultProfile); err != nil {
+			return err
+		}
+	}
+
+	dir, err := getProfileDirectory(name)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// ListProfiles はdefaultと名前付きのプロファイルを返す
+func ListProfiles() ([]string, error) {
+	dir, err := GetSettingsDirectory()
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{DefaultProfile}
+	entries, err := os.ReadDir(filepath.Join(dir, ProfilesDirName))
+	if os.IsNotExist(err) {
+		return names, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && profileNamePattern.MatchString(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+func ProfileExists(name string) bool {
+	if name == DefaultProfile {
+		return true
+	}
+	dir, err := getProfileDirectory(name)
+	if err != nil {
+		return false
+	}
+	info, err := os.Stat(dir)
+	return err == nil && info.IsDir()
+}
+
+func ValidateProfileName(name string) error {
+	if !profileNamePattern.MatchString(name) {
+		return fmt.Errorf("Invalid profile name %q. Use letters, numbers, '-' and '_'", name)
+	}
+	return nil
+}
+
+func getProfileDirectory(name string) (string, error) {
+	dir, err := GetSettingsDirectory()
+	if err != nil {
+		return "", err
+	}
+	if name == DefaultProfile {
+		return dir, nil
+	}
+	return filepath.Join(dir, ProfilesDirName, name), nil
+}
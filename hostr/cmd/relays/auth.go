@@ -0,0 +1,68 @@
+package relays
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/keystore"
+)
+
+// 読み込みに必要なAUTHの完了を待つ時間
+const AuthWaitTimeout = 2 * time.Second
+
+// 接続のタイムアウト
+const connectTimeout = 10 * time.Second
+
+// Connect はNIP-42のAUTHにsignerで署名して応答するリレーに接続する。
+// signerがnilの場合はAUTHに応答しない。
+// authWaitが正の場合は、読み込みに認証が必要なリレーの認証が終わるまで最大authWait待つ
+func Connect(ctx context.Context, url string, signer keystore.Signer, authWait time.Duration) (*nostr.Relay, error) {
+	if signer == nil {
+		return nostr.RelayConnect(ctx, url)
+	}
+
+	authenticated := make(chan struct{})
+	var once sync.Once
+	var relay *nostr.Relay
+
+	relay = nostr.NewRelay(context.Background(), url, nostr.WithAuthHandler(func(ctx context.Context, authEvent *nostr.Event) bool {
+		if err := signer.SignEvent(authEvent); err != nil {
+			return false
+		}
+		// AUTHへのOKはメッセージの受信ループで処理されるので、ここで待つとブロックしてしまう
+		go func() {
+			status, _ := relay.Auth(ctx, *authEvent)
+			if status == nostr.PublishStatusSucceeded {
+				once.Do(func() { close(authenticated) })
+			}
+		}()
+		return false
+	}))
+
+	err := relay.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if authWait > 0 {
+		// 接続直後に送られたAUTHを受け取れない場合があるので、読み込みを試して認証が必要ならAUTHを要求させる。
+		// 認証が不要なリレーはEOSEを返すのでそこで待つのをやめる
+		probeCtx, cancel := context.WithTimeout(ctx, authWait)
+		defer cancel()
+
+		probed := make(chan struct{})
+		go func() {
+			relay.QuerySync(probeCtx, nostr.Filter{Limit: 1})
+			close(probed)
+		}()
+
+		select {
+		case <-authenticated:
+		case <-probed:
+		}
+	}
+
+	return relay, nil
+}
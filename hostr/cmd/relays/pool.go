@@ -0,0 +1,159 @@
+package relays
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/keystore"
+)
+
+// Pool はリレーへの接続を使い回し、複数のリレーに問い合わせる。
+// signerを指定した場合はNIP-42のAUTHに応答する接続を張る。
+// 接続の一覧はPoolが排他制御するので、複数のgoroutineから使える
+type Pool struct {
+	ctx    context.Context
+	signer keystore.Signer
+	relays map[string]*nostr.Relay
+	// 同じリレーに重複して接続しないようURLごとにロックする
+	connecting map[string]*sync.Mutex
+	mutex      sync.Mutex
+}
+
+// NewPool はsignerでAUTHに応答するPoolを作成する。signerがnilの場合はAUTHに応答しない
+func NewPool(ctx context.Context, signer keystore.Signer) *Pool {
+	return &Pool{
+		ctx:        ctx,
+		signer:     signer,
+		relays:     map[string]*nostr.Relay{},
+		connecting: map[string]*sync.Mutex{},
+	}
+}
+
+// EnsureRelay は接続済みのリレーを返し、切断されている場合は接続し直す
+func (p *Pool) EnsureRelay(url string) (*nostr.Relay, error) {
+	url = nostr.NormalizeURL(url)
+
+	p.mutex.Lock()
+	lock, ok := p.connecting[url]
+	if !ok {
+		lock = &sync.Mutex{}
+		p.connecting[url] = lock
+	}
+	p.mutex.Unlock()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	p.mutex.Lock()
+	relay, ok := p.relays[url]
+	p.mutex.Unlock()
+	if ok && relay.IsConnected() {
+		return relay, nil
+	}
+
+	ctx, cancel := context.WithTimeout(p.ctx, connectTimeout)
+	defer cancel()
+
+	// 読み込みに認証が必要なリレーは認証が終わるまで待つ
+	authWait := time.Duration(0)
+	if p.signer != nil {
+		authWait = AuthWaitTimeout
+	}
+	relay, err := Connect(ctx, url, p.signer, authWait)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mutex.Lock()
+	p.relays[url] = relay
+	p.mutex.Unlock()
+
+	return relay, nil
+}
+
+// SubManyEose はurlsのリレーにfiltersで問い合わせ、重複を除いたイベントを返す。
+// すべてのリレーがEOSEを返すか、ctxが終了するとチャンネルを閉じる
+func (p *Pool) SubManyEose(ctx context.Context, urls []string, filters nostr.Filters) chan *nostr.Event {
+	ctx, cancel := context.WithCancel(ctx)
+
+	events := make(chan *nostr.Event)
+	seen := map[string]bool{}
+	var seenMutex sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, url := range urls {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+
+			relay, err := p.EnsureRelay(url)
+			if err != nil {
+				return
+			}
+			sub, err := relay.Subscribe(ctx, filters)
+			if err != nil || sub == nil {
+				return
+			}
+			defer sub.Unsub()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-sub.EndOfStoredEvents:
+					return
+				case ev, more := <-sub.Events:
+					if !more {
+						return
+					}
+
+					seenMutex.Lock()
+					duplicated := seen[ev.ID]
+					seen[ev.ID] = true
+					seenMutex.Unlock()
+					if duplicated {
+						continue
+					}
+
+					select {
+					case events <- ev:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}(url)
+	}
+
+	go func() {
+		wg.Wait()
+		cancel()
+		close(events)
+	}()
+
+	return events
+}
+
+// QuerySingle は最初に見つかったイベントを返す。見つからない場合はnilを返す
+func (p *Pool) QuerySingle(ctx context.Context, urls []string, filter nostr.Filter) *nostr.Event {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for ev := range p.SubManyEose(ctx, urls, nostr.Filters{filter}) {
+		return ev
+	}
+	return nil
+}
+
+// Close はすべての接続を閉じる
+func (p *Pool) Close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for url, relay := range p.relays {
+		relay.Close()
+		delete(p.relays, url)
+	}
+}
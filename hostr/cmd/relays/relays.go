@@ -10,8 +10,15 @@ import (
 
 const PATH = ".nostr_relays"
 
+// hostr.tomlで指定されたリレー。指定された場合は.nostr_relaysより優先する
+var projectRelays []string
+
+func SetProjectRelays(relayURLs []string) {
+	projectRelays = relayURLs
+}
+
 func AddRelay(relayURL string) error {
-	dir, err := paths.GetSettingsDirectory()
+	dir, err := paths.GetProfileDirectory()
 	if err != nil {
 		return err
 	}
@@ -28,7 +35,7 @@ func AddRelay(relayURL string) error {
 }
 
 func RemoveRelay(targetURL string) error {
-	dir, err := paths.GetSettingsDirectory()
+	dir, err := paths.GetProfileDirectory()
 	if err != nil {
 		return err
 	}
@@ -73,14 +80,33 @@ func GetAllRelays() ([]string, error) {
 		}
 	}
 
-	// Fall back to reading from file if environment variable is not set
-	dir, err := paths.GetSettingsDirectory()
+	// 名前付きのプロファイルに専用のリレーがあればhostr.tomlより優先する
+	profileDir, err := paths.GetProfileDirectory()
+	if err != nil {
+		return nil, err
+	}
+	settingsDir, err := paths.GetSettingsDirectory()
 	if err != nil {
 		return nil, err
 	}
+	if profileDir != settingsDir {
+		profileRelays, err := readRelaysFile(filepath.Join(profileDir, PATH))
+		if err == nil && len(profileRelays) > 0 {
+			return profileRelays, nil
+		} else if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
 
-	filePath := filepath.Join(dir, PATH)
+	if len(projectRelays) > 0 {
+		return projectRelays, nil
+	}
+
+	// Fall back to reading from file if environment variable is not set
+	return readRelaysFile(filepath.Join(settingsDir, PATH))
+}
 
+func readRelaysFile(filePath string) ([]string, error) {
 	content, err := os.ReadFile(filePath)
 	if err != nil {
 		return nil, err
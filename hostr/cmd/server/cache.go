@@ -0,0 +1,56 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// 期限付きのキャッシュ。リクエストのたびにリレーへ問い合わせないようにする
+type ttlCache[V any] struct {
+	ttl        time.Duration
+	maxEntries int
+	entries    map[string]ttlCacheEntry[V]
+	mutex      sync.Mutex
+}
+
+type ttlCacheEntry[V any] struct {
+	value     V
+	expiresAt time.Time
+}
+
+func newTTLCache[V any](ttl time.Duration, maxEntries int) *ttlCache[V] {
+	return &ttlCache[V]{ttl: ttl, maxEntries: maxEntries, entries: map[string]ttlCacheEntry[V]{}}
+}
+
+// 期限内のキャッシュがあればokがtrueになる
+func (c *ttlCache[V]) get(key string) (V, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expiresAt) {
+		var zero V
+		return zero, false
+	}
+	return entry.value, true
+}
+
+func (c *ttlCache[V]) set(key string, value V) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	if len(c.entries) >= c.maxEntries {
+		for key, entry := range c.entries {
+			if now.After(entry.expiresAt) {
+				delete(c.entries, key)
+			}
+		}
+		// 期限内のものだけで上限に達している場合はすべて破棄する
+		if len(c.entries) >= c.maxEntries {
+			clear(c.entries)
+		}
+	}
+
+	c.entries[key] = ttlCacheEntry[V]{value: value, expiresAt: now.Add(c.ttl)}
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/consts"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/relays"
+)
+
+// 削除リクエストの取得を待つ時間
+const deletionQueryTimeout = 5 * time.Second
+
+// 作成者によるNIP-09の削除リクエストが公開されているかどうか。
+// Replaceableなイベントはaタグで削除された場合、削除リクエストより前に作成されたものだけが削除済みになる
+func isDeleted(ctx context.Context, pool *relays.Pool, relays []string, ev *nostr.Event) bool {
+	filters := nostr.Filters{{
+		Kinds:   []int{consts.KindDeletion},
+		Authors: []string{ev.PubKey},
+		Tags:    nostr.TagMap{"e": []string{ev.ID}},
+	}}
+
+	address := ""
+	if ev.Kind >= 30000 && ev.Kind < 40000 {
+		address = fmt.Sprintf("%d:%s:%s", ev.Kind, ev.PubKey, getDTag(ev))
+		filters = append(filters, nostr.Filter{
+			Kinds:   []int{consts.KindDeletion},
+			Authors: []string{ev.PubKey},
+			Tags:    nostr.TagMap{"a": []string{address}},
+		})
+	}
+
+	queryCtx, cancel := context.WithTimeout(ctx, deletionQueryTimeout)
+	defer cancel()
+
+	for deletion := range pool.SubManyEose(queryCtx, relays, filters) {
+		if deletion.PubKey != ev.PubKey {
+			continue
+		}
+		for _, tag := range deletion.Tags {
+			if len(tag) < 2 {
+				continue
+			}
+			if tag[0] == "e" && tag[1] == ev.ID {
+				return true
+			}
+			if tag[0] == "a" && tag[1] == address && len(address) > 0 && deletion.CreatedAt >= ev.CreatedAt {
+				return true
+			}
+		}
+	}
+
+	return false
+}
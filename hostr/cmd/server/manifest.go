@@ -0,0 +1,312 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/consts"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/relays"
+)
+
+// マニフェストの取得を待つ時間
+const manifestQueryTimeout = 10 * time.Second
+
+// サイトのマニフェストと削除の確認結果をキャッシュする時間。リクエストのたびにリレーへ問い合わせないようにする
+const manifestCacheTTL = 30 * time.Second
+
+// キャッシュするエントリーの数の上限。超えた場合は期限切れのものを削除する
+const manifestCacheMaxEntries = 10000
+
+// マニフェストに記録されたファイル
+type manifestFile struct {
+	eventID string
+	url     string
+}
+
+// サイトのマニフェストから読み込んだファイルとルーティング
+type siteManifest struct {
+	identifier string
+	// リクエストされたURLでのサイトのルート
+	url       string
+	files     map[string]manifestFile
+	redirects []redirectRule
+	// 一致するファイルがないパスに返すファイル(SPAモード)
+	fallback string
+}
+
+// [pubkey]:[identifier]ごとのサイトのマニフェストと、イベントごとの削除の確認結果のキャッシュ
+type manifestCache struct {
+	// 見つからないか削除されている場合はnil
+	manifests *ttlCache[*nostr.Event]
+	// [event id]:[削除されているか]
+	deletions *ttlCache[bool]
+}
+
+func newManifestCache() *manifestCache {
+	return &manifestCache{
+		manifests: newTTLCache[*nostr.Event](manifestCacheTTL, manifestCacheMaxEntries),
+		deletions: newTTLCache[bool](manifestCacheTTL, manifestCacheMaxEntries),
+	}
+}
+
+// 期限内のキャッシュがあればokがtrueになる
+func (c *manifestCache) get(pubKey, identifier string) (*nostr.Event, bool) {
+	return c.manifests.get(pubKey + ":" + identifier)
+}
+
+func (c *manifestCache) set(pubKey, identifier string, manifest *nostr.Event) {
+	c.manifests.set(pubKey+":"+identifier, manifest)
+}
+
+// 削除リクエストをリレーに問い合わせ、結果をマニフェストと同じ期間キャッシュする
+func (c *manifestCache) isDeleted(ctx context.Context, pool *relays.Pool, relays []string, ev *nostr.Event) bool {
+	if deleted, ok := c.deletions.get(ev.ID); ok {
+		return deleted
+	}
+	deleted := isDeleted(ctx, pool, relays, ev)
+	c.deletions.set(ev.ID, deleted)
+	return deleted
+}
+
+// dタグに対応するファイルをマニフェスト経由で解決しレスポンスとして返す。
+// マニフェストが存在しない場合はdタグから直接イベントを取得する
+func respondReplaceable(ctx *gin.Context, pool *relays.Pool, manifests *manifestCache, relays []string, pubKey, dTag string) {
+	site := findSite(ctx, pool, manifests, relays, pubKey, dTag)
+	if site == nil {
+		// 以前のバージョンでデプロイされたサイト
+		ev, resolvedDTag := findReplaceableEvent(ctx, pool, relays, pubKey, dTag)
+		if ev != nil && manifests.isDeleted(ctx, pool, relays, ev) {
+			ctx.String(http.StatusGone, http.StatusText(http.StatusGone))
+			return
+		}
+		respondResolved(ctx, pool, relays, dTag, resolvedDTag, ev, "")
+		return
+	}
+
+	// マニフェストから解決したファイルは、マニフェストが削除されていなければ削除の確認を省く
+
+	path := "/" + strings.TrimPrefix(strings.TrimPrefix(dTag, site.identifier), "/")
+	site.url = strings.TrimSuffix(ctx.Request.URL.Path, dTag) + site.identifier
+
+	// !付きのルールは一致するファイルより優先する
+	if applyRedirects(ctx, pool, relays, pubKey, site, path, true) {
+		return
+	}
+
+	if candidate, file, ok := site.findFile(path); ok {
+		resolvedDTag := site.identifier
+		if candidate != "index.html" {
+			resolvedDTag = site.identifier + "/" + candidate
+		}
+
+		ev := fetchManifestFile(ctx, pool, relays, pubKey, file)
+		if ev == nil && len(file.url) < 1 {
+			// 以前のバージョンでは各ファイルもReplaceableなイベントだったので、置き換えられている場合はdタグから取得する
+			ev, resolvedDTag = findReplaceableEvent(ctx, pool, relays, pubKey, dTag)
+		}
+		respondResolved(ctx, pool, relays, dTag, resolvedDTag, ev, file.url)
+		return
+	}
+
+	if applyRedirects(ctx, pool, relays, pubKey, site, path, false) {
+		return
+	}
+
+	// SPAモードではアセット以外のパスにindex.htmlを返し、クライアント側でルーティングする
+	if len(site.fallback) > 0 && !isAssetPath(path) && respondSiteFile(ctx, pool, relays, pubKey, site, site.fallback, http.StatusOK) {
+		return
+	}
+
+	// サイトに404.htmlがあればそれを返す
+	if respondSiteFile(ctx, pool, relays, pubKey, site, notFoundPagePath, http.StatusNotFound) {
+		return
+	}
+
+	ctx.String(http.StatusNotFound, http.StatusText(http.StatusNotFound))
+}
+
+// 解決したイベントまたはメディアのURLをレスポンスとして返す
+func respondResolved(ctx *gin.Context, pool *relays.Pool, relays []string, dTag, resolvedDTag string, ev *nostr.Event, url string) {
+	// ディレクトリの場合はindex.htmlへリダイレクトする
+	if (ev != nil || len(url) > 0) && resolvedDTag != dTag {
+		ctx.Redirect(http.StatusFound, strings.TrimSuffix(ctx.Request.URL.Path, dTag)+resolvedDTag)
+		return
+	}
+
+	// アップロードされたメディアの場合はアップロード先へリダイレクトする
+	if len(url) > 0 {
+		ctx.Redirect(http.StatusFound, url)
+		return
+	}
+
+	if ev != nil {
+		respondEvent(ctx, pool, relays, ev)
+	} else {
+		ctx.String(http.StatusNotFound, http.StatusText(http.StatusNotFound))
+	}
+}
+
+// サイト内のファイルをURLを変えずにstatusで返す。ファイルが見つからない場合はfalseを返す
+func respondSiteFile(ctx *gin.Context, pool *relays.Pool, relays []string, pubKey string, site *siteManifest, path string, status int) bool {
+	candidate, file, ok := site.findFile(path)
+	if !ok {
+		return false
+	}
+
+	if len(file.url) > 0 {
+		ctx.Redirect(http.StatusFound, file.url)
+		return true
+	}
+
+	ev := fetchManifestFile(ctx, pool, relays, pubKey, file)
+	if ev == nil {
+		return false
+	}
+	// 本来のURLのディレクトリを基準に相対パスを解決させる
+	fileURL := site.url
+	if candidate != "index.html" {
+		fileURL = site.url + "/" + candidate
+	}
+	respondEventWithStatus(ctx, pool, relays, ev, status, fileURL[:strings.LastIndex(fileURL, "/")+1])
+	return true
+}
+
+// マニフェストに記録されたイベントを取得する。アップロードされたメディアの場合はnilを返す
+func fetchManifestFile(ctx context.Context, pool *relays.Pool, relays []string, pubKey string, file manifestFile) *nostr.Event {
+	if len(file.url) > 0 {
+		return nil
+	}
+	return pool.QuerySingle(ctx, relays, nostr.Filter{
+		IDs:     []string{file.eventID},
+		Authors: []string{pubKey},
+	})
+}
+
+// dタグを含むサイトのマニフェストを取得し、ファイルとルーティングを読み込む。
+// 見つからない場合はnilを返す
+func findSite(ctx context.Context, pool *relays.Pool, manifests *manifestCache, relays []string, pubKey, dTag string) *siteManifest {
+	manifest := findSiteManifest(ctx, pool, manifests, relays, pubKey, dTag)
+	if manifest == nil {
+		return nil
+	}
+
+	site := &siteManifest{
+		identifier: getDTag(manifest),
+		files:      map[string]manifestFile{},
+	}
+	for _, tag := range manifest.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+		switch tag[0] {
+		case "file":
+			if len(tag) < 3 {
+				continue
+			}
+			file := manifestFile{eventID: tag[2]}
+			if len(tag) > 4 {
+				file.url = tag[4]
+			}
+			site.files[tag[1]] = file
+		case "redirect":
+			if rule, ok := parseRedirectTag(tag); ok {
+				site.redirects = append(site.redirects, rule)
+			}
+		case "fallback":
+			site.fallback = tag[1]
+		}
+	}
+
+	return site
+}
+
+// サイト内のパスに対応するファイルを取得する。見つからない場合はディレクトリとみなしてindex.htmlを探す
+func (s *siteManifest) findFile(path string) (string, manifestFile, bool) {
+	path = strings.TrimPrefix(path, "/")
+	trimmed := strings.TrimSuffix(path, "/")
+	candidates := []string{path, trimmed}
+	if len(trimmed) < 1 {
+		candidates = append(candidates, "index.html")
+	} else {
+		candidates = append(candidates, trimmed+"/index.html")
+	}
+
+	for _, candidate := range candidates {
+		if file, ok := s.files[candidate]; ok {
+			return candidate, file, true
+		}
+	}
+	return "", manifestFile{}, false
+}
+
+// dタグのパスの各階層をidentifierの候補としてマニフェストを検索し、最も長く一致するものを返す。
+// 削除されたサイトのマニフェストは参照しない。キャッシュにない候補だけをリレーに問い合わせる
+func findSiteManifest(ctx context.Context, pool *relays.Pool, manifests *manifestCache, relays []string, pubKey, dTag string) *nostr.Event {
+	candidates := []string{}
+	segments := strings.Split(dTag, "/")
+	for i := range segments {
+		candidates = append(candidates, strings.Join(segments[:i+1], "/"))
+	}
+
+	found := map[string]*nostr.Event{}
+	uncached := []string{}
+	for _, candidate := range candidates {
+		if manifest, ok := manifests.get(pubKey, candidate); ok {
+			found[candidate] = manifest
+		} else {
+			uncached = append(uncached, candidate)
+		}
+	}
+
+	if len(uncached) > 0 {
+		queried := querySiteManifests(ctx, pool, relays, pubKey, uncached)
+		for _, candidate := range uncached {
+			manifest := queried[candidate]
+			if manifest != nil && manifests.isDeleted(ctx, pool, relays, manifest) {
+				manifest = nil
+			}
+			manifests.set(pubKey, candidate, manifest)
+			found[candidate] = manifest
+		}
+	}
+
+	// より深い階層のidentifierを優先する
+	for i := len(candidates) - 1; i >= 0; i-- {
+		if manifest := found[candidates[i]]; manifest != nil {
+			return manifest
+		}
+	}
+	return nil
+}
+
+// identifierごとに最新のサイトのマニフェストを取得する
+func querySiteManifests(ctx context.Context, pool *relays.Pool, relays []string, pubKey string, identifiers []string) map[string]*nostr.Event {
+	queryCtx, cancel := context.WithTimeout(ctx, manifestQueryTimeout)
+	defer cancel()
+
+	manifests := map[string]*nostr.Event{}
+	for ev := range pool.SubManyEose(queryCtx, relays, nostr.Filters{{
+		Kinds:   []int{consts.KindWebhostSiteManifest},
+		Authors: []string{pubKey},
+		Tags:    nostr.TagMap{"d": identifiers},
+	}}) {
+		identifier := getDTag(ev)
+		if current, ok := manifests[identifier]; !ok || ev.CreatedAt > current.CreatedAt {
+			manifests[identifier] = ev
+		}
+	}
+
+	return manifests
+}
+
+func getDTag(ev *nostr.Event) string {
+	dTag := ev.Tags.GetFirst([]string{"d", ""})
+	if dTag == nil {
+		return ""
+	}
+	return dTag.Value()
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/consts"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/relays"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/tools"
+)
+
+// チャンクの取得を待つ時間
+const chunkQueryTimeout = 30 * time.Second
+
+// イベントの内容をContent-Typeとともにレスポンスとして返す
+func respondEvent(ctx *gin.Context, pool *relays.Pool, relays []string, ev *nostr.Event) {
+	respondEventWithStatus(ctx, pool, relays, ev, http.StatusOK, "")
+}
+
+// イベントの内容をstatusで返す。
+// 404.htmlやSPAのように別のURLでHTMLを返す場合は、相対パスの参照が元のURLから解決されるようbaseHrefを<base>として挿入する
+func respondEventWithStatus(ctx *gin.Context, pool *relays.Pool, relays []string, ev *nostr.Event, status int, baseHref string) {
+	contentType, isTextFile, err := tools.GetContentType(ev)
+	if err != nil {
+		ctx.String(http.StatusNotFound, http.StatusText(http.StatusNotFound))
+		return
+	}
+
+	// チャンクに分割されたメディアの場合は組み立てて返す
+	chunkIDs := getChunkIDs(ev)
+	if len(chunkIDs) > 0 {
+		respondChunks(ctx, pool, relays, ev, contentType, chunkIDs, status)
+		return
+	}
+
+	// 書き換えるHTMLは展開してから返す
+	injectBase := len(baseHref) > 0 && strings.HasPrefix(contentType, "text/html")
+	acceptEncoding := ctx.GetHeader("Accept-Encoding")
+	if injectBase {
+		acceptEncoding = ""
+	}
+
+	// contentの変換
+	content, contentEncoding, err := tools.GetResponseContent(ev, isTextFile, acceptEncoding)
+	if err != nil {
+		ctx.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	if injectBase {
+		content = insertBaseElement(content, baseHref)
+	}
+
+	// 圧縮されたイベントの場合はクライアントによってレスポンスが変わる
+	if len(tools.GetContentEncoding(ev)) > 0 {
+		ctx.Header("Vary", "Accept-Encoding")
+	}
+	if len(contentEncoding) > 0 {
+		ctx.Header("Content-Encoding", contentEncoding)
+	}
+
+	ctx.Data(status, contentType, content)
+}
+
+// インデックスのイベントからチャンクのイベントIDを順番に取得する
+func getChunkIDs(ev *nostr.Event) []string {
+	chunkIDs := []string{}
+	for _, tag := range ev.Tags.GetAll([]string{"chunk"}) {
+		chunkIDs = append(chunkIDs, tag.Value())
+	}
+	return chunkIDs
+}
+
+// チャンクのイベントを取得し、順番にデコードしながらレスポンスに書き込む
+func respondChunks(ctx *gin.Context, pool *relays.Pool, relays []string, index *nostr.Event, contentType string, chunkIDs []string, status int) {
+	queryCtx, cancel := context.WithTimeout(ctx, chunkQueryTimeout)
+	defer cancel()
+
+	chunks := map[string]*nostr.Event{}
+	for ev := range pool.SubManyEose(queryCtx, relays, nostr.Filters{{
+		Kinds:   []int{consts.KindTextFile},
+		IDs:     chunkIDs,
+		Authors: []string{index.PubKey},
+	}}) {
+		chunks[ev.ID] = ev
+	}
+
+	for _, id := range chunkIDs {
+		if _, ok := chunks[id]; !ok {
+			fmt.Println("[Hostr] Missing chunk:", id)
+			ctx.String(http.StatusBadGateway, http.StatusText(http.StatusBadGateway))
+			return
+		}
+	}
+
+	ctx.Status(status)
+	ctx.Header("Content-Type", contentType)
+	if size := index.Tags.GetFirst([]string{"size"}); size != nil {
+		if _, err := strconv.Atoi(size.Value()); err == nil {
+			ctx.Header("Content-Length", size.Value())
+		}
+	}
+
+	for _, id := range chunkIDs {
+		content, _, err := tools.GetResponseContent(chunks[id], true, "")
+		if err != nil {
+			fmt.Println("[Hostr] Failed to decode chunk:", id, err)
+			return
+		}
+		_, err = ctx.Writer.Write(content)
+		if err != nil {
+			return
+		}
+		ctx.Writer.Flush()
+	}
+}
+
+// HTMLの<head>の直後に<base>を挿入する。既に<base>がある場合はそのまま返す
+func insertBaseElement(content []byte, baseHref string) []byte {
+	lower := bytes.ToLower(content)
+	if bytes.Contains(lower, []byte("<base")) {
+		return content
+	}
+
+	element := []byte(`<base href="` + html.EscapeString(baseHref) + `">`)
+	index := 0
+	if head := bytes.Index(lower, []byte("<head")); head >= 0 {
+		if end := bytes.IndexByte(lower[head:], '>'); end >= 0 {
+			index = head + end + 1
+		}
+	}
+
+	return slices.Concat(content[:index], element, content[index:])
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/relays"
+)
+
+// 一致するファイルもルールもないパスに返すページ
+const notFoundPagePath = "404.html"
+
+// デプロイ時に_redirectsから生成されたルール
+type redirectRule struct {
+	from   string
+	to     string
+	status int
+	// 一致するファイルがあってもルールを優先する
+	force bool
+}
+
+// ["redirect", 転送元, 転送先, ステータスコード] のタグを読み込む
+func parseRedirectTag(tag nostr.Tag) (redirectRule, bool) {
+	if len(tag) < 4 {
+		return redirectRule{}, false
+	}
+
+	code, force := strings.CutSuffix(tag[3], "!")
+	status, err := strconv.Atoi(code)
+	if err != nil {
+		return redirectRule{}, false
+	}
+
+	switch status {
+	case http.StatusOK, http.StatusNotFound,
+		http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return redirectRule{}, false
+	}
+
+	return redirectRule{from: tag[1], to: tag[2], status: status, force: force}, true
+}
+
+// サイト内のパスがルールの転送元に一致する場合、:placeholderと:splatを置き換えた転送先を返す
+func (r redirectRule) match(sitePath string) (string, bool) {
+	patternSegments := strings.Split(strings.Trim(r.from, "/"), "/")
+	pathSegments := strings.Split(strings.Trim(sitePath, "/"), "/")
+
+	params := map[string]string{}
+	for i, segment := range patternSegments {
+		// 末尾の*は残りの階層すべてに一致する
+		if segment == "*" && i == len(patternSegments)-1 {
+			if i < len(pathSegments) {
+				params["splat"] = strings.Join(pathSegments[i:], "/")
+			}
+			return r.destination(params), true
+		}
+		if i >= len(pathSegments) {
+			return "", false
+		}
+		if strings.HasPrefix(segment, ":") && len(pathSegments[i]) > 0 {
+			params[segment[1:]] = pathSegments[i]
+			continue
+		}
+		if segment != pathSegments[i] {
+			return "", false
+		}
+	}
+
+	if len(patternSegments) != len(pathSegments) {
+		return "", false
+	}
+	return r.destination(params), true
+}
+
+func (r redirectRule) destination(params map[string]string) string {
+	// :idと:identifierのように前方一致する名前があるので長い順に置き換える
+	names := []string{}
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return len(names[i]) > len(names[j]) })
+
+	to := r.to
+	for _, name := range names {
+		to = strings.ReplaceAll(to, ":"+name, params[name])
+	}
+	return strings.ReplaceAll(to, ":splat", "")
+}
+
+// forceが一致するルールを順に適用する。レスポンスを返した場合はtrueを返す
+func applyRedirects(ctx *gin.Context, pool *relays.Pool, relays []string, pubKey string, site *siteManifest, sitePath string, force bool) bool {
+	for _, rule := range site.redirects {
+		if rule.force != force {
+			continue
+		}
+		to, ok := rule.match(sitePath)
+		if !ok {
+			continue
+		}
+
+		// 200と404はURLを変えずにサイト内の別のファイルを返す
+		if rule.status == http.StatusOK || rule.status == http.StatusNotFound {
+			if respondSiteFile(ctx, pool, relays, pubKey, site, to, rule.status) {
+				return true
+			}
+			continue
+		}
+
+		if strings.HasPrefix(to, "/") {
+			to = site.url + to
+		}
+		ctx.Redirect(rule.status, to)
+		return true
+	}
+	return false
+}
+
+// 拡張子がありHTMLでないパスはSPAのルートではなくアセットとみなす
+func isAssetPath(sitePath string) bool {
+	ext := strings.ToLower(path.Ext(sitePath))
+	return len(ext) > 0 && ext != ".html" && ext != ".htm"
+}
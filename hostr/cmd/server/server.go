@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"slices"
 	"strings"
 	"time"
 
@@ -11,11 +12,16 @@ import (
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/nbd-wtf/go-nostr/nip19"
 	"github.com/studiokaiji/nostr-webhost/hostr/cmd/consts"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/keystore"
 	"github.com/studiokaiji/nostr-webhost/hostr/cmd/relays"
 	"github.com/studiokaiji/nostr-webhost/hostr/cmd/tools"
 )
 
-func Start(port string, mode string) {
+// neventに含まれるリレーのヒントのうち問い合わせに使う数
+const maxRelayHints = 3
+
+// authKeyを指定した場合はNIP-42のAUTHを要求するリレーにその鍵で認証する
+func Start(port string, mode string, authKey string) {
 	ctx := context.Background()
 
 	allRelays, err := relays.GetAllRelays()
@@ -23,7 +29,19 @@ func Start(port string, mode string) {
 		panic(err)
 	}
 
-	pool := nostr.NewSimplePool(ctx)
+	// 不正な鍵は最初のAUTHではなく起動時にエラーにする
+	var authSigner keystore.Signer
+	if len(authKey) > 0 {
+		authKey, err = keystore.DecodeSecretKey(authKey)
+		if err != nil {
+			panic(err)
+		}
+		authSigner = keystore.NewKeySigner(authKey)
+	}
+
+	// authSignerがある場合はAUTHを要求するリレーに接続時に認証し、その接続を使い回す
+	pool := relays.NewPool(ctx, authSigner)
+	manifests := newManifestCache()
 
 	r := gin.Default()
 
@@ -96,6 +114,8 @@ func Start(port string, mode string) {
 		}
 
 		ids := []string{}
+		// neventのリレーのヒントはこのリクエストだけで使う
+		reqRelays := allRelays
 
 		// neventからIDを取得
 		if hexOrNevent[0:6] == "nevent" {
@@ -112,7 +132,7 @@ func Start(port string, mode string) {
 			}
 
 			ids = append(ids, data.ID)
-			allRelays = append(allRelays, data.Relays...)
+			reqRelays = append(slices.Clone(allRelays), data.Relays[:min(len(data.Relays), maxRelayHints)]...)
 		} else {
 			ids = append(ids, hexOrNevent)
 		}
@@ -131,22 +151,17 @@ func Start(port string, mode string) {
 		}
 
 		// Poolからデータを取得する
-		ev := pool.QuerySingle(ctx, allRelays, filter)
-		if ev != nil {
-			contentType, isTextFile, err := tools.GetContentType(ev)
-			if err != nil {
-				ctx.String(http.StatusNotFound, http.StatusText(http.StatusNotFound))
-			}
-
-			content, err := tools.GetResponseContent(ev.Content, isTextFile)
-			if err != nil {
-				ctx.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
-			} else {
-				ctx.Data(http.StatusOK, contentType, content)
-			}
-		} else {
+		ev := pool.QuerySingle(ctx, reqRelays, filter)
+		if ev == nil {
 			ctx.String(http.StatusNotFound, http.StatusText(http.StatusNotFound))
+			return
+		}
+		// 作成者が削除したイベントは返さない
+		if manifests.isDeleted(ctx, pool, reqRelays, ev) {
+			ctx.String(http.StatusGone, http.StatusText(http.StatusGone))
+			return
 		}
+		respondEvent(ctx, pool, reqRelays, ev)
 	})
 
 	if mode != "secure" {
@@ -159,44 +174,12 @@ func Start(port string, mode string) {
 				return
 			}
 
-			authors := []string{pubKey}
-
-			// dTagを取得しFilterに追加
+			// dTagを取得
 			// dTagの最初は`/`ではじまるのでそれをslice
 			dTag := ctx.Param("dTag")[1:]
 
-			tags := nostr.TagMap{}
-			tags["d"] = []string{dTag}
-
 			// Poolからデータを取得する
-			ev := pool.QuerySingle(ctx, allRelays, nostr.Filter{
-				Kinds: []int{
-					consts.KindWebhostReplaceableHTML,
-					consts.KindWebhostReplaceableCSS,
-					consts.KindWebhostReplaceableJS,
-					consts.KindReplaceableTextFile,
-				},
-				Authors: authors,
-				Tags:    tags,
-			})
-			if ev != nil {
-				contentType, isTextFile, err := tools.GetContentType(ev)
-				if err != nil {
-					ctx.String(http.StatusNotFound, http.StatusText(http.StatusNotFound))
-				}
-
-				// contentの変換
-				content, err := tools.GetResponseContent(ev.Content, isTextFile)
-				if err != nil {
-					ctx.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
-				} else {
-					ctx.Data(http.StatusOK, contentType, content)
-				}
-			} else {
-				ctx.String(http.StatusNotFound, http.StatusText(http.StatusNotFound))
-			}
-
-			return
+			respondReplaceable(ctx, pool, manifests, allRelays, pubKey, dTag)
 		})
 
 	}
@@ -213,44 +196,46 @@ func Start(port string, mode string) {
 				return
 			}
 
-			authors := []string{pubKey}
-
-			// dTagを取得しFilterに追加
+			// dTagを取得
 			// dTagの最初は`/`ではじまるのでそれをslice
 			dTag := ctx.Param("dTag")[1:]
 
-			tags := nostr.TagMap{}
-			tags["d"] = []string{dTag}
-
 			// Poolからデータを取得する
-			ev := pool.QuerySingle(ctx, allRelays, nostr.Filter{
-				Kinds: []int{
-					consts.KindWebhostReplaceableHTML,
-					consts.KindWebhostReplaceableCSS,
-					consts.KindWebhostReplaceableJS,
-					consts.KindReplaceableTextFile,
-				},
-				Authors: authors,
-				Tags:    tags,
-			})
-
-			if ev != nil {
-				contentType, isTextFile, err := tools.GetContentType(ev)
-				if err != nil {
-					ctx.String(http.StatusNotFound, http.StatusText(http.StatusNotFound))
-				}
-
-				content, err := tools.GetResponseContent(ev.Content, isTextFile)
-				if err != nil {
-					ctx.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
-				} else {
-					ctx.Data(http.StatusOK, contentType, content)
-				}
-			} else {
-				ctx.String(http.StatusNotFound, http.StatusText(http.StatusNotFound))
-			}
+			respondReplaceable(ctx, pool, manifests, allRelays, pubKey, dTag)
 		})
 	}
 
 	r.Run(":" + port)
 }
+
+// dタグからReplaceableなイベントを取得する。
+// 見つからない場合はディレクトリとみなしてindex.htmlを探し、見つかったイベントのdタグを返す
+func findReplaceableEvent(ctx context.Context, pool *relays.Pool, relays []string, pubKey, dTag string) (*nostr.Event, string) {
+	candidates := []string{dTag}
+	trimmed := strings.TrimSuffix(dTag, "/")
+	if trimmed != dTag {
+		candidates = append(candidates, trimmed)
+	}
+	candidates = append(candidates, trimmed+"/index.html")
+
+	for _, candidate := range candidates {
+		tags := nostr.TagMap{}
+		tags["d"] = []string{candidate}
+
+		ev := pool.QuerySingle(ctx, relays, nostr.Filter{
+			Kinds: []int{
+				consts.KindWebhostReplaceableHTML,
+				consts.KindWebhostReplaceableCSS,
+				consts.KindWebhostReplaceableJS,
+				consts.KindReplaceableTextFile,
+			},
+			Authors: []string{pubKey},
+			Tags:    tags,
+		})
+		if ev != nil {
+			return ev, candidate
+		}
+	}
+
+	return nil, dTag
+}
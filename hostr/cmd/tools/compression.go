@@ -0,0 +1,101 @@
+package tools
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	EncodingGzip   = "gzip"
+	EncodingBrotli = "br"
+)
+
+// 展開後の最大サイズ。ゲートウェイは第三者のイベントを展開するので、圧縮爆弾でメモリを使い切らないよう制限する
+const MaxDecompressedSize = 64 << 20
+
+// ErrDecompressedTooLarge は展開後のサイズがMaxDecompressedSizeを超える場合のエラー
+var ErrDecompressedTooLarge = fmt.Errorf("decompressed content exceeds %d bytes", MaxDecompressedSize)
+
+// contentを指定されたエンコーディングで圧縮する
+func Compress(content []byte, encoding string) ([]byte, error) {
+	var buf bytes.Buffer
+	var writer io.WriteCloser
+
+	switch encoding {
+	case EncodingGzip:
+		gzipWriter, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+		if err != nil {
+			return nil, err
+		}
+		writer = gzipWriter
+	case EncodingBrotli:
+		writer = brotli.NewWriterLevel(&buf, brotli.BestCompression)
+	default:
+		return nil, fmt.Errorf("Unsupported encoding: %s", encoding)
+	}
+
+	if _, err := writer.Write(content); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// 圧縮されたcontentを展開する。展開後のサイズがMaxDecompressedSizeを超える場合はエラーを返す
+func Decompress(content []byte, encoding string) ([]byte, error) {
+	var reader io.Reader
+
+	switch encoding {
+	case EncodingGzip:
+		gzipReader, err := gzip.NewReader(bytes.NewReader(content))
+		if err != nil {
+			return nil, err
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	case EncodingBrotli:
+		reader = brotli.NewReader(bytes.NewReader(content))
+	default:
+		return nil, fmt.Errorf("Unsupported encoding: %s", encoding)
+	}
+
+	decompressed, err := io.ReadAll(io.LimitReader(reader, MaxDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(decompressed) > MaxDecompressedSize {
+		return nil, ErrDecompressedTooLarge
+	}
+	return decompressed, nil
+}
+
+// Accept-Encodingヘッダーがencodingを受け付けるか判定する
+func AcceptsEncoding(acceptEncoding, encoding string) bool {
+	for _, value := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(value, ";")
+		name := strings.TrimSpace(params[0])
+		if name != encoding && name != "*" {
+			continue
+		}
+
+		// q=0の場合は受け付けない
+		accepted := true
+		for _, param := range params[1:] {
+			q, found := strings.CutPrefix(strings.TrimSpace(param), "q=")
+			if weight, err := strconv.ParseFloat(q, 64); found && err == nil && weight <= 0 {
+				accepted = false
+			}
+		}
+		return accepted
+	}
+	return false
+}
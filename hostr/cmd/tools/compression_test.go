@@ -0,0 +1,61 @@
+package tools
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Compressは最高圧縮率で遅いので、大きなcontentは最速の設定で圧縮する
+func compressFast(t *testing.T, content []byte, encoding string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	var writer io.WriteCloser
+	if encoding == EncodingGzip {
+		writer, _ = gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+	} else {
+		writer = brotli.NewWriterLevel(&buf, brotli.BestSpeed)
+	}
+	if _, err := writer.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecompressRoundTrip(t *testing.T) {
+	content := []byte("<!DOCTYPE html><html><body>hello</body></html>")
+
+	for _, encoding := range []string{EncodingGzip, EncodingBrotli} {
+		compressed, err := Compress(content, encoding)
+		if err != nil {
+			t.Fatalf("Compress(%s) error = %v", encoding, err)
+		}
+		decompressed, err := Decompress(compressed, encoding)
+		if err != nil {
+			t.Fatalf("Decompress(%s) error = %v", encoding, err)
+		}
+		if !bytes.Equal(decompressed, content) {
+			t.Errorf("Decompress(%s) = %q, want %q", encoding, decompressed, content)
+		}
+	}
+}
+
+func TestDecompressRejectsTooLargeContent(t *testing.T) {
+	// 数十KBに圧縮される、上限を1バイト超えるcontent
+	bomb := make([]byte, MaxDecompressedSize+1)
+
+	for _, encoding := range []string{EncodingGzip, EncodingBrotli} {
+		compressed := compressFast(t, bomb, encoding)
+		if _, err := Decompress(compressed, encoding); !errors.Is(err, ErrDecompressedTooLarge) {
+			t.Errorf("Decompress(%s) error = %v, want ErrDecompressedTooLarge", encoding, err)
+		}
+	}
+}
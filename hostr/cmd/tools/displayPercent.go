@@ -2,43 +2,46 @@ package tools
 
 import (
 	"fmt"
+	"io"
+	"os"
+	"strings"
 	"time"
 
 	"golang.org/x/term"
 )
 
-func DisplayProgressBar(current, total *int) {
+// IsTerminal はwがターミナルで、進捗バーを\rで上書きして描画できるかどうかを返す
+func IsTerminal(w io.Writer) bool {
+	file, ok := w.(*os.File)
+	return ok && term.IsTerminal(int(file.Fd()))
+}
+
+// DisplayProgressBar は進捗がtotalに達するまでwに進捗バーを描画する。
+// progressは描画のたびに呼ばれ、その時点の進捗とtotalを返す
+func DisplayProgressBar(w io.Writer, progress func() (int, int)) {
 	// ターミナルのサイズを取得
-	terminalWidth, _, err := term.GetSize(0)
-	if err != nil {
-		terminalWidth = 80
+	terminalWidth := 80
+	if file, ok := w.(*os.File); ok {
+		if width, _, err := term.GetSize(int(file.Fd())); err == nil {
+			terminalWidth = width
+		}
 	}
 
-	width := terminalWidth - 12
-
 	// ターミナルの幅を最大100として調整
-	if width > 100 {
-		width = 100
-	}
+	width := min(max(terminalWidth-12, 0), 100)
 
 	for {
-		progress := int(float64(*current) / float64(*total) * float64(width))
-
-		// バーの描画
-		bar := ""
-		for j := 0; j < width; j++ {
-			if j < progress {
-				bar += "="
-			} else {
-				bar += " "
-			}
+		current, total := progress()
+		filled := width
+		if total > 0 {
+			filled = min(current*width/total, width)
 		}
 
 		// カーソルを行の先頭に戻して上書き
-		fmt.Printf("\r[%s] %d/%d", bar, *current, *total)
+		fmt.Fprintf(w, "\r[%s%s] %d/%d", strings.Repeat("=", filled), strings.Repeat(" ", width-filled), current, total)
 
-		if *current >= *total {
-			fmt.Println("")
+		if current >= total {
+			fmt.Fprintln(w, "")
 			break
 		}
 
@@ -2,6 +2,7 @@ package tools
 
 import (
 	"fmt"
+	"path"
 
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/studiokaiji/nostr-webhost/hostr/cmd/consts"
@@ -12,8 +13,17 @@ func GetContentType(event *nostr.Event) (string, bool, error) {
 	kind := event.Kind
 
 	if kind == consts.KindTextFile || kind == consts.KindReplaceableTextFile {
-		contentTypeTag := event.Tags.GetFirst([]string{"type"})
-		contentType := contentTypeTag.Value()
+		contentType := ""
+		if contentTypeTag := event.Tags.GetFirst([]string{"type"}); contentTypeTag != nil {
+			contentType = contentTypeTag.Value()
+		}
+
+		// typeタグがない場合はdタグのファイル名から判定する
+		if len(contentType) < 1 {
+			if dTag := event.Tags.GetFirst([]string{"d"}); dTag != nil && len(path.Ext(dTag.Value())) > 0 {
+				contentType = DetectFileTypeByExtension(dTag.Value()).ContentType
+			}
+		}
 
 		if len(contentType) < 1 {
 			return "", true, fmt.Errorf("Content-Type not specified")
@@ -2,13 +2,44 @@ package tools
 
 import (
 	"encoding/base64"
+
+	"github.com/nbd-wtf/go-nostr"
 )
 
-func GetResponseContent(eventContent string, isTextFile bool) ([]byte, error) {
-	if isTextFile {
-		// NIP-95ファイル(Text File)の場合はbase64エンコードされているのでdecodeする
-		return base64.StdEncoding.DecodeString(eventContent)
-	} else {
-		return []byte(eventContent), nil
+// イベントのcontentの圧縮形式をencodingタグから取得する
+func GetContentEncoding(event *nostr.Event) string {
+	encodingTag := event.Tags.GetFirst([]string{"encoding"})
+	if encodingTag == nil {
+		return ""
+	}
+	return encodingTag.Value()
+}
+
+// イベントのcontentをレスポンスの本文に変換する。
+// 圧縮されている場合はacceptEncodingが受け付けるならそのまま返し、第二引数にContent-Encodingを返す。受け付けない場合は展開して返す
+func GetResponseContent(event *nostr.Event, isTextFile bool, acceptEncoding string) ([]byte, string, error) {
+	encoding := GetContentEncoding(event)
+
+	if len(encoding) < 1 {
+		if isTextFile {
+			// NIP-95ファイル(Text File)の場合はbase64エンコードされているのでdecodeする
+			content, err := base64.StdEncoding.DecodeString(event.Content)
+			return content, "", err
+		} else {
+			return []byte(event.Content), "", nil
+		}
 	}
+
+	// 圧縮されている場合はkindに関わらずbase64エンコードされている
+	content, err := base64.StdEncoding.DecodeString(event.Content)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if AcceptsEncoding(acceptEncoding, encoding) {
+		return content, encoding, nil
+	}
+
+	content, err = Decompress(content, encoding)
+	return content, "", err
 }
@@ -0,0 +1,192 @@
+package tools
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"strings"
+)
+
+const (
+	HostrIgnoreFileName = ".hostrignore"
+	GitIgnoreFileName   = ".gitignore"
+	// サイトのマニフェストにルーティングのルールとして記録し、ファイルとしては公開しない
+	RedirectsFileName = "_redirects"
+)
+
+// IgnoreOptions はデプロイ対象から除外するファイルの指定
+type IgnoreOptions struct {
+	// サイトルートの.gitignoreも.hostrignoreと同様に扱う
+	GitIgnore bool
+	// ドットで始まるファイルとディレクトリも対象にする
+	IncludeHidden bool
+	// hostr.tomlで指定されたパターン。.hostrignoreより前に適用する
+	Patterns []string
+}
+
+// IgnoredFile は除外されたファイルとその理由
+type IgnoredFile struct {
+	Path   string
+	Reason string
+}
+
+// gitignoreの1行分のパターン
+type ignorePattern struct {
+	source  string
+	negate  bool
+	dirOnly bool
+	regexp  *regexp.Regexp
+}
+
+// サイトルートに適用される除外パターン。後のパターンほど優先される
+type ignoreRules struct {
+	patterns []*ignorePattern
+}
+
+// fsysのサイトルートの除外パターンを読み込む
+func loadIgnoreRules(fsys fs.FS, options IgnoreOptions) (*ignoreRules, error) {
+	rules := &ignoreRules{}
+	// 隠しファイルは既定で除外するが、.hostrignoreの!パターンで再度含めることができる
+	if !options.IncludeHidden {
+		rules.patterns = append(rules.patterns, compileIgnorePattern(".*", "hidden"))
+	}
+	// サイトのディレクトリがプロジェクトルートの場合でも設定ファイルは公開しない
+	rules.patterns = append(rules.patterns, compileIgnorePattern("/hostr.toml", "project config"))
+	rules.patterns = append(rules.patterns, compileIgnorePattern("/"+RedirectsFileName, "routing rules"))
+
+	for _, line := range options.Patterns {
+		if pattern := compileIgnorePattern(line, "hostr.toml: "+line); pattern != nil {
+			rules.patterns = append(rules.patterns, pattern)
+		}
+	}
+
+	fileNames := []string{}
+	if options.GitIgnore {
+		fileNames = append(fileNames, GitIgnoreFileName)
+	}
+	fileNames = append(fileNames, HostrIgnoreFileName)
+
+	for _, fileName := range fileNames {
+		file, err := fsys.Open(fileName)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(file)
+		for lineNumber := 1; scanner.Scan(); lineNumber++ {
+			line := strings.TrimRight(scanner.Text(), " \t\r")
+			if len(line) < 1 || strings.HasPrefix(line, "#") {
+				continue
+			}
+			source := fmt.Sprintf("%s:%d: %s", fileName, lineNumber, line)
+			if pattern := compileIgnorePattern(line, source); pattern != nil {
+				rules.patterns = append(rules.patterns, pattern)
+			}
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return rules, nil
+}
+
+// gitignoreのパターンを正規表現に変換する
+func compileIgnorePattern(line, source string) *ignorePattern {
+	pattern := &ignorePattern{source: source}
+
+	if strings.HasPrefix(line, "!") {
+		pattern.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		pattern.dirOnly = true
+		line = strings.TrimSuffix(line, "/")
+	}
+	if len(line) < 1 {
+		return nil
+	}
+
+	// 途中にスラッシュを含むパターンはサイトルートからの相対パス、含まないものは任意の階層の名前にマッチする
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+
+	var expr strings.Builder
+	if anchored {
+		expr.WriteString("^")
+	} else {
+		expr.WriteString("^(?:.*/)?")
+	}
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case strings.HasPrefix(line[i:], "**/"):
+			expr.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(line[i:], "**") && i+2 == len(line):
+			expr.WriteString(".*")
+			i++
+		case c == '*':
+			expr.WriteString("[^/]*")
+		case c == '?':
+			expr.WriteString("[^/]")
+		case c == '\\' && i+1 < len(line):
+			i++
+			expr.WriteString(regexp.QuoteMeta(string(line[i])))
+		case c == '[':
+			end := strings.IndexByte(line[i+1:], ']')
+			if end < 0 {
+				expr.WriteString(`\[`)
+				continue
+			}
+			class := line[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString("$")
+
+	compiled, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil
+	}
+	pattern.regexp = compiled
+	return pattern
+}
+
+// サイトルートからの相対パスが除外されるかどうかと、その理由を返す。
+// gitignoreと同様に、除外されたディレクトリ以下のファイルは再度含めることができない
+func (r *ignoreRules) match(relPath string, isDir bool) (bool, string) {
+	segments := strings.Split(relPath, "/")
+	for i := range segments {
+		current := strings.Join(segments[:i+1], "/")
+		currentIsDir := isDir || i < len(segments)-1
+
+		ignored, reason := false, ""
+		for _, pattern := range r.patterns {
+			if pattern.dirOnly && !currentIsDir {
+				continue
+			}
+			if pattern.regexp.MatchString(current) {
+				ignored, reason = !pattern.negate, pattern.source
+			}
+		}
+		if ignored {
+			return true, reason
+		}
+	}
+	return false, ""
+}
@@ -0,0 +1,157 @@
+package tools
+
+import (
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// ファイルをどのようにデプロイするか
+const (
+	// 参照を書き換えてHTML/CSS/JSのkindで公開する
+	FileClassPage = "page"
+	// NIP-95のイベントとしてリレーに保存する
+	FileClassText = "text"
+	// アップロード先、またはMediaModeRelayの場合はNIP-95のイベントとして保存する
+	FileClassMedia = "media"
+)
+
+// FileType はファイルのContent-Typeとデプロイ方法
+type FileType struct {
+	ContentType string
+	Class       string
+}
+
+// 標準ライブラリのmimeパッケージではOSによって結果が異なる、または登録されていない拡張子
+var builtinMimeTypes = map[string]string{
+	".html":        "text/html; charset=utf-8",
+	".htm":         "text/html; charset=utf-8",
+	".css":         "text/css; charset=utf-8",
+	".js":          "text/javascript; charset=utf-8",
+	".mjs":         "text/javascript; charset=utf-8",
+	".json":        "application/json",
+	".map":         "application/json",
+	".webmanifest": "application/manifest+json",
+	".wasm":        "application/wasm",
+	".txt":         "text/plain; charset=utf-8",
+	".md":          "text/markdown; charset=utf-8",
+	".csv":         "text/csv; charset=utf-8",
+	".xml":         "application/xml",
+	".yaml":        "application/yaml",
+	".yml":         "application/yaml",
+	".svg":         "image/svg+xml",
+	".ico":         "image/x-icon",
+	".avif":        "image/avif",
+	".webp":        "image/webp",
+	".woff":        "font/woff",
+	".woff2":       "font/woff2",
+	".ttf":         "font/ttf",
+	".otf":         "font/otf",
+	".pdf":         "application/pdf",
+	".mp4":         "video/mp4",
+	".webm":        "video/webm",
+	".mp3":         "audio/mpeg",
+}
+
+// MimeTypes はhostr.tomlの[mime]で指定された[拡張子またはファイル名]:[Content-Type]。
+// nilの場合は組み込みの判定のみ使う
+type MimeTypes struct {
+	overrides map[string]string
+}
+
+// NewMimeTypes は拡張子(".foo")またはファイル名("CNAME")ごとのContent-Typeを設定する
+func NewMimeTypes(overrides map[string]string) *MimeTypes {
+	m := &MimeTypes{overrides: map[string]string{}}
+	for key, contentType := range overrides {
+		if strings.HasPrefix(key, ".") {
+			key = strings.ToLower(key)
+		}
+		m.overrides[key] = contentType
+	}
+	return m
+}
+
+// 参照を書き換えてHTML/CSS/JSのkindで公開する拡張子と、その正規化した拡張子
+var pageExts = map[string]string{
+	".html": ".html",
+	".htm":  ".html",
+	".css":  ".css",
+	".js":   ".js",
+	".mjs":  ".js",
+}
+
+// PageExt はHTML/CSS/JSとして公開するファイルの拡張子を".html"・".css"・".js"のいずれかに正規化して返す。
+// 大文字の拡張子も対象にする。それ以外のファイルの場合は空文字を返す
+func PageExt(filePath string) string {
+	return pageExts[strings.ToLower(filepath.Ext(filePath))]
+}
+
+// DetectFileType はfsys内のファイルのContent-Typeとデプロイ方法を返す。
+// hostr.tomlの指定、組み込みの表、標準ライブラリ、ファイル先頭の内容の順に判定する
+func (m *MimeTypes) DetectFileType(fsys fs.FS, filePath string) FileType {
+	return detectFileType(m, filePath, func() (io.ReadCloser, error) {
+		return fsys.Open(filePath)
+	})
+}
+
+// DetectFileTypeByExtension はパスの拡張子だけからContent-Typeとデプロイ方法を組み込みの判定で返す。
+// ファイルを読まないので、リレーから受け取ったdタグなど信頼できないパスにも使える
+func DetectFileTypeByExtension(filePath string) FileType {
+	return detectFileType(nil, filePath, nil)
+}
+
+// openがnilの場合は拡張子から判定できなくてもファイルの内容を読まない
+func detectFileType(m *MimeTypes, filePath string, open func() (io.ReadCloser, error)) FileType {
+	ext := strings.ToLower(filepath.Ext(filePath))
+	contentType := m.detectContentType(filePath, ext, open)
+
+	class := FileClassText
+	switch {
+	case len(PageExt(filePath)) > 0:
+		class = FileClassPage
+	case strings.HasPrefix(contentType, "image/") && !strings.HasPrefix(contentType, "image/svg"),
+		strings.HasPrefix(contentType, "video/"),
+		strings.HasPrefix(contentType, "audio/"):
+		class = FileClassMedia
+	}
+
+	return FileType{ContentType: contentType, Class: class}
+}
+
+func (m *MimeTypes) detectContentType(filePath, ext string, open func() (io.ReadCloser, error)) string {
+	if m != nil {
+		contentType, ok := m.overrides[filepath.Base(filePath)]
+		if !ok && len(ext) > 0 {
+			contentType, ok = m.overrides[ext]
+		}
+		if ok {
+			return contentType
+		}
+	}
+
+	if contentType, ok := builtinMimeTypes[ext]; ok {
+		return contentType
+	}
+	if len(ext) > 0 {
+		if contentType := mime.TypeByExtension(ext); len(contentType) > 0 {
+			return contentType
+		}
+	}
+
+	if open == nil {
+		return "application/octet-stream"
+	}
+
+	// 拡張子から判定できない場合は先頭512バイトから推測する
+	file, err := open()
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer file.Close()
+	head := make([]byte, 512)
+	n, _ := file.Read(head)
+	return http.DetectContentType(head[:n])
+}
@@ -0,0 +1,63 @@
+package tools
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+func TestDetectFileTypeClass(t *testing.T) {
+	tests := map[string]string{
+		"index.html":        FileClassPage,
+		"INDEX.HTML":        FileClassPage,
+		"about.htm":         FileClassPage,
+		"style.CSS":         FileClassPage,
+		"main.js":           FileClassPage,
+		"module.mjs":        FileClassPage,
+		"data.json":         FileClassText,
+		"logo.PNG":          FileClassMedia,
+		"icon.svg":          FileClassText,
+		"movie.mp4":         FileClassMedia,
+		"archive.unknownxx": FileClassText,
+	}
+	for filePath, want := range tests {
+		if got := DetectFileTypeByExtension(filePath).Class; got != want {
+			t.Errorf("DetectFileTypeByExtension(%q).Class = %q, want %q", filePath, got, want)
+		}
+	}
+}
+
+func TestPageExt(t *testing.T) {
+	tests := map[string]string{
+		"a/INDEX.HTML": ".html",
+		"about.htm":    ".html",
+		"style.css":    ".css",
+		"module.mjs":   ".js",
+		"app.JS":       ".js",
+		"data.json":    "",
+		"README":       "",
+	}
+	for filePath, want := range tests {
+		if got := PageExt(filePath); got != want {
+			t.Errorf("PageExt(%q) = %q, want %q", filePath, got, want)
+		}
+	}
+}
+
+// 拡張子から判定できないファイルは、サイトのファイルなら内容から推測し、パスだけの場合は推測しない
+func TestDetectFileTypeSniffing(t *testing.T) {
+	fsys := fstest.MapFS{
+		"CNAME": {Data: []byte("example.com\n")},
+		"image": {Data: []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR")},
+	}
+	mimeTypes := NewMimeTypes(map[string]string{"CNAME": "text/plain"})
+
+	if got := mimeTypes.DetectFileType(fsys, "CNAME").ContentType; got != "text/plain" {
+		t.Errorf("CNAME ContentType = %q, want text/plain", got)
+	}
+	if got := mimeTypes.DetectFileType(fsys, "image"); got.ContentType != "image/png" || got.Class != FileClassMedia {
+		t.Errorf("image = %+v, want image/png media", got)
+	}
+	if got := DetectFileTypeByExtension("image").ContentType; got != "application/octet-stream" {
+		t.Errorf("DetectFileTypeByExtension(image).ContentType = %q, want application/octet-stream", got)
+	}
+}
@@ -0,0 +1,134 @@
+package tools
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// SiteFiles はデプロイするサイトのファイル。除外パターンは作成時に1度だけ読み込む
+type SiteFiles struct {
+	fsys fs.FS
+	// ローカルのディレクトリから読み込む場合のパス。シンボリックリンクがサイトルートの外を指していないか確認する
+	root  string
+	rules *ignoreRules
+}
+
+// NewSiteFiles はfsysをサイトルートとし、除外パターンを読み込む
+func NewSiteFiles(fsys fs.FS, options IgnoreOptions) (*SiteFiles, error) {
+	rules, err := loadIgnoreRules(fsys, options)
+	if err != nil {
+		return nil, err
+	}
+	return &SiteFiles{fsys: fsys, rules: rules}, nil
+}
+
+// NewDirSiteFiles はローカルのディレクトリをサイトルートとし、除外パターンを読み込む
+func NewDirSiteFiles(dir string, options IgnoreOptions) (*SiteFiles, error) {
+	files, err := NewSiteFiles(os.DirFS(dir), options)
+	if err != nil {
+		return nil, err
+	}
+	files.root = dir
+	return files, nil
+}
+
+// FS はサイトルートのファイルシステムを返す
+func (s *SiteFiles) FS() fs.FS {
+	return s.fsys
+}
+
+// IsIgnored はサイトルートからの相対パスのファイルがデプロイ対象から除外されるかどうかを返す
+func (s *SiteFiles) IsIgnored(relPath string) bool {
+	relPath = path.Clean(relPath)
+	info, err := fs.Stat(s.fsys, relPath)
+	if ignored, _ := s.rules.match(relPath, err == nil && info.IsDir()); ignored {
+		return true
+	}
+	return s.isOutsideRoot(relPath)
+}
+
+// Walk はサイトルート以下の除外されないファイルをfnに、除外されたファイルとディレクトリをignoredに渡す。
+// パスはサイトルートからのスラッシュ区切りの相対パス
+func (s *SiteFiles) Walk(fn func(path string), ignored func(IgnoredFile)) error {
+	return fs.WalkDir(s.fsys, ".", func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if filePath == "." {
+			return nil
+		}
+
+		if ok, reason := s.rules.match(filePath, entry.IsDir()); ok {
+			ignored(IgnoredFile{Path: filePath, Reason: reason})
+			if entry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		// サイトルートの外を指すシンボリックリンクは公開しない
+		if entry.Type()&fs.ModeSymlink != 0 {
+			if s.isOutsideRoot(filePath) {
+				ignored(IgnoredFile{Path: filePath, Reason: "symlink outside site root"})
+				return nil
+			}
+			// ディレクトリへのシンボリックリンクは辿らない
+			if targetInfo, err := fs.Stat(s.fsys, filePath); err != nil || targetInfo.IsDir() {
+				return nil
+			}
+		}
+
+		if !entry.IsDir() {
+			fn(filePath)
+		}
+		return nil
+	})
+}
+
+// Find はfilterがtrueを返すファイルのサイトルートからの相対パスを返す
+func (s *SiteFiles) Find(filter func(path string) bool) ([]string, error) {
+	filePaths := []string{}
+	err := s.Walk(func(path string) {
+		if filter(path) {
+			filePaths = append(filePaths, path)
+		}
+	}, func(IgnoredFile) {})
+	if err != nil {
+		return nil, err
+	}
+	return filePaths, nil
+}
+
+// Ignored はデプロイ対象から除外されるファイルとディレクトリを返す
+func (s *SiteFiles) Ignored() ([]IgnoredFile, error) {
+	ignoredFiles := []IgnoredFile{}
+	err := s.Walk(func(string) {}, func(file IgnoredFile) {
+		ignoredFiles = append(ignoredFiles, file)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ignoredFiles, nil
+}
+
+// シンボリックリンクを解決した結果がサイトルートの外を指しているかどうか。
+// ローカルのディレクトリでない場合はfs.FSの外を参照できないので常にfalse
+func (s *SiteFiles) isOutsideRoot(relPath string) bool {
+	if len(s.root) < 1 {
+		return false
+	}
+
+	root, err := filepath.EvalSymlinks(s.root)
+	if err != nil {
+		return true
+	}
+	target, err := filepath.EvalSymlinks(filepath.Join(s.root, filepath.FromSlash(relPath)))
+	if err != nil {
+		return true
+	}
+	rel, err := filepath.Rel(root, target)
+	return err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/deploy"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/keystore"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/relays"
+)
+
+// 現在のプロファイルの鍵とリレーでDeployerを作成する
+func newDeployer(options deploy.Options, log io.Writer) (*deploy.Deployer, error) {
+	signer, err := keystore.GetSigner()
+	if err != nil {
+		fmt.Fprintln(log, "❌ Failed to get signer:", err)
+		return nil, err
+	}
+
+	allRelays, err := relays.GetAllRelays()
+	if err != nil {
+		fmt.Fprintln(log, "❌ Failed to get all relays:", err)
+		return nil, err
+	}
+
+	return &deploy.Deployer{
+		Signer:  signer,
+		Relays:  allRelays,
+		Options: options,
+		Confirm: confirm,
+		Log:     log,
+	}, nil
+}
+
+// ターミナルでy/Nの確認を求める
+func confirm(message string) bool {
+	reader := bufio.NewReader(os.Stdin)
+	fmt.Printf("⌨️ %s [y/N]: ", message)
+	answer, _ := reader.ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// identifierが指定されていない場合はユーザー入力を受け取る
+func promptIdentifier() string {
+	reader := bufio.NewReader(os.Stdin)
+	fmt.Print("⌨️ Please type identifier: ")
+
+	identifier, _ := reader.ReadString('\n')
+	// 改行タグを削除
+	identifier = strings.TrimSpace(identifier)
+
+	fmt.Printf("Identifier: %s\n", identifier)
+	return identifier
+}
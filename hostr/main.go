@@ -3,12 +3,18 @@ package main
 import (
 	_ "embed"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
 
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/nbd-wtf/go-nostr/nip19"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/archive"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/config"
 	"github.com/studiokaiji/nostr-webhost/hostr/cmd/deploy"
 	"github.com/studiokaiji/nostr-webhost/hostr/cmd/keystore"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/paths"
 	"github.com/studiokaiji/nostr-webhost/hostr/cmd/relays"
 	"github.com/studiokaiji/nostr-webhost/hostr/cmd/server"
 	"github.com/urfave/cli/v2"
@@ -17,6 +23,35 @@ import (
 //go:embed cute-ostrich.txt
 var cuteOstrich string
 
+const (
+	exitCodeError = 1
+	// --min-relaysを満たすリレーにpublishできなかった場合
+	exitCodePublishFailed = 2
+	// リレーに保存されたイベントがデプロイしたものと一致しなかった場合
+	exitCodeVerifyFailed = 3
+)
+
+var publishRetriesFlag = &cli.IntFlag{
+	Name:  "retries",
+	Value: 2,
+	Usage: "Number of times to retry connecting and publishing to each relay",
+}
+
+var minRelaysFlag = &cli.IntFlag{
+	Name:  "min-relays",
+	Value: 1,
+	Usage: "Minimum number of relays that must accept every event, otherwise exit with code 2",
+}
+
+var profileFlag = &cli.StringFlag{
+	Name:    "profile",
+	Usage:   "Key profile to use instead of the one selected with 'hostr key use'",
+	EnvVars: []string{"HOSTR_PROFILE"},
+	Action: func(ctx *cli.Context, v string) error {
+		return paths.SetProfile(v)
+	},
+}
+
 func main() {
 	app := &cli.App{
 		Commands: []*cli.Command{
@@ -36,6 +71,11 @@ Relay configuration:
 						Value:   "./",
 						Usage:   "Site directory",
 					},
+					&cli.StringFlag{
+						Name:    "archive",
+						Aliases: []string{"a"},
+						Usage:   "Deploy the site from a .tar, .tar.gz or .zip archive instead of --path ('-' reads it from stdin)",
+					},
 					&cli.BoolFlag{
 						Name:    "replaceable",
 						Aliases: []string{"r"},
@@ -47,46 +87,435 @@ Relay configuration:
 						Aliases: []string{"d"},
 						Usage:   "index.html identifier (valid only if replaceable option is true)",
 					},
+					&cli.BoolFlag{
+						Name:    "force",
+						Aliases: []string{"f"},
+						Usage:   "Ignore the previous deploy manifest and republish every file",
+					},
+					&cli.StringFlag{
+						Name:    "uploader",
+						Value:   "nostrcheck",
+						Usage:   "Media upload backend ('nostrcheck', 'blossom' or 'nip96')",
+						EnvVars: []string{"HOSTR_UPLOADER"},
+						Action: func(ctx *cli.Context, v string) error {
+							if v != "nostrcheck" && v != "blossom" && v != "nip96" {
+								return fmt.Errorf("Invalid uploader flag. Must be 'nostrcheck', 'blossom' or 'nip96'.")
+							}
+							return nil
+						},
+					},
+					&cli.StringFlag{
+						Name:    "upload-server",
+						Usage:   "Media upload server URL (required for 'blossom' and 'nip96')",
+						EnvVars: []string{"HOSTR_UPLOAD_SERVER"},
+					},
+					&cli.StringFlag{
+						Name:  "media-mode",
+						Value: "upload",
+						Usage: "Where to store media files ('upload' to the upload server, or 'relay' as NIP-95 events)",
+						Action: func(ctx *cli.Context, v string) error {
+							if v != "upload" && v != "relay" {
+								return fmt.Errorf("Invalid media-mode flag. Must be 'upload' or 'relay'.")
+							}
+							return nil
+						},
+					},
+					&cli.StringFlag{
+						Name:  "compress",
+						Value: "none",
+						Usage: "Compress HTML, CSS, JS and text file events ('none', 'gzip' or 'br')",
+						Action: func(ctx *cli.Context, v string) error {
+							if v != "none" && v != "gzip" && v != "br" {
+								return fmt.Errorf("Invalid compress flag. Must be 'none', 'gzip' or 'br'.")
+							}
+							return nil
+						},
+					},
+					publishRetriesFlag,
+					minRelaysFlag,
+					profileFlag,
+					&cli.BoolFlag{
+						Name:  "verify",
+						Usage: "Read every event back from every relay after publishing, otherwise exit with code 3",
+					},
+					&cli.StringFlag{
+						Name:  "gateway",
+						Usage: "Gateway URL shown after deploy (defaults to " + config.DefaultGateway + ")",
+					},
+					&cli.BoolFlag{
+						Name:  "gitignore",
+						Usage: "Also exclude files listed in the site's .gitignore (.hostrignore is always honoured)",
+					},
+					&cli.BoolFlag{
+						Name:  "include-hidden",
+						Usage: "Deploy files and directories whose names start with a dot",
+					},
+					&cli.BoolFlag{
+						Name:  "spa",
+						Usage: "Serve index.html for paths that match no file (replaceable sites only)",
+					},
+					&cli.BoolFlag{
+						Name:    "verbose",
+						Aliases: []string{"v"},
+						Usage:   "Show excluded files",
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "Print the deploy plan without uploading, signing or publishing anything",
+					},
+					&cli.BoolFlag{
+						Name:    "watch",
+						Aliases: []string{"w"},
+						Usage:   "Keep running and republish the changed files whenever --path changes",
+					},
+					&cli.BoolFlag{
+						Name:  "ci",
+						Usage: "Never prompt, log line by line to stderr and print a JSON result to stdout (enabled when the CI environment variable is set)",
+					},
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Value:   "text",
+						Usage:   "Output format of the dry-run plan ('text' or 'json')",
+						Action: func(ctx *cli.Context, v string) error {
+							if v != "text" && v != "json" {
+								return fmt.Errorf("Invalid output flag. Must be 'text' or 'json'.")
+							}
+							return nil
+						},
+					},
 				},
 				Action: func(ctx *cli.Context) error {
-					fmt.Println("🌐 Deploying...")
+					dryRun := ctx.Bool("dry-run")
+					output := ctx.String("output")
+					ci := isCI(ctx)
 
+					// 計画やCIの結果をjsonで出力する場合はログを標準エラー出力に流す
+					var logOutput io.Writer = os.Stdout
+					if (dryRun && output == "json") || ci {
+						logOutput = os.Stderr
+					}
+					if ci {
+						keystore.SetInteractive(false)
+					}
+
+					// hostr.tomlの値はフラグで上書きできる
+					projectConfig, err := loadProjectConfig(ctx.String("path"), logOutput)
+					if err != nil {
+						if ci && !dryRun {
+							(&deploy.Result{}).Write(os.Stdout, err, exitCodeFor(err))
+						}
+						return err
+					}
 					path := ctx.String("path")
-					replaceable := ctx.Bool("replaceable")
-					dTag := ctx.String("identifier")
+					if !ctx.IsSet("path") && len(projectConfig.Path) > 0 {
+						path = projectConfig.SitePath()
+					}
+					replaceable := boolFlagOrConfig(ctx, "replaceable", projectConfig.Replaceable)
+					dTag := stringFlagOrConfig(ctx, "identifier", projectConfig.Identifier)
+					gateway := stringFlagOrConfig(ctx, "gateway", projectConfig.Gateway)
+					if len(gateway) < 1 {
+						gateway = config.DefaultGateway
+					}
 
-					_, encoded, dTag, err := deploy.Deploy(path, replaceable, dTag)
-					if err == nil {
-						fmt.Println("🌐 Deploy Complete!")
+					options := deploy.Options{
+						Force:          ctx.Bool("force"),
+						DryRun:         dryRun,
+						Uploader:       stringFlagOrConfig(ctx, "uploader", projectConfig.Upload.Uploader),
+						UploadServer:   stringFlagOrConfig(ctx, "upload-server", projectConfig.Upload.Server),
+						MediaMode:      stringFlagOrConfig(ctx, "media-mode", projectConfig.Upload.MediaMode),
+						Compression:    ctx.String("compress"),
+						Retries:        ctx.Int("retries"),
+						MinRelays:      ctx.Int("min-relays"),
+						Verify:         ctx.Bool("verify"),
+						GitIgnore:      boolFlagOrConfig(ctx, "gitignore", &projectConfig.Ignore.GitIgnore),
+						IncludeHidden:  boolFlagOrConfig(ctx, "include-hidden", &projectConfig.Ignore.IncludeHidden),
+						IgnorePatterns: projectConfig.Ignore.Patterns,
+						Verbose:        ctx.Bool("verbose"),
+						MimeTypes:      projectConfig.MIME,
+						SPA:            boolFlagOrConfig(ctx, "spa", &projectConfig.SPA),
+						PlainProgress:  ci,
+					}
+
+					if profile, err := paths.GetProfile(); err == nil && profile != paths.DefaultProfile {
+						fmt.Fprintln(logOutput, "👤 Using profile", profile)
+					}
+					fmt.Fprintln(logOutput, "🌐 Deploying...")
+
+					watch := ctx.Bool("watch")
+					if watch && (len(ctx.String("archive")) > 0 || dryRun || ci) {
+						err := fmt.Errorf("--watch cannot be combined with --archive, --dry-run or --ci")
+						fmt.Fprintln(logOutput, "❌", err)
+						return err
+					}
+
+					// アーカイブからデプロイする場合はアーカイブの中身をサイトとして扱う
+					var siteFS fs.FS
+					archiveName := ctx.String("archive")
+					if len(archiveName) > 0 {
+						siteFS, err = archive.Open(archiveName, os.Stdin)
+						if err != nil {
+							fmt.Fprintln(logOutput, "❌ Failed to open archive:", err)
+							if ci && !dryRun {
+								(&deploy.Result{}).Write(os.Stdout, err, exitCodeFor(err))
+							}
+							return err
+						}
+						path = archiveName
+					}
+
+					// CIと標準入力からアーカイブを読み込んだ場合はidentifierがない場合にエラーにする
+					if replaceable && len(dTag) < 1 && !ci && archiveName != archive.Stdin {
+						dTag = promptIdentifier()
+					}
 
-						pubkey, err := keystore.GetPublic()
+					if watch {
+						deployer, err := newDeployer(options, logOutput)
 						if err != nil {
-							os.Exit(1)
+							return err
 						}
-						npub, err := nip19.EncodePublicKey(pubkey)
+						return watchDeploy(deployer, path, replaceable, dTag, gateway)
+					}
+
+					result := &deploy.Result{}
+					deployer, err := newDeployer(options, logOutput)
+					if err == nil {
+						deployer.FS = siteFS
+						result, err = deployer.Deploy(path, replaceable, dTag)
+					}
+					if err == nil && dryRun {
+						return result.Plan.Write(os.Stdout, output)
+					}
+
+					var urls *accessURLs
+					if err == nil {
+						fmt.Fprintln(logOutput, "🌐 Deploy Complete!")
+						urls, err = getAccessURLs(gateway, replaceable, dTag, result.Nevent)
 						if err != nil {
-							os.Exit(1)
+							fmt.Fprintln(logOutput, "❌ Failed to get access URLs:", err)
 						}
+					}
+
+					if ci {
+						if urls != nil {
+							result.URLs = map[string]string{
+								"default": urls.defaultMode,
+								"secure":  urls.secureMode,
+							}
+						}
+						result.Write(os.Stdout, err, exitCodeFor(err))
+						return err
+					}
+
+					if urls != nil {
+						fmt.Fprintln(logOutput, "\n\033[1m========= 🚵 Access To =========\033")
+
+						fmt.Fprintf(logOutput, "\n\033[1m🗃️  Default Mode:\033[0m\n\x1b[36m%s\x1b[0m\n", urls.defaultMode)
+						fmt.Fprintf(logOutput, "\033[1m\n🔑 Secure Mode:\033[0m\n\x1b[36m%s\x1b[0m\n", urls.secureMode)
+
+						fmt.Fprintf(logOutput, "\n\x1b[90m%s is just one endpoint, so depending on the relay configuration, it may not be accessible.\x1b[0m\n", urls.gatewayHost)
+
+						fmt.Fprintf(logOutput, "\n\033[1m=================================\033\n")
+					}
+					return err
+				},
+			},
+			{
+				Name:  "init",
+				Usage: "📝 Create hostr.toml in the current directory",
+				Description: `Create a hostr.toml holding the deploy settings of this project.
+
+hostr deploy, rollback, verify and delete look for hostr.toml from --path (or the current directory) upward.
+Command line flags override the values in hostr.toml.`,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "path",
+						Aliases: []string{"p"},
+						Usage:   "Site directory relative to hostr.toml (defaults to dist, build, public or out if it contains index.html)",
+					},
+					&cli.StringFlag{
+						Name:    "identifier",
+						Aliases: []string{"d"},
+						Usage:   "index.html identifier (defaults to the name of the current directory)",
+					},
+					&cli.BoolFlag{
+						Name:    "force",
+						Aliases: []string{"f"},
+						Usage:   "Overwrite an existing hostr.toml",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					dir, err := filepath.Abs("./")
+					if err != nil {
+						return err
+					}
+
+					projectConfig := &config.Config{
+						Path:       ctx.String("path"),
+						Identifier: ctx.String("identifier"),
+					}
+					if len(projectConfig.Path) < 1 {
+						projectConfig.Path = config.GuessSitePath(dir)
+					}
+					if len(projectConfig.Identifier) < 1 {
+						projectConfig.Identifier = filepath.Base(dir)
+					}
+					// 現在のリレーを初期値にする
+					if allRelays, err := relays.GetAllRelays(); err == nil {
+						projectConfig.Relays = allRelays
+					}
+
+					filePath, err := config.Init(dir, projectConfig, ctx.Bool("force"))
+					if err != nil {
+						fmt.Println("❌ Failed to create", config.FileName+":", err)
+						return err
+					}
 
-						defaultModeUrl := "https://h.hostr.cc"
-						secureModeUrl := fmt.Sprintf("https://%s.hostr.cc", npub)
+					fmt.Println("📝 Created", filePath)
+					return nil
+				},
+			},
+			{
+				Name:  "rollback",
+				Usage: "⏪ Roll back a replaceable site to a previous version",
+				Description: `Republish a previous deployment of a replaceable site with a fresh created_at.
+
+Versions are read from the local deploy history (~/.nostr-webhost/history).
+A site manifest event id that is not in the history is looked up on relays that retain older events.`,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "identifier",
+						Aliases: []string{"d"},
+						Usage:   "index.html identifier of the site (defaults to the identifier in hostr.toml)",
+					},
+					&cli.StringFlag{
+						Name:  "to",
+						Usage: "Version number or site manifest event id to roll back to (defaults to the previous version)",
+					},
+					publishRetriesFlag,
+					minRelaysFlag,
+					profileFlag,
+				},
+				Action: func(ctx *cli.Context) error {
+					// hostr.tomlのリレーを使うため、identifierを指定した場合も読み込む
+					projectConfig, err := loadProjectConfig("./", os.Stdout)
+					if err != nil {
+						return err
+					}
+					dTag, err := identifierFlagOrConfig(ctx, projectConfig)
+					if err != nil {
+						return err
+					}
+
+					deployer, err := newDeployer(deploy.Options{
+						Retries:   ctx.Int("retries"),
+						MinRelays: ctx.Int("min-relays"),
+					}, os.Stdout)
+					if err != nil {
+						return err
+					}
+
+					version, err := deployer.Rollback(dTag, ctx.String("to"))
+					if err == nil {
+						fmt.Println("⏪ Rolled back", dTag, "as version", version)
+					}
+					return err
+				},
+			},
+			{
+				Name:  "delete",
+				Usage: "🗑 Delete a deployed site",
+				Description: `Publish NIP-09 deletion requests for every event of a site and delete uploaded media.
+
+A replaceable site is found by its identifier, including all files under it.
+A non-replaceable site is found by following the references from its index.html event.`,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "identifier",
+						Aliases: []string{"d"},
+						Usage:   "index.html identifier of a replaceable site (defaults to the identifier in hostr.toml)",
+					},
+					&cli.StringFlag{
+						Name:  "event",
+						Usage: "index.html event id (hex or nevent) of a non-replaceable site",
+					},
+					&cli.BoolFlag{
+						Name:    "yes",
+						Aliases: []string{"y"},
+						Usage:   "Delete without confirmation",
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "Print the events and media to delete without publishing anything",
+					},
+					publishRetriesFlag,
+					minRelaysFlag,
+					profileFlag,
+				},
+				Action: func(ctx *cli.Context) error {
+					// --eventで指定した場合もhostr.tomlのリレーに削除リクエストを送る
+					projectConfig, err := loadProjectConfig("./", os.Stdout)
+					if err != nil {
+						return err
+					}
 
-						if replaceable {
-							defaultModeUrl = fmt.Sprintf("%s/p/%s/d/%s", defaultModeUrl, npub, dTag)
-							secureModeUrl = fmt.Sprintf("%s/d/%s", secureModeUrl, dTag)
-						} else {
-							defaultModeUrl = fmt.Sprintf("%s/e/%s", defaultModeUrl, encoded)
-							secureModeUrl = fmt.Sprintf("%s/e/%s", secureModeUrl, encoded)
+					dTag := ""
+					event := ctx.String("event")
+					if len(event) < 1 {
+						dTag, err = identifierFlagOrConfig(ctx, projectConfig)
+						if err != nil {
+							return err
 						}
+					} else if ctx.IsSet("identifier") {
+						return fmt.Errorf("Specify either --identifier or --event.")
+					}
 
-						fmt.Println("\n\033[1m========= 🚵 Access To =========\033")
+					deployer, err := newDeployer(deploy.Options{
+						DryRun:    ctx.Bool("dry-run"),
+						Retries:   ctx.Int("retries"),
+						MinRelays: ctx.Int("min-relays"),
+						Yes:       ctx.Bool("yes"),
+					}, os.Stdout)
+					if err != nil {
+						return err
+					}
 
-						fmt.Printf("\n\033[1m🗃️  Default Mode:\033[0m\n\x1b[36m%s\x1b[0m\n", defaultModeUrl)
-						fmt.Printf("\033[1m\n🔑 Secure Mode:\033[0m\n\x1b[36m%s\x1b[0m\n", secureModeUrl)
+					count, err := deployer.Delete(dTag, event)
+					if err == nil && count > 0 {
+						fmt.Println("🗑 Requested deletion of", count, "events")
+					}
+					return err
+				},
+			},
+			{
+				Name:  "verify",
+				Usage: "🔍 Verify that every relay holds the deployed site",
+				Flags: []cli.Flag{
+					profileFlag,
+					&cli.StringFlag{
+						Name:    "identifier",
+						Aliases: []string{"d"},
+						Usage:   "index.html identifier of the site (defaults to the identifier in hostr.toml)",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					projectConfig, err := loadProjectConfig("./", os.Stdout)
+					if err != nil {
+						return err
+					}
+					dTag, err := identifierFlagOrConfig(ctx, projectConfig)
+					if err != nil {
+						return err
+					}
 
-						fmt.Printf("\n\x1b[90mh.hostr.cc is just one endpoint, so depending on the relay configuration, it may not be accessible.\x1b[0m\n")
+					deployer, err := newDeployer(deploy.Options{}, os.Stdout)
+					if err != nil {
+						return err
+					}
 
-						fmt.Printf("\n\033[1m=================================\033\n")
+					_, err = deployer.Verify(dTag)
+					if err == nil {
+						fmt.Println("🔍 All relays hold", dTag)
 					}
 					return err
 				},
@@ -94,6 +523,7 @@ Relay configuration:
 			{
 				Name:  "add-relay",
 				Usage: "📌 Add nostr relay",
+				Flags: []cli.Flag{profileFlag},
 				Action: func(ctx *cli.Context) error {
 					args := ctx.Args()
 					relay := args.Get(args.Len() - 1)
@@ -107,6 +537,7 @@ Relay configuration:
 			{
 				Name:  "remove-relay",
 				Usage: "🗑  Remove nostr relay",
+				Flags: []cli.Flag{profileFlag},
 				Action: func(ctx *cli.Context) error {
 					args := ctx.Args()
 					relay := args.Get(args.Len() - 1)
@@ -120,6 +551,7 @@ Relay configuration:
 			{
 				Name:  "list-relays",
 				Usage: "📝 List added nostr relays",
+				Flags: []cli.Flag{profileFlag},
 				Action: func(ctx *cli.Context) error {
 					relays, err := relays.GetAllRelays()
 					fmt.Println("===========================")
@@ -133,6 +565,7 @@ Relay configuration:
 			{
 				Name:  "set-private",
 				Usage: "🔐 Set private key",
+				Flags: []cli.Flag{profileFlag},
 				Action: func(ctx *cli.Context) error {
 					args := ctx.Args()
 					key := args.Get(args.Len() - 1)
@@ -143,9 +576,44 @@ Relay configuration:
 					return err
 				},
 			},
+			{
+				Name:      "set-bunker",
+				Usage:     "🧷 Sign with a NIP-46 remote signer instead of a private key",
+				ArgsUsage: "bunker://...",
+				Flags: []cli.Flag{
+					profileFlag,
+					&cli.BoolFlag{
+						Name:  "remove",
+						Usage: "Stop using the remote signer",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					if ctx.Bool("remove") {
+						err := keystore.RemoveBunker()
+						if err == nil {
+							fmt.Println("🧷 Bunker is removed")
+						}
+						return err
+					}
+
+					bunkerURL := ctx.Args().First()
+					if len(bunkerURL) < 1 {
+						return fmt.Errorf("Please specify a bunker:// URL")
+					}
+					pubKey, err := keystore.SetBunker(bunkerURL)
+					if err != nil {
+						fmt.Println("❌ Failed to connect to bunker:", err)
+						return err
+					}
+					npub, _ := nip19.EncodePublicKey(pubKey)
+					fmt.Println("🧷 Bunker is recorded. Signing as", npub)
+					return nil
+				},
+			},
 			{
 				Name:  "show-public",
 				Usage: "📛 Show public key",
+				Flags: []cli.Flag{profileFlag},
 				Action: func(ctx *cli.Context) error {
 					_, _, err := keystore.ShowPublic()
 					return err
@@ -154,6 +622,7 @@ Relay configuration:
 			{
 				Name:  "generate-key",
 				Usage: "🗝  Generate key",
+				Flags: []cli.Flag{profileFlag},
 				Action: func(ctx *cli.Context) error {
 					key := nostr.GeneratePrivateKey()
 					err := keystore.SetSecret(key)
@@ -163,6 +632,161 @@ Relay configuration:
 					return err
 				},
 			},
+			{
+				Name:  "export-key",
+				Usage: "📤 Print the private key encrypted as NIP-49 ncryptsec",
+				Flags: []cli.Flag{profileFlag},
+				Action: func(ctx *cli.Context) error {
+					ncryptsec, err := keystore.ExportSecret()
+					if err != nil {
+						fmt.Println("❌ Failed to export key:", err)
+						return err
+					}
+					fmt.Println(ncryptsec)
+					return nil
+				},
+			},
+			{
+				Name:      "import-key",
+				Usage:     "📥 Import a NIP-49 ncryptsec private key",
+				ArgsUsage: "ncryptsec1...",
+				Flags:     []cli.Flag{profileFlag},
+				Action: func(ctx *cli.Context) error {
+					err := keystore.ImportSecret(ctx.Args().First())
+					if err != nil {
+						fmt.Println("❌ Failed to import key:", err)
+						return err
+					}
+					fmt.Println("🔐 Secret is recorded")
+					return nil
+				},
+			},
+			{
+				Name:  "key",
+				Usage: "👤 Manage named key profiles",
+				Description: `Keep several identities (for example personal, staging and production) side by side.
+
+Each profile has its own private key or bunker and may have its own relays (add-relay --profile <name>).
+The keys set with set-private, set-bunker and generate-key without --profile belong to the 'default' profile.`,
+				Subcommands: []*cli.Command{
+					{
+						Name:      "add",
+						Usage:     "Add a profile with a new or given key",
+						ArgsUsage: "<name> [nsec, hex or ncryptsec private key]",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "bunker",
+								Usage: "Sign with a NIP-46 remote signer (bunker://...) instead of a private key",
+							},
+							&cli.StringSliceFlag{
+								Name:  "relay",
+								Usage: "Relay used only by this profile (can be repeated)",
+							},
+						},
+						Action: func(ctx *cli.Context) error {
+							name := ctx.Args().First()
+							key := ctx.Args().Get(1)
+							bunkerURL := ctx.String("bunker")
+							if len(key) > 0 && len(bunkerURL) > 0 {
+								return fmt.Errorf("Specify either a private key or --bunker.")
+							}
+
+							err := paths.CreateProfile(name)
+							if err != nil {
+								return err
+							}
+							err = addProfileKey(name, key, bunkerURL, ctx.StringSlice("relay"))
+							if err != nil {
+								// やり直せるよう作成途中のプロファイルを削除する
+								paths.RemoveProfile(name)
+								fmt.Println("❌ Failed to add profile:", err)
+								return err
+							}
+
+							fmt.Printf("👤 Added profile %s. Run 'hostr key use %s' to use it by default\n", name, name)
+							return nil
+						},
+					},
+					{
+						Name:      "use",
+						Usage:     "Use a profile when --profile is not specified",
+						ArgsUsage: "<name>",
+						Action: func(ctx *cli.Context) error {
+							name := ctx.Args().First()
+							err := paths.UseProfile(name)
+							if err == nil {
+								fmt.Println("👤 Using profile", name)
+							}
+							return err
+						},
+					},
+					{
+						Name:  "list",
+						Usage: "List profiles",
+						Action: func(ctx *cli.Context) error {
+							current, err := paths.GetProfile()
+							if err != nil {
+								return err
+							}
+							names, err := paths.ListProfiles()
+							if err != nil {
+								return err
+							}
+
+							fmt.Println("===========================")
+							for _, name := range names {
+								if err := paths.SetProfile(name); err != nil {
+									return err
+								}
+								npub := "(public key unknown)"
+								if pubKey, err := keystore.PeekPublic(); err == nil && len(pubKey) > 0 {
+									npub, _ = nip19.EncodePublicKey(pubKey)
+								}
+
+								marker := " "
+								if name == current {
+									marker = "*"
+								}
+								fmt.Printf("%s %-12s %s\n", marker, name, npub)
+							}
+							fmt.Println("===========================")
+							return nil
+						},
+					},
+					{
+						Name:      "remove",
+						Usage:     "Remove a profile and its private key",
+						ArgsUsage: "<name>",
+						Flags: []cli.Flag{
+							&cli.BoolFlag{
+								Name:    "yes",
+								Aliases: []string{"y"},
+								Usage:   "Remove without confirmation",
+							},
+						},
+						Action: func(ctx *cli.Context) error {
+							name := ctx.Args().First()
+							if err := paths.ValidateProfileName(name); err != nil {
+								return err
+							}
+
+							if !ctx.Bool("yes") {
+								fmt.Printf("⚠️  The private key of %s is deleted. Back it up first with 'hostr export-key --profile %s'\n", name, name)
+								if !confirm("Remove the profile?") {
+									fmt.Println("Canceled.")
+									return nil
+								}
+							}
+
+							err := paths.RemoveProfile(name)
+							if err == nil {
+								fmt.Println("🗑  Removed profile", name)
+							}
+							return err
+						},
+					},
+				},
+			},
 			{
 				Name:  "start",
 				Usage: "🕺 Wake up web server",
@@ -191,11 +815,17 @@ Relay configuration:
 							return nil
 						},
 					},
+					&cli.StringFlag{
+						Name:    "auth-key",
+						Usage:   "Gateway private key (nsec or hex) used to answer NIP-42 AUTH from relays",
+						EnvVars: []string{"HOSTR_AUTH_KEY"},
+					},
 				},
 				Action: func(ctx *cli.Context) error {
 					port := ctx.String("port")
 					mode := ctx.String("mode")
-					server.Start(port, mode)
+					authKey := ctx.String("auth-key")
+					server.Start(port, mode, authKey)
 					return nil
 				},
 			},
@@ -210,6 +840,8 @@ Relay configuration:
 	// Start app
 	err := app.Run(os.Args)
 	if err != nil {
-		fmt.Println(err)
+		// jsonの出力と混ざらないよう標準エラー出力に出す
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitCodeFor(err))
 	}
 }
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/keystore"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/nip49"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/paths"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/relays"
+)
+
+// 作成したプロファイルに鍵とリレーを設定する。鍵もbunkerも指定されない場合は鍵を生成する
+func addProfileKey(name, key, bunkerURL string, relayURLs []string) error {
+	if err := paths.SetProfile(name); err != nil {
+		return err
+	}
+
+	var err error
+	switch {
+	case len(bunkerURL) > 0:
+		_, err = keystore.SetBunker(bunkerURL)
+	case nip49.IsNcryptsec(key):
+		err = keystore.ImportSecret(key)
+	case len(key) > 0:
+		err = keystore.SetSecret(key)
+	default:
+		err = keystore.SetSecret(nostr.GeneratePrivateKey())
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, relayURL := range relayURLs {
+		if err := relays.AddRelay(relayURL); err != nil {
+			return err
+		}
+	}
+
+	pubKey, err := keystore.GetPublic()
+	if err != nil {
+		return err
+	}
+	npub, err := nip19.EncodePublicKey(pubKey)
+	if err != nil {
+		return err
+	}
+	fmt.Println("📛", name, "signs as", npub)
+	return nil
+}
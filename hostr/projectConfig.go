@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/config"
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/relays"
+	"github.com/urfave/cli/v2"
+)
+
+// pathから親ディレクトリへ辿ってhostr.tomlを読み込み、指定されたリレーを使うよう設定する。
+// 見つからない場合は空の設定を返す
+func loadProjectConfig(path string, log io.Writer) (*config.Config, error) {
+	projectConfig, err := config.Load(path)
+	if err != nil {
+		fmt.Fprintln(log, "❌ Failed to load", config.FileName+":", err)
+		return nil, err
+	}
+	if projectConfig == nil {
+		return &config.Config{}, nil
+	}
+
+	fmt.Fprintln(log, "⚙️ Using", projectConfig.FilePath)
+	relays.SetProjectRelays(projectConfig.Relays)
+
+	return projectConfig, nil
+}
+
+// フラグ(環境変数を含む)が指定されていなければhostr.tomlの値を使う
+func stringFlagOrConfig(ctx *cli.Context, name, value string) string {
+	if ctx.IsSet(name) || len(value) < 1 {
+		return ctx.String(name)
+	}
+	return value
+}
+
+func boolFlagOrConfig(ctx *cli.Context, name string, value *bool) bool {
+	if ctx.IsSet(name) || value == nil {
+		return ctx.Bool(name)
+	}
+	return *value
+}
+
+// --identifierが指定されていなければhostr.tomlのidentifierを使う
+func identifierFlagOrConfig(ctx *cli.Context, projectConfig *config.Config) (string, error) {
+	dTag := stringFlagOrConfig(ctx, "identifier", projectConfig.Identifier)
+	if len(dTag) < 1 {
+		return "", fmt.Errorf("Required flag \"identifier\" not set")
+	}
+	return dTag, nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/studiokaiji/nostr-webhost/hostr/cmd/deploy"
+)
+
+// Ctrl+Cで止めるまでサイトの変更を監視し、デプロイのたびに変更されたイベントの数とURLを表示する
+func watchDeploy(deployer *deploy.Deployer, path string, replaceable bool, dTag, gateway string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	return deployer.Watch(ctx, path, replaceable, dTag, func(result *deploy.Result, err error) {
+		if err != nil {
+			fmt.Println("❌ Deploy failed:", err)
+			return
+		}
+
+		published, skipped := 0, 0
+		for _, entry := range result.Plan.Files {
+			if entry.Action == deploy.PlanActionSkip {
+				skipped++
+			} else {
+				published++
+			}
+		}
+		fmt.Printf("🌐 Deploy Complete! %d published, %d unchanged\n", published, skipped)
+
+		urls, err := getAccessURLs(gateway, replaceable, dTag, result.Nevent)
+		if err != nil {
+			fmt.Println("❌ Failed to get access URLs:", err)
+			return
+		}
+		fmt.Printf("\x1b[36m%s\x1b[0m\n", urls.defaultMode)
+	})
+}